@@ -0,0 +1,30 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+// InboundAnswerReasoner can be implemented by an MBoxHandler to give a reason when rejecting or deferring a proposal.
+//
+// If the session's handler implements this interface, AnswerInbound is used instead of
+// GetInboundAnswer.
+//
+// The B2F protocol has no way of telling the remote why a proposal was refused, as each
+// proposal is answered by a single character in the FS line. The reason is recorded locally
+// only (see TrafficStats.Refused).
+type InboundAnswerReasoner interface {
+	AnswerInbound(p Proposal) (answer ProposalAnswer, reason string)
+}
+
+// Refusal is an inbound proposal that was rejected or deferred.
+type Refusal struct {
+	MID    string
+	Answer ProposalAnswer // Reject or Defer.
+	Reason string         // Why the proposal was refused (empty if unknown).
+}
+
+// refuse records an inbound proposal that was rejected or deferred, along with the reason.
+func (s *Session) refuse(p *Proposal, answer ProposalAnswer, reason string) {
+	p.answer = answer
+	s.trafficStats.Refused = append(s.trafficStats.Refused, Refusal{MID: p.mid, Answer: answer, Reason: reason})
+}
@@ -0,0 +1,76 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// reasonMBox is a memMBox refusing the proposals listed in refuse, with the given reason.
+type reasonMBox struct {
+	*memMBox
+	refuse map[string]Refusal
+}
+
+func (m reasonMBox) AnswerInbound(p Proposal) (ProposalAnswer, string) {
+	if r, ok := m.refuse[p.MID()]; ok {
+		return r.Answer, r.Reason
+	}
+	return Accept, ""
+}
+
+func TestSessionRefusalReason(t *testing.T) {
+	client, master := tcpPipe(t)
+
+	spam := newTestMessage("LA5NTA", "N0CALL", 100)
+	later := newTestMessage("LA5NTA", "N0CALL", 200)
+	valid := newTestMessage("LA5NTA", "N0CALL", 300)
+
+	expected := []Refusal{
+		{MID: spam.MID(), Answer: Reject, Reason: "spam"},
+		{MID: later.MID(), Answer: Defer, Reason: "mailbox full"},
+	}
+	mbox := reasonMBox{newMemMBox(), map[string]Refusal{}}
+	for _, r := range expected {
+		mbox.refuse[r.MID] = r
+	}
+
+	cs := NewSession("LA5NTA", "N0CALL", "JO39EQ", newMemMBox(spam, later, valid))
+	ms := NewSession("N0CALL", "LA5NTA", "JO39EQ", mbox)
+	ms.IsMaster(true)
+
+	errs := make(chan error, 1)
+	go func() { _, err := cs.Exchange(client); errs <- err }()
+	stats, err := ms.Exchange(master)
+	if err != nil {
+		t.Fatalf("Exchange failed: %s", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Client exchange failed: %s", err)
+	}
+
+	if !reflect.DeepEqual(stats.Refused, expected) {
+		t.Errorf("Unexpected refusals.\nGot:      %+v\nExpected: %+v", stats.Refused, expected)
+	}
+	if inbox := mbox.inbox(); len(inbox) != 1 || inbox[0].MID() != valid.MID() {
+		t.Errorf("Expected only %s to be received", valid.MID())
+	}
+}
+
+func TestSessionRefusalInternalReasons(t *testing.T) {
+	s := NewSession("N0CALL", "LA5NTA", "JO39EQ", newMemMBox())
+	s.SetDirection(Send)
+
+	props := []*Proposal{{mid: "A", code: Wl2kProposal}, {mid: "A", code: Wl2kProposal}}
+	if _, err := s.writeProposalsAnswer(&bytes.Buffer{}, props); err != nil {
+		t.Fatal(err)
+	}
+	expected := []Refusal{{"A", Defer, "send only"}, {"A", Defer, "duplicate"}}
+	if !reflect.DeepEqual(s.trafficStats.Refused, expected) {
+		t.Errorf("Unexpected refusals: %+v", s.trafficStats.Refused)
+	}
+}
@@ -12,24 +12,43 @@ import (
 	"io"
 	"log"
 	"mime"
+	"net"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/la5nta/wl2k-go/transport"
 )
 
 var ErrOffsetLimitExceeded error = errors.New("Protocol does not support offset larger than 6 digits")
 
+var ErrAborted = errors.New("Exchange aborted")
+
+// ErrTurnoverTimeout is returned when the remote does not respond to our session turnover in time.
+//
+// See Session.SetTurnoverTimeout.
+var ErrTurnoverTimeout = errors.New("Timeout waiting for the remote after session turnover")
+
 const (
 	ProtocolOffsetSizeLimit = 999999
-	MaxBlockSize            = 5
+
+	// The maximum number of proposals in a block. Outbound messages are always proposed in
+	// blocks of up to this many messages, which are transferred in the same turn of the session.
+	MaxBlockSize = 5
 
 	// Paclink-unix uses 250, protocol maximum is 255, but we use 125 to allow use of AX.25 links with a paclen of 128.
-	// TODO: Consider setting this dynamically.
+	// See Session.SetBlockSize.
 	MaxMsgLength = 125
+
+	// The protocol's maximum length of a compressed data block.
+	MaxBlockLength = 255
 )
 
+// The length of the header (CRC16 and uncompressed size) at the start of lzhuf compressed data.
+const lzhufHeaderLength = 6
+
 const (
 	cmdPrefix = 'F'
 	cmdPrompt = '>'
@@ -50,6 +69,7 @@ const (
 	_CHRSOH      = 1
 	_CHRSTX      = 2
 	_CHREOT      = 4
+	_CHRSUB      = 26 // Ctrl-Z, end of message in the basic protocol
 )
 
 func (s *Session) handleOutbound(rw io.ReadWriter) (quitSent bool, err error) {
@@ -66,13 +86,18 @@ func (s *Session) handleOutbound(rw io.ReadWriter) (quitSent bool, err error) {
 	// Report rejected now, they can safely be omitted even if an error occures
 	for mid, rej := range sent {
 		if rej {
-			s.h.SetSent(mid, rej)
+			s.outboundHandler().SetSent(mid, rej)
+			s.transfers.Forget(mid)
 			delete(sent, mid)
 		}
 	}
 
-	// If all messages was deferred/rejected, we should propose new messages
-	if len(sent) == 0 && len(s.outbound()) > 0 {
+	// If all messages was deferred/rejected, we should propose new messages.
+	//
+	// The exception is when the remote asked us to hold messages, which is the closest thing
+	// to flow control in B2F. We then pause our propositions by turning the session over,
+	// and resume proposing in our next turn.
+	if len(sent) == 0 && !s.remoteHold && len(s.outbound()) > 0 {
 		return s.handleOutbound(rw)
 	}
 
@@ -95,36 +120,86 @@ func (s *Session) handleOutbound(rw io.ReadWriter) (quitSent bool, err error) {
 	// The only valid bytes (according to protocol) after a session
 	// turnover is 'F' or ';', so we use those to confirm the block
 	// was successfully received.
-	var p []byte
-	if p, err = s.rd.Peek(1); err != nil {
-		return
-	} else if p[0] != 'F' && p[0] != ';' {
+	for {
+		var p []byte
+		if p, err = s.peekTurnover(rw); err != nil {
+			return
+		} else if p[0] == 'F' || p[0] == ';' {
+			break
+		}
 		var line string
 		line, err = s.nextLine()
 		if err != nil {
 			return
 		}
-		err = fmt.Errorf("Unexpected response: '%s'", line)
-		return
+		if !isSIDLine(line) {
+			err = fmt.Errorf("Unexpected response: '%s'", line)
+			return
+		}
+		// Some implementations renegotiate by sending a new SID header
+		if err = s.handleSIDChange(line); err != nil {
+			return
+		}
 	}
 
 	// Report successfully sent messages
 	for mid, rej := range sent {
-		s.h.SetSent(mid, rej)
+		s.outboundHandler().SetSent(mid, rej)
+		s.transfers.Forget(mid)
 		if !rej {
 			s.trafficStats.Sent = append(s.trafficStats.Sent, mid)
+			s.trafficStats.Messages = append(s.trafficStats.Messages, s.written[mid])
+			s.observeBID(mid, Outbound)
+			s.addMetric(MetricMessagesSent, 1)
+			s.addMetric(MetricBytesSent, float64(s.written[mid].CompressedSize))
 		}
+		delete(s.written, mid)
 	}
 	return
 }
 
+// peekTurnover waits for the remote's response to our session turnover, bounded by the turnover timeout (if set).
+func (s *Session) peekTurnover(rw io.ReadWriter) ([]byte, error) {
+	conn, ok := rw.(interface{ SetReadDeadline(time.Time) error })
+	if s.turnoverTimeout <= 0 || !ok {
+		return s.rd.Peek(1)
+	}
+
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		conn.SetReadDeadline(time.Now().Add(s.turnoverTimeout))
+		p, err := s.rd.Peek(1)
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			return p, ErrTurnoverTimeout
+		} else if err != nil || p[0] != 'F' || !s.keepaliveNegotiated() {
+			return p, err
+		}
+
+		// A keepalive frame restarts the timeout
+		frame, _ := s.rd.Peek(len(keepaliveFrame) + 1)
+		if string(frame) != keepaliveFrame+"\r" {
+			return p, nil
+		}
+		s.rd.Discard(len(frame))
+	}
+}
+
+// blockProposals returns the max number of proposals to send in one block.
+func (s *Session) blockProposals() int {
+	if s.maxInFlight > 0 && s.maxInFlight < MaxBlockSize {
+		return s.maxInFlight
+	}
+	return MaxBlockSize
+}
+
 func (s *Session) sendOutbound(rw io.ReadWriter) (sent map[string]bool, err error) {
 	sent = make(map[string]bool) // Use this to keep track of sent (rejected or not) mids.
 	var checksum int64
+	s.remoteHold = false
 
 	outbound := s.outbound()
-	if len(outbound) > MaxBlockSize {
-		outbound = outbound[0:MaxBlockSize]
+	if n := s.blockProposals(); len(outbound) > n {
+		outbound = outbound[0:n]
 	}
 
 	for _, prop := range outbound {
@@ -136,8 +211,20 @@ func (s *Session) sendOutbound(rw io.ReadWriter) (sent map[string]bool, err erro
 			prop.compressedSize, // Compressed size of message
 			0)                   // ?
 
+		if prop.code == BasicProposal {
+			sp = fmt.Sprintf("F%c %s %s %s %s %s %d",
+				prop.code,      // Proposal code
+				"P",            // Message type (private)
+				prop.from,      // Sender
+				s.Targetcall(), // BBS of recipient
+				prop.to,        // Recipient
+				prop.mid,       // BID
+				prop.size)      // Size of message
+		}
+
 		s.pLog.Printf(">%s", sp)
 		fmt.Fprintf(rw, "%s\r", sp)
+		s.emit(Event{Type: ProposalOffered, MID: prop.mid, Direction: Outbound})
 		for _, c := range sp {
 			checksum += int64(c)
 		}
@@ -158,6 +245,10 @@ func (s *Session) sendOutbound(rw io.ReadWriter) (sent map[string]bool, err erro
 			reply = line // The expected proposal answer
 		case strings.HasPrefix(line, ";"):
 			continue // Ignore comment
+		case isSIDLine(line):
+			if err := s.handleSIDChange(line); err != nil {
+				return sent, err
+			}
 		default:
 			return sent, fmt.Errorf("Expected proposal answer from remote. Got: '%s'", reply)
 		}
@@ -179,23 +270,47 @@ func (s *Session) sendOutbound(rw io.ReadWriter) (sent map[string]bool, err erro
 	for _, prop := range outbound {
 		switch prop.answer {
 		case Defer:
-			s.h.SetDeferred(prop.mid)
+			if prop.code == GzipProposal && !s.gzipRefused[prop.mid] {
+				// The remote might support gzip, but not for this message. Propose it again using lzhuf.
+				s.log.Printf("Remote defered gzip proposal %s, falling back to lzhuf", prop.mid)
+				s.gzipRefused[prop.mid] = true
+				continue
+			}
+			reason := DeferredByRemote
+			if prop.held {
+				reason = HeldByRemote
+				s.remoteHold = true
+			}
+			s.setDeferred(prop.mid, reason)
 		case Reject:
 			sent[prop.mid] = true
 		case Accept:
-			if err = s.writeCompressed(rw, prop); err != nil {
+			s.emit(Event{Type: MessageStarted, MID: prop.mid, Direction: Outbound})
+			if prop.code == BasicProposal {
+				err = s.writeBasic(rw, prop)
+			} else {
+				err = s.writeCompressed(rw, prop)
+			}
+			if err != nil {
 				return
 			}
+			s.emit(Event{Type: MessageCompleted, MID: prop.mid, Direction: Outbound})
+			s.written[prop.mid] = prop.stats(Outbound)
 			sent[prop.mid] = false
 		}
 	}
 	return
 }
 
+// Matches comment lines summarizing the transfer, i.e. "; 2 messages accepted".
+var summaryLineRe = regexp.MustCompile(`(?i)\b\d+\s+messages?\b`)
+
 func (s *Session) handleInbound(rw io.ReadWriter) (quitReceived bool, err error) {
 	var ourChecksum int64
 	proposals := make([]*Proposal, 0)
 	var nAccepted int
+	var summary string // Summary comment preceding FF/FQ (if any)
+	pending := make(map[string]pendingMessage)
 
 Loop:
 	for {
@@ -207,32 +322,57 @@ Loop:
 
 		// Ignore comments and empty lines
 		if line == "" || line[0] == ';' {
+			if summaryLineRe.MatchString(line) {
+				summary = strings.TrimSpace(strings.TrimPrefix(line, ";"))
+			}
+			if pm, ok := parsePendingMessage(line); ok {
+				pending[pm.mid] = pm
+			}
+			continue
+		}
+
+		// Some implementations renegotiate by sending a new SID header
+		if isSIDLine(line) {
+			if err = s.handleSIDChange(line); err != nil {
+				return
+			}
 			continue
 		}
 
 		// The line should be prefixed F? (? is the command character)
-		if len(line) < 2 || line[0] != 'F' {
+		if len(line) < 2 || line[0] != 'F' && !isCommandLine(line) {
 			return false, fmt.Errorf("Got unexpected protocol line: '%s'", line)
 		}
 
+		// The checksum is calculated over the line as received
+		raw := line
+		line = strings.ToUpper(line[:2]) + line[2:]
+
 		switch line[:2] {
 		case "FA", "FB", "FC", "FD": // Proposals
-			for _, c := range line {
+			for _, c := range raw {
 				ourChecksum += int64(c)
 			}
 			ourChecksum += int64('\r')
 
 			prop := new(Proposal)
-			if err = parseProposal(line, prop); err != nil {
+			if err = parseProposal(line, prop, s.basicMode()); err != nil {
 				err = errors.New(`Unable to parse proposal: ` + err.Error())
 				return
 			}
+			if pm, ok := pending[prop.mid]; ok && prop.from == "" {
+				prop.from, prop.to = pm.from, pm.to
+			}
 			proposals = append(proposals, prop)
+			summary = ""
+			s.emit(Event{Type: ProposalOffered, MID: prop.mid, Direction: Inbound})
 
 		case "FF": // No more messages
+			s.setRemoteSummary(summary)
 			break Loop
 
 		case "FQ": // Quit
+			s.setRemoteSummary(summary)
 			quitReceived = true
 			break Loop
 
@@ -240,9 +380,17 @@ Loop:
 			// Verify checksum
 			ourChecksum = (-ourChecksum) & 0xff
 			their, _ := strconv.ParseInt(line[3:], 16, 64)
-			if their != ourChecksum {
+			if their != ourChecksum && (s.checksumErrors >= s.checksumRetries || len(proposals) == 0) {
 				err = errors.New(fmt.Sprintf(`Checksum error (%d-%d)`, ourChecksum, their))
 				return
+			} else if their != ourChecksum {
+				// Defer the whole block, and let the remote propose again
+				s.checksumErrors++
+				s.log.Printf(`Checksum error (%d-%d), deferring %d proposal(s)`, ourChecksum, their, len(proposals))
+				if err = s.deferProposals(rw, proposals, "checksum error"); err != nil {
+					return
+				}
+				return s.handleInbound(rw)
 			}
 
 			// If we didn't get any proposals, return
@@ -280,22 +428,76 @@ Loop:
 		}
 		s.remoteNoMsgs = false
 
-		var msg *Message
-		if err = s.readCompressed(rw, prop); err != nil {
-			return
-		} else if msg, err = prop.Message(); err != nil {
-			return
+		// In streaming mode, the message is written to the caller's writer as it arrives
+		var stream io.WriteCloser
+		if s.inboundStream != nil {
+			if stream, err = s.inboundStream(*prop); err != nil {
+				return
+			}
 		}
 
-		if err = s.h.ProcessInbound(msg); err != nil {
+		s.emit(Event{Type: MessageStarted, MID: prop.mid, Direction: Inbound})
+		if prop.code == BasicProposal {
+			err = s.readBasic(prop, stream)
+		} else {
+			err = s.readCompressed(rw, prop, stream)
+		}
+		if stream != nil {
+			if cErr := stream.Close(); err == nil {
+				err = cErr
+			}
+		}
+		if err != nil {
 			return
 		}
+
+		if stream == nil {
+			var msg *Message
+			if msg, err = prop.inboundMessage(); err != nil {
+				s.messageFailed(prop.mid, err)
+				return
+			}
+			if s.remoteSID.Has(sMID) {
+				if err = verifyMID(prop, msg); err != nil {
+					s.messageFailed(prop.mid, err)
+					return
+				}
+			}
+			if s.isCancelledInbound(prop.mid) {
+				s.log.Printf("Discarding %s (cancelled)", prop.mid)
+				s.refuse(prop, Reject, "cancelled")
+				s.emit(Event{Type: MessageCompleted, MID: prop.mid, Direction: Inbound})
+				continue
+			}
+			if s.isUnknownRecipient(msg) {
+				s.discardUnknownRecipient(msg)
+				s.emit(Event{Type: MessageCompleted, MID: prop.mid, Direction: Inbound})
+				continue
+			}
+			if s.keepalive(rw, func() { err = s.storeInbound(msg) }); err != nil {
+				s.messageFailed(prop.mid, err)
+				return
+			}
+		}
 		s.trafficStats.Received = append(s.trafficStats.Received, prop.MID())
+		s.trafficStats.Messages = append(s.trafficStats.Messages, prop.stats(Inbound))
+		s.observeBID(prop.MID(), Inbound)
+		s.addMetric(MetricMessagesReceived, 1)
+		s.addMetric(MetricBytesReceived, float64(prop.compressedSize))
+		s.emit(Event{Type: MessageCompleted, MID: prop.mid, Direction: Inbound})
 	}
 
 	return
 }
 
+func (s *Session) setRemoteSummary(summary string) {
+	if summary == "" {
+		return
+	}
+	s.log.Printf("Remote summary: %s", summary)
+	s.trafficStats.RemoteSummary = summary
+}
+
 // The B2F protocol does not support offsets larger than 6 digits, the author of the protocol
 // seems to have thrown away the idea of supporting transfer of fragmented messages.
 //
@@ -311,16 +513,28 @@ func (s *Session) writeProposalsAnswer(rw io.ReadWriter, proposals []*Proposal)
 			// Radio Only gateways will sometimes send multiple proposals for the same MID in the same batch.
 			// Instead of rejecting them right away, let's defer the dups until we know we have sucessfully received at least one of the copies.
 			s.log.Printf("Defering duplicate message %s", prop.MID())
-			prop.answer = Defer
-		} else if prop.code != Wl2kProposal && prop.code != GzipProposal {
+			s.refuse(prop, Defer, "duplicate")
+		} else if prop.code != Wl2kProposal && prop.code != GzipProposal && (prop.code != BasicProposal || !s.basicMode()) {
 			s.log.Printf("Defering %s (unsupported format)", prop.MID())
-			prop.answer = Defer
-		} else if s.h == nil {
+			s.refuse(prop, Defer, "unsupported format")
+		} else if s.h == nil && s.sink == nil && s.quarantine == nil {
 			s.log.Printf("Defering %s (missing handler)", prop.MID())
-			prop.answer = Defer
-		} else if prop.answer = s.h.GetInboundAnswer(*prop); prop.answer == Accept {
+			s.refuse(prop, Defer, "missing handler")
+		} else if s.direction == Send {
+			s.log.Printf("Defering %s (send only)", prop.MID())
+			s.refuse(prop, Defer, "send only")
+		} else if prop.code == BasicProposal && s.unknownRecipient == RejectUnknownRecipient && !s.isLocalRecipient(AddressFromString(prop.to)) {
+			s.log.Printf("Rejecting %s (%s)", prop.MID(), unknownRecipientReason)
+			s.refuse(prop, Reject, unknownRecipientReason)
+		} else if answer, reason := s.waitInboundAnswer(rw, *prop); answer == Accept {
 			s.log.Printf("Accepting %s", prop.MID()) //TODO: Remove?
+			prop.answer = answer
 			nAccepted++
+		} else {
+			if reason != "" {
+				s.log.Printf("Refusing %s (%s)", prop.MID(), reason)
+			}
+			s.refuse(prop, answer, reason)
 		}
 
 		seen[prop.MID()] = true
@@ -331,6 +545,17 @@ func (s *Session) writeProposalsAnswer(rw io.ReadWriter, proposals []*Proposal)
 	return
 }
 
+// deferProposals answers the proposals by deferring all of them.
+func (s *Session) deferProposals(w io.Writer, proposals []*Proposal, reason string) error {
+	answers := make([]byte, len(proposals))
+	for i, prop := range proposals {
+		s.refuse(prop, Defer, reason)
+		answers[i] = byte(prop.answer)
+	}
+	_, err := fmt.Fprintf(w, "FS %s\r", answers)
+	return err
+}
+
 // Parses the proposal answer (str) and updates the proposals given (in that order)
 func parseProposalAnswer(str string, props []*Proposal, l *log.Logger) error {
 	str = strings.TrimPrefix(str, "FS ")
@@ -360,24 +585,39 @@ func parseProposalAnswer(str string, props []*Proposal, l *log.Logger) error {
 				l.Printf("Remote defered %s", prop.MID())
 			}
 			prop.answer = Defer
+			prop.held = c == 'H' || c == 'h'
 		case 'A', 'a', '!':
-			idx := strings.LastIndexAny(str, "0123456789")
+			// The offset is the digits following the code, up to the next answer code
+			idx := strings.IndexFunc(str, func(r rune) bool { return r < '0' || r > '9' })
 			if idx < 0 {
+				idx = len(str)
+			}
+			if idx == 0 {
 				return errors.New("Got offset request without offset index")
 			}
 			prop.answer = Accept // Offset is not implemented as a ProposalAnswer
-			prop.offset, _ = strconv.Atoi(str[:idx+1])
-			str = str[idx+1:]
+			offset, _ := strconv.Atoi(str[:idx])
+			str = str[idx:]
 
-			if prop.offset > ProtocolOffsetSizeLimit { // RMS Express does this (in Winmor P2P for sure)
-				prop.offset = 0
+			switch {
+			case offset > ProtocolOffsetSizeLimit: // RMS Express does this (in Winmor P2P for sure)
 				if l != nil {
 					l.Printf(
 						"Remote requested %s at offset %d which exceeds the binary protocol offset limit. Ignoring offset.",
-						prop.MID(), prop.offset,
+						prop.MID(), offset,
 					)
 				}
-			} else if l != nil {
+				offset = 0
+			case prop.compressedData != nil && offset >= len(prop.compressedData):
+				if l != nil {
+					l.Printf("Remote requested %s at offset %d which exceeds the message size. Ignoring offset.", prop.MID(), offset)
+				}
+				offset = 0
+			case offset > 0 && offset < lzhufHeaderLength:
+				offset = 0 // Within the header, which is always sent
+			}
+			prop.offset = offset
+			if l != nil {
 				l.Printf("Remote accepted %s at offset %d", prop.MID(), prop.offset)
 			}
 		default:
@@ -387,6 +627,75 @@ func parseProposalAnswer(str string, props []*Proposal, l *log.Logger) error {
 	return nil
 }
 
+// writeBasic writes the message using the FBB basic (ASCII) protocol: The title on
+// the first line followed by the message and a Ctrl-Z.
+func (s *Session) writeBasic(rw io.ReadWriter, p *Proposal) error {
+	s.log.Printf("Transmitting [%s] (uncompressed)", p.title)
+
+	writer := bufio.NewWriter(rw)
+	fmt.Fprintf(writer, "%s\r", mime.QEncoding.Encode("utf-8", p.title))
+	writer.Write(p.compressedData)
+	writer.Write([]byte{_CHRSUB, '\r'})
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	if f, ok := rw.(transport.Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// readBasic reads a message transferred using the FBB basic protocol.
+//
+// If dst is non-nil, the message is written to dst instead of being kept in p.
+func (s *Session) readBasic(p *Proposal, dst io.Writer) error {
+	title, err := s.rd.ReadString('\r')
+	if err != nil {
+		return errors.New(`Unable to parse title: ` + err.Error())
+	}
+	p.title, _ = new(WordDecoder).DecodeHeader(strings.TrimSpace(title))
+
+	s.log.Printf("Receiving [%s] (uncompressed)", p.title)
+
+	var buf bytes.Buffer
+	if dst == nil {
+		dst = &buf
+	}
+
+	var n int
+	for done := false; !done; {
+		chunk, err := s.rd.ReadSlice(_CHRSUB)
+		switch err {
+		case nil:
+			chunk, done = chunk[:len(chunk)-1], true // Remove Ctrl-Z
+		case bufio.ErrBufferFull:
+			// Keep reading
+		default:
+			return err
+		}
+
+		n += len(chunk)
+		if _, err := dst.Write(chunk); err != nil {
+			return err
+		}
+	}
+
+	if c, err := s.rd.ReadByte(); err != nil {
+		return err
+	} else if c != '\r' {
+		return fmt.Errorf("Expected end of line after Ctrl-Z, got %d", int(c))
+	}
+
+	if n != p.size {
+		return fmt.Errorf("Length mismatch: expected %d, got %d", p.size, n)
+	}
+	if dst == &buf {
+		p.compressedData = buf.Bytes()
+	}
+	return nil
+}
+
 func (s *Session) writeCompressed(rw io.ReadWriter, p *Proposal) (err error) {
 	s.log.Printf("Transmitting [%s] [offset %d]", p.title, p.offset)
 
@@ -410,11 +719,18 @@ func (s *Session) writeCompressed(rw io.ReadWriter, p *Proposal) (err error) {
 	writer.WriteByte(_CHRNUL)
 	writer.Flush()
 
-	if p.compressedSize < 6 { // lzhuf's smallest valid length (empty)
+	if p.compressedSize < lzhufHeaderLength { // lzhuf's smallest valid length (empty)
 		return errors.New(`Invalid compressed data`)
 	}
 
-	buffer := bytes.NewBuffer(p.compressedData[p.offset:])
+	// When resuming at an offset, the header (CRC and length) is sent before the
+	// data following the offset, so that the remote can verify the reassembled message.
+	buffer := bytes.NewBuffer(p.compressedData)
+	if p.offset > 0 {
+		buffer = bytes.NewBuffer(make([]byte, 0, lzhufHeaderLength+len(p.compressedData)-p.offset))
+		buffer.Write(p.compressedData[:lzhufHeaderLength])
+		buffer.Write(p.compressedData[p.offset:])
+	}
 
 	// Update Status of message transfer every 250ms
 	statusTicker := time.NewTicker(250 * time.Millisecond)
@@ -440,6 +756,7 @@ func (s *Session) writeCompressed(rw io.ReadWriter, p *Proposal) (err error) {
 
 				if s.statusUpdater != nil {
 					s.statusUpdater.UpdateStatus(Status{
+						SessionID:        s.id,
 						Sending:          p,
 						BytesTransferred: transferred,
 						BytesTotal:       p.compressedSize,
@@ -448,6 +765,7 @@ func (s *Session) writeCompressed(rw io.ReadWriter, p *Proposal) (err error) {
 			case <-statusDone:
 				if s.statusUpdater != nil {
 					s.statusUpdater.UpdateStatus(Status{
+						SessionID:        s.id,
 						Sending:          p,
 						BytesTransferred: p.compressedSize - buffer.Len(),
 						BytesTotal:       p.compressedSize,
@@ -460,10 +778,18 @@ func (s *Session) writeCompressed(rw io.ReadWriter, p *Proposal) (err error) {
 	}()
 	defer func() { close(statusDone) }()
 
-	// Data (in chunks of max 250)
+	// Data (in chunks of max MaxBlockLength)
+	blockLen := MaxMsgLength
+	if s.blockSize > 0 {
+		blockLen = s.blockSize
+	}
 	for buffer.Len() > 0 {
-		msgLen := MaxMsgLength
-		if buffer.Len() < MaxMsgLength {
+		if s.isAborted() {
+			return s.abortCompressed(writer, checksum)
+		}
+
+		msgLen := blockLen
+		if buffer.Len() < blockLen {
 			msgLen = buffer.Len()
 		}
 
@@ -500,12 +826,67 @@ func (s *Session) writeCompressed(rw io.ReadWriter, p *Proposal) (err error) {
 	return err
 }
 
-func (s *Session) readCompressed(rw io.ReadWriter, p *Proposal) (err error) {
+// abortCompressed terminates a partially written message.
+//
+// The protocol has no explicit abort command, but a receiver must ignore a message
+// with a checksum error. The EOT is sent with a checksum that is guaranteed to be
+// wrong, so that the remote discards the partial instead of storing garbage.
+func (s *Session) abortCompressed(writer *bufio.Writer, checksum int64) error {
+	s.log.Println("Aborting transfer of partially written message")
+
+	checksum = (-checksum + 1) & 0xff // Off by one
+	writer.Write([]byte{_CHREOT, byte(checksum)})
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return ErrAborted
+}
+
+// isCommandLine returns true if line starts with a protocol command (i.e. FF), ignoring case.
+func isCommandLine(line string) bool {
+	if len(line) < 2 || (line[0] != 'F' && line[0] != 'f') {
+		return false
+	}
+	return strings.ContainsRune("ABCDFQS>", unicode.ToUpper(rune(line[1])))
+}
+
+// MessageChecksum returns the checksum of a message transferred using the FBB compressed protocol.
+//
+// The data is the (compressed) message data sent in the STX blocks, starting at the
+// transfer offset. The checksum is the two's complement of the sum of the data bytes,
+// modulo 256. It is sent after the EOT byte, so that the receiver can verify
+// the transfer by checking that the sum of the data bytes and the checksum is 0 (modulo 256).
+func MessageChecksum(data []byte) byte {
+	var sum byte
+	for _, c := range data {
+		sum += c
+	}
+	return -sum
+}
+
+// readCompressed reads a message transferred using the FBB compressed protocol.
+//
+// If dst is non-nil, the message is decompressed and written to dst as it arrives
+// instead of being kept in p.
+func (s *Session) readCompressed(rw io.ReadWriter, p *Proposal, dst io.Writer) (err error) {
 	var (
 		ourChecksum int
 		buf         bytes.Buffer
+		n           int       // Number of compressed bytes received
+		w           io.Writer = &buf
+		head                  = []byte{} // The first bytes, for compression format sanity checks (nil when checked)
 	)
 
+	if dst != nil {
+		dw := newDecompressWriter(dst, p.code)
+		defer func() {
+			if err != nil {
+				dw.CloseWithError(err)
+			}
+		}()
+		w = dw
+	}
+
 	var c byte
 	if c, err = s.rd.ReadByte(); err != nil {
 		return
@@ -561,18 +942,32 @@ func (s *Session) readCompressed(rw io.ReadWriter, p *Proposal) (err error) {
 
 	s.log.Printf("Receiving [%s] [offset %d]", p.title, p.offset)
 
+	// The remote closing the connection mid-message is reported as such, with the bytes received so far
+	defer func() {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			err = &TruncatedMessageError{MID: p.mid, Received: n, Expected: p.compressedSize, Err: err}
+		}
+	}()
+
 	if p.code == GzipProposal {
 		s.log.Println("GZIP_EXPERIMENT:", "Receiving gzip compressed message.")
 	}
 
-	statusUpdate := make(chan struct{})
+	statusUpdate := make(chan int)
+	statusDone := make(chan struct{})
 	go func() {
+		defer close(statusDone)
+		var transferred int
 		for {
-			_, ok := <-statusUpdate
+			m, ok := <-statusUpdate
+			if ok {
+				transferred = m
+			}
 			if s.statusUpdater != nil {
 				s.statusUpdater.UpdateStatus(Status{
+					SessionID:        s.id,
 					Receiving:        p,
-					BytesTransferred: buf.Len(),
+					BytesTransferred: transferred,
 					BytesTotal:       p.compressedSize,
 					Done:             !ok,
 				})
@@ -582,10 +977,14 @@ func (s *Session) readCompressed(rw io.ReadWriter, p *Proposal) (err error) {
 			}
 		}
 	}()
-	defer func() { close(statusUpdate) }()
+	defer func() {
+		// Deliver the final status before returning (i.e. in case the message is cancelled)
+		close(statusUpdate)
+		<-statusDone
+	}()
 	updateStatus := func() {
 		select {
-		case statusUpdate <- struct{}{}:
+		case statusUpdate <- n:
 		default:
 		}
 	}
@@ -604,27 +1003,52 @@ func (s *Session) readCompressed(rw io.ReadWriter, p *Proposal) (err error) {
 			if length == 0 {
 				length = 256
 			}
+			block := make([]byte, 0, length)
 			for i := 0; i < length; i++ {
 				c, err = s.rd.ReadByte()
 				if err != nil {
 					return
 				}
-				buf.WriteByte(c)
+				block = append(block, c)
+				n++
 				ourChecksum = (ourChecksum + int(c)) % 256
 				if i%10 == 0 {
 					updateStatus()
 				}
 			}
+			if head != nil {
+				if head = append(head, block...); len(head) >= lzhufHeaderLength {
+					if err = p.checkFormat(head); err != nil {
+						return
+					}
+					head = nil // Checked
+				}
+			}
+			if _, err = w.Write(block); err != nil {
+				return
+			}
 		case _CHREOT:
-			c, _ = s.rd.ReadByte()
+			if c, err = s.rd.ReadByte(); err != nil {
+				return
+			}
 			ourChecksum = (ourChecksum + int(c)) % 256
 			if ourChecksum != 0 {
 				return errors.New(`Bad checksum`)
-			} else if p.compressedSize != buf.Len() {
+			} else if p.compressedSize != n {
 				return errors.New(`Length mismatch after EOT`)
-			} else {
-				p.compressedData = buf.Bytes()
+			} else if head != nil {
+				if err = p.checkFormat(head); err != nil {
+					return
+				}
+			}
+
+			if dw, ok := w.(*decompressWriter); ok {
+				if err = dw.Close(); err != nil {
+					return
+				}
+				return p.checkSize(dw.n)
 			}
+			p.compressedData = buf.Bytes()
 			return
 		default:
 			return errors.New(`Unexpected byte in compressed stream: ` + string(c))
@@ -4,7 +4,17 @@
 
 package fbb
 
-import "testing"
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+)
 
 func TestParseProposalAnswer(t *testing.T) {
 	tests := map[string][]*Proposal{
@@ -43,3 +53,444 @@ func TestParseProposalAnswer(t *testing.T) {
 		}
 	}
 }
+
+func TestParseProposalAnswerOffsets(t *testing.T) {
+	data := make([]byte, 5000)
+	props := make([]*Proposal, 6)
+	for i := range props {
+		props[i] = &Proposal{compressedData: data, compressedSize: len(data)}
+	}
+
+	if err := parseProposalAnswer("FS +!1234-A56=a9999", props, nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expect := []struct {
+		answer ProposalAnswer
+		offset int
+	}{
+		{Accept, 0},
+		{Accept, 1234},
+		{Reject, 0},
+		{Accept, 56},
+		{Defer, 0},
+		{Accept, 0}, // Beyond the end of the message
+	}
+	for i, exp := range expect {
+		if props[i].answer != exp.answer || props[i].offset != exp.offset {
+			t.Errorf("Proposal %d: Expected %c at %d, got %c at %d", i, exp.answer, exp.offset, props[i].answer, props[i].offset)
+		}
+	}
+
+	for _, answer := range []string{"FS !", "FS A+"} {
+		if err := parseProposalAnswer(answer, props, nil); err == nil {
+			t.Errorf("%q: Expected error", answer)
+		}
+	}
+}
+
+func TestWriteCompressedOffset(t *testing.T) {
+	prop, err := newTestMessage("LA5NTA", "N0CALL", 1000).Proposal(Wl2kProposal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prop.offset = 100
+
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+	s.SetLogger(log.New(ioutil.Discard, "", 0))
+
+	var buf bytes.Buffer
+	if err := s.writeCompressed(&buf, prop); err != nil {
+		t.Fatal(err)
+	}
+
+	// Skip the SOH header and collect the data of the STX blocks
+	rd := bufio.NewReader(&buf)
+	rd.ReadByte()
+	n, _ := rd.ReadByte()
+	header := make([]byte, n)
+	if _, err := io.ReadFull(rd, header); err != nil || !bytes.HasSuffix(header, []byte("\x00100\x00")) {
+		t.Fatalf("Expected offset 100 in header, got %q", header)
+	}
+	var data []byte
+	for {
+		c, err := rd.ReadByte()
+		if err != nil {
+			t.Fatal(err)
+		} else if c == _CHREOT {
+			break
+		}
+		n, _ := rd.ReadByte()
+		block := make([]byte, n)
+		if _, err := io.ReadFull(rd, block); err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, block...)
+	}
+
+	expect := append(append([]byte{}, prop.compressedData[:lzhufHeaderLength]...), prop.compressedData[100:]...)
+	if !bytes.Equal(data, expect) {
+		t.Errorf("Expected the lzhuf header followed by the data at offset (%d bytes), got %d bytes", len(expect), len(data))
+	}
+	if sum, _ := rd.ReadByte(); sum != MessageChecksum(expect) {
+		t.Errorf("Expected checksum %02X, got %02X", MessageChecksum(expect), sum)
+	}
+}
+
+func TestMessageChecksum(t *testing.T) {
+	tests := []struct {
+		data   []byte
+		expect byte
+	}{
+		{nil, 0x00},
+		{[]byte{0x01}, 0xFF},
+		{[]byte{0x80, 0x80}, 0x00},
+		{[]byte("Hello"), 0x0C},
+		{bytes.Repeat([]byte{0xFF}, 1000), 0xE8},
+	}
+	for _, test := range tests {
+		if got := MessageChecksum(test.data); got != test.expect {
+			t.Errorf("%.10q: Expected checksum %02X, got %02X", test.data, test.expect, got)
+		}
+		var sum byte
+		for _, c := range test.data {
+			sum += c
+		}
+		if sum+MessageChecksum(test.data) != 0 {
+			t.Errorf("%.10q: Expected the data and checksum to sum to zero", test.data)
+		}
+	}
+}
+
+func TestMessageChecksumMatchesTransfer(t *testing.T) {
+	prop, err := newTestMessage("LA5NTA", "N0CALL", 1000).Proposal(Wl2kProposal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+	s.SetLogger(log.New(ioutil.Discard, "", 0))
+
+	var buf bytes.Buffer
+	if err := s.writeCompressed(&buf, prop); err != nil {
+		t.Fatal(err)
+	}
+	sent := buf.Bytes()
+	if sent[len(sent)-2] != _CHREOT {
+		t.Fatalf("Expected EOT before the checksum, got %q", sent[len(sent)-2:])
+	}
+	if got, expect := sent[len(sent)-1], MessageChecksum(prop.compressedData); got != expect {
+		t.Errorf("Expected checksum %02X, transferred %02X", expect, got)
+	}
+}
+
+func TestHandleInboundLowercaseCommands(t *testing.T) {
+	tests := map[string]bool{
+		"ff\r":           false,
+		"fq\r":           true,
+		";comment\rfq\r": true,
+		"FF\r":           false,
+	}
+	for input, expectQuit := range tests {
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+		s.SetLogger(log.New(ioutil.Discard, "", 0))
+		s.rd = bufio.NewReader(strings.NewReader(input))
+
+		quit, err := s.handleInbound(&bytes.Buffer{})
+		if err != nil {
+			t.Errorf("%q: Unexpected error: %s", input, err)
+		} else if quit != expectQuit {
+			t.Errorf("%q: Expected quit %t, got %t", input, expectQuit, quit)
+		}
+	}
+}
+
+func TestSessionBlockSize(t *testing.T) {
+	for _, size := range []int{0, 16, MaxBlockLength} {
+		client, master := tcpPipe(t)
+
+		msg := newTestMessage("LA5NTA", "N0CALL", 2000)
+		cs := NewSession("LA5NTA", "N0CALL", "JO39EQ", newMemMBox(msg))
+		cs.SetBlockSize(size)
+		mbox := newMemMBox()
+		ms := NewSession("N0CALL", "LA5NTA", "JO39EQ", mbox)
+
+		// Record the length of the data blocks written by the client
+		var written bytes.Buffer
+		hook := writeHookConn{client, func(p []byte) { written.Write(p) }}
+		if _, _, cErr, mErr := exchangeConns(cs, ms, hook, master); cErr != nil || mErr != nil {
+			t.Fatalf("size=%d: Exchange failed: %v, %v", size, cErr, mErr)
+		}
+
+		if len(mbox.inbox()) != 1 || mbox.inbox()[0].MID() != msg.MID() {
+			t.Fatalf("size=%d: Message not received", size)
+		}
+
+		expect := size
+		if size == 0 {
+			expect = MaxMsgLength
+		}
+		data := written.Bytes()
+		if i := bytes.IndexByte(data, _CHRSTX); i < 0 || i+1 >= len(data) {
+			t.Errorf("size=%d: No data block written", size)
+		} else if got := int(data[i+1]); got != expect {
+			t.Errorf("size=%d: Expected first block of %d bytes, got %d", size, expect, got)
+		}
+	}
+}
+
+func TestReadCompressedSizeMismatch(t *testing.T) {
+	sent, err := newTestMessage("LA5NTA", "N0CALL", 1000).Proposal(Wl2kProposal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stream := range []bool{false, true} {
+		s := NewSession("N0CALL", "LA5NTA", "JO39EQ", nil)
+		s.SetLogger(log.New(ioutil.Discard, "", 0))
+
+		var buf bytes.Buffer
+		if err := s.writeCompressed(&buf, sent); err != nil {
+			t.Fatal(err)
+		}
+		s.rd = bufio.NewReader(&buf)
+
+		// The proposal declares a size one byte larger than the actual message
+		prop := &Proposal{mid: sent.mid, code: sent.code, size: sent.size + 1, compressedSize: sent.compressedSize}
+		if stream {
+			err = s.readCompressed(&bytes.Buffer{}, prop, ioutil.Discard)
+		} else if err = s.readCompressed(&bytes.Buffer{}, prop, nil); err == nil {
+			_, err = prop.inboundMessage()
+		}
+
+		if !errors.Is(err, ErrSizeMismatch) {
+			t.Fatalf("stream=%t: Expected ErrSizeMismatch, got %v", stream, err)
+		}
+		if e, ok := err.(*SizeMismatchError); !ok || e.Declared != sent.size+1 || e.Actual != sent.size {
+			t.Errorf("stream=%t: Unexpected error: %#v", stream, err)
+		}
+	}
+}
+
+func TestReadCompressedFormatMismatch(t *testing.T) {
+	msg := newTestMessage("LA5NTA", "N0CALL", 1000)
+	lzhufProp, err := msg.Proposal(Wl2kProposal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzipProp, err := msg.Proposal(GzipProposal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Data sent compressed in one format, but labeled (proposed) as the other
+	tests := map[PropCode]*Proposal{
+		GzipProposal: lzhufProp,
+		Wl2kProposal: gzipProp,
+	}
+	for label, sent := range tests {
+		for _, stream := range []bool{false, true} {
+			s := NewSession("N0CALL", "LA5NTA", "JO39EQ", nil)
+			s.SetLogger(log.New(ioutil.Discard, "", 0))
+
+			var buf bytes.Buffer
+			if err := s.writeCompressed(&buf, sent); err != nil {
+				t.Fatal(err)
+			}
+			s.rd = bufio.NewReader(&buf)
+
+			prop := &Proposal{mid: sent.mid, code: label, size: sent.size, compressedSize: sent.compressedSize}
+			if stream {
+				err = s.readCompressed(&bytes.Buffer{}, prop, ioutil.Discard)
+			} else {
+				err = s.readCompressed(&bytes.Buffer{}, prop, nil)
+			}
+			if !errors.Is(err, ErrCompressionMismatch) {
+				t.Errorf("%c (stream=%t): Expected ErrCompressionMismatch, got %v", label, stream, err)
+			}
+		}
+	}
+
+	// Correctly labeled data passes the checks
+	for _, sent := range []*Proposal{lzhufProp, gzipProp} {
+		s := NewSession("N0CALL", "LA5NTA", "JO39EQ", nil)
+		s.SetLogger(log.New(ioutil.Discard, "", 0))
+		var buf bytes.Buffer
+		s.writeCompressed(&buf, sent)
+		s.rd = bufio.NewReader(&buf)
+
+		prop := &Proposal{mid: sent.mid, code: sent.code, size: sent.size, compressedSize: sent.compressedSize}
+		if err := s.readCompressed(&bytes.Buffer{}, prop, nil); err != nil {
+			t.Errorf("%c: Unexpected error: %s", sent.code, err)
+		}
+	}
+}
+
+func TestSessionChecksumRetries(t *testing.T) {
+	msg := newTestMessage("N0CALL", "LA5NTA", 1000)
+	prop, err := msg.Proposal(Wl2kProposal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := fmt.Sprintf("FC EM %s %d %d 0", prop.mid, prop.size, prop.compressedSize)
+	var sum int64
+	for _, c := range line + "\r" {
+		sum += int64(c)
+	}
+	checksum := (-sum) & 0xff
+
+	for _, retries := range []int{0, 1} {
+		client, srv := tcpPipe(t)
+		mbox := newMemMBox()
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", mbox)
+		s.SetLogger(log.New(ioutil.Discard, "", 0))
+		s.SetChecksumRetries(retries)
+
+		cerrs := make(chan error, 1)
+		go func() {
+			_, err := s.Exchange(client)
+			cerrs <- err
+		}()
+
+		rd := bufio.NewReader(srv)
+		readUntil := func(expect string) {
+			for {
+				line, err := rd.ReadString('\r')
+				if err != nil || line == expect {
+					return
+				}
+			}
+		}
+
+		fmt.Fprint(srv, "[WL2K-5.0-B2FWIHJM$]\rTest CMS >\r")
+		readUntil("FF\r")
+
+		// Send the block with a bad checksum once, then correctly
+		fmt.Fprintf(srv, "%s\rF> %02X\r", line, (checksum+1)&0xff)
+		if retries > 0 {
+			readUntil("FS =\r")
+			fmt.Fprintf(srv, "%s\rF> %02X\r", line, checksum)
+			readUntil("FS +\r")
+			NewSession("N0CALL", "LA5NTA", "JO39EQ", nil).writeCompressed(srv, prop)
+			readUntil("FF\r")
+			fmt.Fprint(srv, "FQ\r")
+		}
+		go ioutil.ReadAll(rd)
+
+		err := <-cerrs
+		srv.Close()
+		switch {
+		case retries == 0 && (err == nil || !strings.Contains(err.Error(), "Checksum error")):
+			t.Errorf("retries=0: Expected checksum error, got %v", err)
+		case retries > 0 && err != nil:
+			t.Errorf("retries=%d: Unexpected error: %s", retries, err)
+		case retries > 0 && len(mbox.inbox()) != 1:
+			t.Errorf("retries=%d: Expected the message to be received on the second attempt", retries)
+		case retries > 0 && len(s.trafficStats.Refused) != 1:
+			t.Errorf("retries=%d: Expected the first proposal to be recorded as refused", retries)
+		}
+	}
+}
+
+func TestSessionZeroLengthMessage(t *testing.T) {
+	prop := NewProposal("EMPTY0000001", "Empty", Wl2kProposal, nil)
+	if prop.size != 0 {
+		t.Fatalf("Expected zero-length proposal, got size %d", prop.size)
+	}
+	line := fmt.Sprintf("FC EM %s %d %d 0", prop.mid, prop.size, prop.compressedSize)
+	var sum int64
+	for _, c := range line + "\r" {
+		sum += int64(c)
+	}
+
+	client, srv := tcpPipe(t)
+	mbox := newMemMBox()
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", mbox)
+	s.SetLogger(log.New(ioutil.Discard, "", 0))
+
+	cerrs := make(chan error, 1)
+	go func() {
+		_, err := s.Exchange(client)
+		cerrs <- err
+	}()
+
+	rd := bufio.NewReader(srv)
+	readUntil := func(expect string) {
+		for {
+			line, err := rd.ReadString('\r')
+			if err != nil || line == expect {
+				return
+			}
+		}
+	}
+
+	fmt.Fprint(srv, "[WL2K-5.0-B2FWIHJM$]\rTest CMS >\r")
+	readUntil("FF\r")
+	fmt.Fprintf(srv, "%s\rF> %02X\r", line, (-sum)&0xff)
+	readUntil("FS +\r")
+	NewSession("N0CALL", "LA5NTA", "JO39EQ", nil).writeCompressed(srv, prop)
+	readUntil("FF\r")
+	fmt.Fprint(srv, "FQ\r")
+	go ioutil.ReadAll(rd)
+
+	err := <-cerrs
+	srv.Close()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	inbox := mbox.inbox()
+	if len(inbox) != 1 {
+		t.Fatalf("Expected 1 received message, got %d", len(inbox))
+	}
+	msg := inbox[0]
+	if msg.MID() != prop.mid || msg.Subject() != "Empty" {
+		t.Errorf("Unexpected message: MID %q, Subject %q", msg.MID(), msg.Subject())
+	}
+	if body, _ := msg.Body(); len(body) != 0 {
+		t.Errorf("Expected empty body, got %q", body)
+	}
+}
+
+func TestReadCompressedTruncated(t *testing.T) {
+	sent, err := newTestMessage("LA5NTA", "N0CALL", 5000).Proposal(Wl2kProposal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent.compressedSize < MaxMsgLength+10 {
+		t.Fatalf("Expected more than one block of compressed data, got %d bytes", sent.compressedSize)
+	}
+
+	for _, stream := range []bool{false, true} {
+		s := NewSession("N0CALL", "LA5NTA", "JO39EQ", nil)
+		s.SetLogger(log.New(ioutil.Discard, "", 0))
+
+		var buf bytes.Buffer
+		if err := s.writeCompressed(&buf, sent); err != nil {
+			t.Fatal(err)
+		}
+
+		// The connection drops 10 bytes into the second block
+		header := 2 + int(buf.Bytes()[1])
+		s.rd = bufio.NewReader(bytes.NewReader(buf.Bytes()[:header+2+MaxMsgLength+2+10]))
+
+		prop := &Proposal{mid: sent.mid, code: sent.code, size: sent.size, compressedSize: sent.compressedSize}
+		if stream {
+			err = s.readCompressed(&bytes.Buffer{}, prop, ioutil.Discard)
+		} else {
+			err = s.readCompressed(&bytes.Buffer{}, prop, nil)
+		}
+
+		if !errors.Is(err, ErrTruncatedMessage) {
+			t.Fatalf("stream=%t: Expected ErrTruncatedMessage, got %v", stream, err)
+		}
+		e, ok := err.(*TruncatedMessageError)
+		if !ok || e.MID != sent.mid || e.Received != MaxMsgLength+10 || e.Expected != sent.compressedSize || !errors.Is(err, io.EOF) {
+			t.Errorf("stream=%t: Unexpected error: %#v", stream, err)
+		}
+	}
+
+	// Decompressing partial data
+	prop := &Proposal{mid: sent.mid, code: sent.code, size: sent.size, compressedSize: sent.compressedSize, compressedData: sent.compressedData[:100]}
+	if _, err := prop.inboundMessage(); !errors.Is(err, ErrTruncatedMessage) {
+		t.Errorf("Expected ErrTruncatedMessage when decompressing partial data, got %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+// Capabilities describes what was negotiated with the remote during the handshake.
+//
+// It can be encoded as JSON (i.e. for logging or dashboards), using the field names as keys.
+// It only tells whether secure login was performed, and holds no credentials.
+type Capabilities struct {
+	RemoteUA  UserAgent // The remote's application name and version (from the SID).
+	RemoteSID string    // The remote's SID codes.
+	RemoteFW  []Address // The addresses the remote requests messages on behalf of.
+
+	MaxMessageSize int // The max message size advertised by the remote (0 if unknown).
+
+	SecureLogin      bool // Secure login was performed.
+	Gzip             bool // Outbound messages will be gzip compressed (GZIP_EXPERIMENT).
+	Uncompressed     bool // Outbound messages will be sent using the FBB basic protocol.
+	CompactHandshake bool // The compact handshake was negotiated.
+	Keepalive        bool // Keepalive frames were negotiated (see Session.SetKeepalive).
+}
+
+// capabilities returns the capabilities negotiated during the handshake.
+func (s *Session) capabilities() Capabilities {
+	code := s.highestPropCode()
+	return Capabilities{
+		RemoteUA:         s.remoteUA,
+		RemoteSID:        string(s.remoteSID),
+		RemoteFW:         s.remoteFW,
+		MaxMessageSize:   s.remoteMaxMessageSize,
+		SecureLogin:      s.secureLoginPerformed,
+		Gzip:             code == GzipProposal,
+		Uncompressed:     code == BasicProposal,
+		CompactHandshake: s.compactHandshake && s.remoteSID.Has(sCompact),
+		Keepalive:        s.keepaliveNegotiated(),
+	}
+}
+
+// CapabilityCache stores the capabilities last seen from remote stations.
+//
+// Implementations must be safe for concurrent use if shared between sessions.
+type CapabilityCache interface {
+	// Get returns the capabilities last seen from the given call sign.
+	Get(callsign string) (caps Capabilities, ok bool)
+
+	// Put stores the capabilities seen from the given call sign.
+	Put(callsign string, caps Capabilities)
+}
+
+// SetCapabilityCache sets a cache of the remote's capabilities, keyed by the target call sign.
+//
+// If the cache has an entry for the target call sign, it is used to pre-seed the
+// remote's SID, user agent and max message size (i.e. RemoteSID) until the handshake
+// completes. The capabilities are always renegotiated during the handshake, so the
+// cache is an optimization only. The cache is updated after each successful handshake.
+func (s *Session) SetCapabilityCache(cache CapabilityCache) { s.capCache = cache }
+
+// loadCachedCapabilities pre-seeds the remote's capabilities from the capability cache (if any).
+func (s *Session) loadCachedCapabilities() {
+	if s.capCache == nil || s.targetcall == "" {
+		return
+	}
+	caps, ok := s.capCache.Get(s.Targetcall())
+	if !ok {
+		return
+	}
+	s.remoteSID = sid(caps.RemoteSID)
+	s.remoteUA = caps.RemoteUA
+	s.remoteMaxMessageSize = caps.MaxMessageSize
+}
+
+// storeCapabilities updates the capability cache (if any) with the negotiated capabilities.
+func (s *Session) storeCapabilities() {
+	if s.capCache == nil || s.targetcall == "" {
+		return
+	}
+	s.capCache.Put(s.Targetcall(), s.capabilities())
+}
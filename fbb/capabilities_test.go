@@ -0,0 +1,168 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSessionPostHandshakeFunc(t *testing.T) {
+	errAbort := errors.New("abort")
+
+	for _, abort := range []bool{false, true} {
+		client, srv := tcpPipe(t)
+		mbox := newMemMBox()
+		if abort {
+			mbox = newMemMBox(newTestMessage("LA5NTA", "N0CALL", 100)) // Should not be proposed
+		}
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", mbox)
+
+		var got []Capabilities
+		s.SetPostHandshakeFunc(func(caps Capabilities) error {
+			got = append(got, caps)
+			if abort {
+				return errAbort
+			}
+			return nil
+		})
+
+		cerrs := make(chan error)
+		go func() {
+			_, err := s.Exchange(client)
+			cerrs <- err
+		}()
+
+		fmt.Fprint(srv, ";FW: N0CALL\r")
+		fmt.Fprint(srv, "[WL2K-2.8.4.8-B2FWIHJM$]\r")
+		fmt.Fprint(srv, "Max message size: 1000 bytes\r")
+		fmt.Fprint(srv, "Test CMS >\r")
+		if !abort {
+			fmt.Fprint(srv, "FQ\r") // Answer the client's FF
+		}
+
+		// Read everything written by the client
+		written, _ := ioutil.ReadAll(srv)
+
+		err := <-cerrs
+		switch {
+		case abort && err != errAbort:
+			t.Errorf("Expected errAbort, got %v", err)
+		case !abort && err != nil:
+			t.Errorf("Unexpected error: %s", err)
+		}
+		if abort && strings.Contains(string(written), "FC ") {
+			t.Errorf("Proposal sent after aborting in post handshake func")
+		}
+
+		expected := Capabilities{
+			RemoteUA:       UserAgent{Name: "WL2K", Version: "2.8.4.8"},
+			RemoteSID:      "B2FWIHJM$",
+			RemoteFW:       []Address{AddressFromString("N0CALL")},
+			MaxMessageSize: 1000,
+		}
+		if !reflect.DeepEqual(got, []Capabilities{expected}) {
+			t.Errorf("Unexpected capabilities.\nGot:      %+v\nExpected: %+v", got, expected)
+		}
+	}
+}
+
+type mapCache struct {
+	mu   sync.Mutex
+	m    map[string]Capabilities
+	gets []string
+}
+
+func (c *mapCache) Get(callsign string) (Capabilities, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gets = append(c.gets, callsign)
+	caps, ok := c.m[callsign]
+	return caps, ok
+}
+
+func (c *mapCache) Put(callsign string, caps Capabilities) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m[callsign] = caps
+}
+
+func TestSessionCapabilityCache(t *testing.T) {
+	cache := &mapCache{m: map[string]Capabilities{
+		"N0CALL": {RemoteUA: UserAgent{Name: "WL2K", Version: "2.0"}, RemoteSID: "B2FWHM$", MaxMessageSize: 500},
+	}}
+
+	// The cached capabilities are used until the handshake completes
+	s := NewSession("LA5NTA", "n0call", "JO39EQ", newMemMBox())
+	s.SetCapabilityCache(cache)
+	s.loadCachedCapabilities()
+	if s.RemoteSID() != "B2FWHM$" || s.RemoteMaxMessageSize() != 500 {
+		t.Errorf("Expected pre-seeded capabilities, got SID %q and max size %d", s.RemoteSID(), s.RemoteMaxMessageSize())
+	}
+
+	cs := NewSession("LA5NTA", "N0CALL", "JO39EQ", newMemMBox())
+	ms := NewSession("N0CALL", "LA5NTA", "JO39EQ", newMemMBox())
+	cs.SetCapabilityCache(cache)
+
+	exchange(t, cs, ms)
+
+	if !reflect.DeepEqual(cache.gets, []string{"N0CALL", "N0CALL"}) {
+		t.Errorf("Expected two cache reads for N0CALL, got %v", cache.gets)
+	}
+	if got := cache.m["N0CALL"]; !reflect.DeepEqual(got, cs.capabilities()) {
+		t.Errorf("Cache not updated after handshake.\nGot:      %+v\nExpected: %+v", got, cs.capabilities())
+	} else if got.RemoteSID == "B2FWHM$" || got.MaxMessageSize != 0 {
+		t.Errorf("Expected the negotiated capabilities to replace the cached ones")
+	}
+}
+
+func TestCapabilitiesJSON(t *testing.T) {
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+	s.SetSecureLoginHandleFunc(func() (string, error) { return "foobar", nil })
+	s.rd = bufio.NewReader(strings.NewReader(";FW: N0CALL\r[WL2K-5.0-B2FWIHJM$]\r;PQ: 23753528\rMax message size: 1000 bytes\rTest CMS >\r"))
+	var buf bytes.Buffer
+	if err := s.handshake(struct {
+		io.Reader
+		io.Writer
+	}{s.rd, &buf}); err != nil {
+		t.Fatalf("Handshake failed: %s", err)
+	}
+
+	data, err := json.Marshal(s.capabilities())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if strings.Contains(string(data), "foobar") {
+		t.Errorf("Expected no password in the JSON encoding, got %s", data)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expect := map[string]interface{}{
+		"RemoteUA":         map[string]interface{}{"Name": "WL2K", "Version": "5.0"},
+		"RemoteSID":        "B2FWIHJM$",
+		"RemoteFW":         []interface{}{map[string]interface{}{"Proto": "", "Addr": "N0CALL"}},
+		"MaxMessageSize":   float64(1000),
+		"SecureLogin":      true,
+		"Gzip":             false,
+		"Uncompressed":     false,
+		"CompactHandshake": false,
+		"Keepalive":        false,
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("Unexpected JSON encoding: %s", data)
+	}
+}
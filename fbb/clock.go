@@ -0,0 +1,34 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import "time"
+
+// clock is the source of time used by a Session, replaceable for testing.
+type clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time        { return time.Now() }
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// SetClockSource sets the source of the time used for dating the messages sent by the session.
+//
+// Use this if the system clock may be wrong (i.e. on a device without a real-time clock), and a
+// better source is available (i.e. GPS). The clock source is used for dating the messages generated
+// by the session (i.e. bounces), for the time of the trace headers and for outbound messages without
+// a Date header. Outbound messages dated by the caller are sent as is. The default is time.Now.
+func (s *Session) SetClockSource(now func() time.Time) { s.clockSource = now }
+
+// messageTime returns the time used for dating messages.
+func (s *Session) messageTime() time.Time {
+	if s.clockSource != nil {
+		return s.clockSource()
+	}
+	return s.clock.Now()
+}
@@ -0,0 +1,92 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock where time only advances when Sleep or Advance is called.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func newFakeClock() *fakeClock { return &fakeClock{now: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)} }
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sleeps = append(c.sleeps, d)
+	c.now = c.now.Add(d)
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (c *fakeClock) Sleeps() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Duration(nil), c.sleeps...)
+}
+
+func TestSessionClockSource(t *testing.T) {
+	source := time.Date(2016, 3, 28, 12, 43, 0, 0, time.UTC)
+
+	undated := newTestMessage("LA5NTA", "N0CALL", 100)
+	undated.Header.Del(HEADER_DATE)
+	dated := newTestMessage("LA5NTA", "N0CALL", 200)
+	dated.SetDate(time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC))
+	relayed := newTestMessage("LE1OF", "N0CALL", 300)
+
+	clientMBox, masterMBox := newMemMBox(undated, dated, relayed), newMemMBox()
+	client, master := tcpPipe(t)
+	errs := make(chan error, 1)
+	go func() {
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", clientMBox)
+		s.SetClockSource(func() time.Time { return source })
+		s.SetTraceHeaderFunc(func(msg *Message) (TraceHeader, bool) {
+			return TraceHeader{Node: "LA5NTA"}, msg.From().Addr != "LA5NTA"
+		})
+		_, err := s.Exchange(client)
+		errs <- err
+	}()
+	s := NewSession("N0CALL", "LA5NTA", "JO39EQ", masterMBox)
+	s.IsMaster(true)
+	if _, err := s.Exchange(master); err != nil {
+		t.Fatalf("Unexpected master error: %s", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Unexpected client error: %s", err)
+	}
+
+	got := make(map[string]*Message)
+	for _, msg := range masterMBox.inbox() {
+		got[msg.MID()] = msg
+	}
+	switch {
+	case len(got) != 3:
+		t.Fatalf("Expected 3 received messages, got %d", len(got))
+	case !got[undated.MID()].Date().Equal(source):
+		t.Errorf("Expected the undated message to be dated by the clock source, got %s", got[undated.MID()].Date())
+	case !got[dated.MID()].Date().Equal(dated.Date()):
+		t.Errorf("Expected the dated message to keep its date, got %s", got[dated.MID()].Date())
+	}
+	if h := got[relayed.MID()].TraceHeaders(); len(h) != 1 || !h[0].Time.Equal(source) {
+		t.Errorf("Expected the trace header to be dated by the clock source, got %v", h)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"fmt"
+	"time"
+)
+
+// DeferReason describes why an outbound message was deferred.
+type DeferReason int
+
+// The different reasons for deferring an outbound message.
+const (
+	DeferredByRemote  DeferReason = iota // The remote deferred the proposal (i.e. it's busy receiving it elsewhere).
+	HeldByRemote                         // The remote accepted the proposal, but will hold it.
+	ExceedsRemoteSize                    // The message exceeds the size limit given by the remote.
+)
+
+func (r DeferReason) String() string {
+	switch r {
+	case DeferredByRemote:
+		return "deferred by remote"
+	case HeldByRemote:
+		return "held by remote"
+	case ExceedsRemoteSize:
+		return "exceeds remote's size limit"
+	default:
+		return fmt.Sprintf("DeferReason(%d)", int(r))
+	}
+}
+
+// MarshalText encodes the reason as its string representation (i.e. in JSON).
+func (r DeferReason) MarshalText() ([]byte, error) { return []byte(r.String()), nil }
+
+// Deferral holds information about a deferred outbound message.
+type Deferral struct {
+	MID    string
+	Reason DeferReason
+
+	// Attempts is the number of times the message has been deferred, counted by the
+	// session's TransferStore (see Session.SetTransferStore).
+	Attempts int
+
+	// RetryAfter is the earliest time the message should be offered again, as
+	// given by the session's DeferralPolicy. Zero if no policy is set.
+	RetryAfter time.Time
+}
+
+// DeferralPolicy determines when a deferred message should be retried.
+//
+// The policy is not enforced by the Session. It is used to record a retry-after
+// hint for each Deferral, and may be consulted by the caller between connects.
+// The delay backs off with the number of deferrals counted by the session's
+// TransferStore, so share the store between sessions to back off across connects.
+type DeferralPolicy struct {
+	Delay    time.Duration // The delay before the first retry.
+	MaxDelay time.Duration // The upper bound of the delay. Zero means no bound.
+}
+
+// RetryAfter returns the delay before a message deferred the given number of
+// times (starting at 1) should be retried.
+//
+// The delay is doubled for each attempt, bounded by MaxDelay.
+func (p DeferralPolicy) RetryAfter(attempts int) time.Duration {
+	d := p.Delay
+	for i := 1; i < attempts; i++ {
+		if p.MaxDelay > 0 && d >= p.MaxDelay {
+			break
+		}
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+// setDeferred marks the outbound message mid as deferred and records it in the traffic stats.
+func (s *Session) setDeferred(mid string, reason DeferReason) {
+	s.outboundHandler().SetDeferred(mid)
+
+	d := Deferral{MID: mid, Reason: reason, Attempts: s.transfers.deferred(mid)}
+	if s.deferralPolicy != nil {
+		d.RetryAfter = s.clock.Now().Add(s.deferralPolicy.RetryAfter(d.Attempts))
+	}
+	s.trafficStats.Deferred = append(s.trafficStats.Deferred, d)
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import "fmt"
+
+// EventType is the type of an Event.
+type EventType int
+
+// The different event types.
+const (
+	HandshakeComplete EventType = iota // The handshake was successful.
+	ProposalOffered                    // A proposal was offered (by us or the remote).
+	MessageStarted                     // A message transfer started.
+	MessageCompleted                   // A message transfer completed.
+	ExchangeError                      // The exchange failed.
+)
+
+func (t EventType) String() string {
+	switch t {
+	case HandshakeComplete:
+		return "handshake complete"
+	case ProposalOffered:
+		return "proposal offered"
+	case MessageStarted:
+		return "message started"
+	case MessageCompleted:
+		return "message completed"
+	case ExchangeError:
+		return "error"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+// Event is a typed event emitted by a Session during Exchange.
+type Event struct {
+	Type EventType
+
+	// The MID and direction of the proposal or message (ProposalOffered, MessageStarted and MessageCompleted).
+	MID       string
+	Direction Direction
+
+	// The negotiated capabilities (HandshakeComplete).
+	Capabilities Capabilities
+
+	// The error returned by Exchange (ExchangeError).
+	Err error
+}
+
+// EventBufferSize is the capacity of the channel returned by Session.Events.
+const EventBufferSize = 64
+
+// Events returns a channel of events emitted during Exchange. It must be called before Exchange.
+//
+// The channel is buffered (see EventBufferSize), and the session will never block
+// sending on it. If the buffer is full, events are dropped. The channel is closed
+// when Exchange (or Transfer) returns, or when the handshake fails.
+func (s *Session) Events() <-chan Event {
+	if s.events == nil {
+		s.events = make(chan Event, EventBufferSize)
+	}
+	return s.events
+}
+
+func (s *Session) emit(e Event) {
+	if s.events == nil {
+		return
+	}
+	select {
+	case s.events <- e:
+	default:
+		// The buffer is full. Drop the event, as we must not block the exchange.
+	}
+}
+
+// closeEvents closes the events channel (if any).
+func (s *Session) closeEvents() {
+	if s.events != nil && !s.eventsClosed {
+		close(s.events)
+		s.eventsClosed = true
+	}
+}
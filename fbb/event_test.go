@@ -0,0 +1,95 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"reflect"
+	"testing"
+)
+
+func collectEvents(ch <-chan Event) <-chan []Event {
+	done := make(chan []Event, 1)
+	go func() {
+		var events []Event
+		for e := range ch {
+			events = append(events, e)
+		}
+		done <- events
+	}()
+	return done
+}
+
+func eventTypes(events []Event) []EventType {
+	types := make([]EventType, len(events))
+	for i, e := range events {
+		types[i] = e.Type
+	}
+	return types
+}
+
+func TestSessionEvents(t *testing.T) {
+	msg := newTestMessage("LA5NTA", "N0CALL", 1000)
+	cs := NewSession("LA5NTA", "N0CALL", "JO39EQ", newMemMBox(msg))
+	ms := NewSession("N0CALL", "LA5NTA", "JO39EQ", newMemMBox())
+
+	clientEvents, masterEvents := collectEvents(cs.Events()), collectEvents(ms.Events())
+	exchange(t, cs, ms)
+
+	tests := []struct {
+		name      string
+		events    []Event
+		direction Direction
+	}{
+		{"client", <-clientEvents, Outbound},
+		{"master", <-masterEvents, Inbound},
+	}
+	for _, tt := range tests {
+		expect := []EventType{HandshakeComplete, ProposalOffered, MessageStarted, MessageCompleted}
+		if got := eventTypes(tt.events); !reflect.DeepEqual(got, expect) {
+			t.Errorf("%s: Expected events %v, got %v", tt.name, expect, got)
+			continue
+		}
+		if tt.events[0].Capabilities.RemoteSID == "" {
+			t.Errorf("%s: Expected capabilities in handshake event", tt.name)
+		}
+		for _, e := range tt.events[1:] {
+			if e.MID != msg.MID() || e.Direction != tt.direction {
+				t.Errorf("%s: Unexpected %s event: MID %q, direction %s", tt.name, e.Type, e.MID, e.Direction)
+			}
+		}
+	}
+}
+
+func TestSessionEventsError(t *testing.T) {
+	client, master := tcpPipe(t)
+
+	cs := NewSession("LA5NTA", "N0CALL", "JO39EQ", newMemMBox())
+	events := collectEvents(cs.Events())
+
+	master.Close()
+	_, err := cs.Exchange(client)
+	if err == nil {
+		t.Fatal("Expected exchange to fail")
+	}
+
+	got := <-events
+	if len(got) != 1 || got[0].Type != ExchangeError {
+		t.Fatalf("Expected a single error event, got %v", eventTypes(got))
+	}
+	if got[0].Err != err {
+		t.Errorf("Expected error event with %q, got %q", err, got[0].Err)
+	}
+}
+
+func TestSessionEventsNonBlocking(t *testing.T) {
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", newMemMBox())
+	s.Events()
+	for i := 0; i < EventBufferSize+10; i++ {
+		s.emit(Event{Type: ProposalOffered})
+	}
+	if n := len(s.events); n != EventBufferSize {
+		t.Errorf("Expected %d buffered events, got %d", EventBufferSize, n)
+	}
+}
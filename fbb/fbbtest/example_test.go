@@ -0,0 +1,42 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbbtest_test
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/la5nta/wl2k-go/fbb"
+	"github.com/la5nta/wl2k-go/fbb/fbbtest"
+)
+
+func ExampleServer() {
+	srv := fbbtest.NewServer("N0CALL")
+
+	msg := fbb.NewMessage(fbb.Private, "N0CALL")
+	msg.AddTo("LA5NTA")
+	msg.SetSubject("Hello")
+	msg.SetBody("Hello from the test server")
+	srv.AddOut(msg)
+
+	conn, srvErrs, err := srv.Connect("LA5NTA")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mbox := fbbtest.NewMailbox()
+	session := fbb.NewSession("LA5NTA", srv.Callsign, "JO39EQ", mbox)
+	if _, err := session.Exchange(conn); err != nil {
+		log.Fatal(err)
+	}
+	if err := <-srvErrs; err != nil {
+		log.Fatal(err)
+	}
+
+	for _, msg := range mbox.Received() {
+		fmt.Println(msg.Subject())
+	}
+	// Output: Hello
+}
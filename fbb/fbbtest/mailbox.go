@@ -0,0 +1,121 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbbtest
+
+import (
+	"sync"
+
+	"github.com/la5nta/wl2k-go/fbb"
+)
+
+// Mailbox is an in-memory fbb.MBoxHandler.
+//
+// It is safe for concurrent use.
+type Mailbox struct {
+	mu       sync.Mutex
+	outbound []*fbb.Message
+	received []*fbb.Message
+	sent     map[string]bool
+	deferred map[string]bool
+}
+
+// NewMailbox returns a new Mailbox with the given outbound messages.
+func NewMailbox(out ...*fbb.Message) *Mailbox {
+	return &Mailbox{
+		outbound: out,
+		sent:     make(map[string]bool),
+		deferred: make(map[string]bool),
+	}
+}
+
+// AddOut adds one or more messages to the outbox.
+func (m *Mailbox) AddOut(msg ...*fbb.Message) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.outbound = append(m.outbound, msg...)
+}
+
+// Received returns the messages received by this mailbox.
+func (m *Mailbox) Received() []*fbb.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*fbb.Message(nil), m.received...)
+}
+
+// IsSent reports whether the message identified by MID has been delivered (or rejected) by the remote.
+func (m *Mailbox) IsSent(MID string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.sent[MID]
+	return ok
+}
+
+func (m *Mailbox) Prepare() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deferred = make(map[string]bool)
+	return nil
+}
+
+// GetOutbound returns all pending messages with at least one receiver in fw.
+//
+// If fw is empty, all pending messages are returned.
+func (m *Mailbox) GetOutbound(fw ...fbb.Address) []*fbb.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := make([]*fbb.Message, 0, len(m.outbound))
+	for _, msg := range m.outbound {
+		if _, sent := m.sent[msg.MID()]; sent || m.deferred[msg.MID()] {
+			continue
+		}
+		if len(fw) == 0 || addressedTo(msg, fw) {
+			out = append(out, msg)
+		}
+	}
+	return out
+}
+
+func addressedTo(msg *fbb.Message, fw []fbb.Address) bool {
+	for _, rcpt := range msg.Receivers() {
+		for _, addr := range fw {
+			if rcpt == addr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m *Mailbox) SetSent(MID string, rejected bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent[MID] = rejected
+}
+
+func (m *Mailbox) SetDeferred(MID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deferred[MID] = true
+}
+
+func (m *Mailbox) ProcessInbound(msg ...*fbb.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.received = append(m.received, msg...)
+	return nil
+}
+
+// GetInboundAnswer accepts all messages not already received.
+func (m *Mailbox) GetInboundAnswer(p fbb.Proposal) fbb.ProposalAnswer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, msg := range m.received {
+		if msg.MID() == p.MID() {
+			return fbb.Reject
+		}
+	}
+	return fbb.Accept
+}
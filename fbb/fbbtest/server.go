@@ -0,0 +1,95 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+// Package fbbtest provides utilities for B2F integration testing.
+//
+// The Server type is a lightweight in-process FBB master (gateway) that
+// clients can exchange messages with:
+//
+//	srv := fbbtest.NewServer("N0CALL")
+//	srv.AddOut(msg) // Message for LA5NTA
+//
+//	conn, errs, _ := srv.Connect("LA5NTA")
+//	session := fbb.NewSession("LA5NTA", srv.Callsign, "JO39EQ", mbox)
+//	session.Exchange(conn)
+package fbbtest
+
+import (
+	"errors"
+	"net"
+
+	"github.com/la5nta/wl2k-go/fbb"
+)
+
+// Server is the master side of a B2F exchange.
+type Server struct {
+	*Mailbox
+
+	Callsign string   // The server's call sign.
+	Locator  string   // The server's locator.
+	MOTD     []string // Lines sent before the handshake.
+
+	// If non-nil, clients are challenged with secure login. The
+	// map holds the password of each client call sign.
+	Passwords map[string]string
+}
+
+// NewServer returns a new Server with an empty mailbox.
+func NewServer(callsign string) *Server {
+	return &Server{
+		Mailbox:  NewMailbox(),
+		Callsign: callsign,
+	}
+}
+
+// Serve runs a single exchange over conn with the remote identified by remoteCall.
+//
+// The connection is closed when the exchange is done.
+func (s *Server) Serve(conn net.Conn, remoteCall string) (fbb.TrafficStats, error) {
+	session := fbb.NewSession(s.Callsign, remoteCall, s.Locator, s.Mailbox)
+	session.IsMaster(true)
+	session.SetMOTD(s.MOTD...)
+
+	if s.Passwords != nil {
+		session.SetSecureLoginVerifier(func(call string) (string, error) {
+			password, ok := s.Passwords[call]
+			if !ok {
+				return "", errors.New("Unknown call sign " + call)
+			}
+			return password, nil
+		})
+	}
+
+	return session.Exchange(conn)
+}
+
+// Connect starts serving a new exchange with the remote identified by remoteCall.
+//
+// It returns the client end of a loopback TCP connection and a channel that
+// delivers the result of the server's exchange (see Serve).
+func (s *Server) Connect(remoteCall string) (net.Conn, <-chan error, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		ln.Close()
+		if err != nil {
+			errs <- err
+			return
+		}
+		_, err = s.Serve(conn, remoteCall)
+		errs <- err
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		ln.Close()
+		return nil, nil, err
+	}
+	return conn, errs, nil
+}
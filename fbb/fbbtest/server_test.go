@@ -0,0 +1,74 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbbtest
+
+import (
+	"testing"
+
+	"github.com/la5nta/wl2k-go/fbb"
+)
+
+func newMessage(from, to, subject string) *fbb.Message {
+	msg := fbb.NewMessage(fbb.Private, from)
+	msg.AddTo(to)
+	msg.SetSubject(subject)
+	msg.SetBody("Hello world")
+	return msg
+}
+
+func TestServerExchange(t *testing.T) {
+	srv := NewServer("N0CALL")
+	srv.MOTD = []string{"Test Gateway"}
+	srv.Passwords = map[string]string{"LA5NTA": "foobar"}
+
+	inbound := newMessage("N0CALL", "LA5NTA", "To client")
+	srv.AddOut(inbound)
+
+	outbound := newMessage("LA5NTA", "N0CALL", "From client")
+	mbox := NewMailbox(outbound)
+
+	conn, srvErrs, err := srv.Connect("LA5NTA")
+	if err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+
+	session := fbb.NewSession("LA5NTA", srv.Callsign, "JO39EQ", mbox)
+	session.SetSecureLoginHandleFunc(func() (string, error) { return "foobar", nil })
+	if _, err := session.Exchange(conn); err != nil {
+		t.Fatalf("Client exchange failed: %s", err)
+	}
+	if err := <-srvErrs; err != nil {
+		t.Fatalf("Server exchange failed: %s", err)
+	}
+
+	if got := mbox.Received(); len(got) != 1 || got[0].MID() != inbound.MID() {
+		t.Errorf("Client did not receive the expected message")
+	}
+	if got := srv.Received(); len(got) != 1 || got[0].MID() != outbound.MID() {
+		t.Errorf("Server did not receive the expected message")
+	}
+	if !mbox.IsSent(outbound.MID()) {
+		t.Errorf("Outbound message was not marked as sent")
+	}
+}
+
+func TestServerSecureLoginFailure(t *testing.T) {
+	srv := NewServer("N0CALL")
+	srv.Passwords = map[string]string{"LA5NTA": "foobar"}
+
+	conn, srvErrs, err := srv.Connect("LA5NTA")
+	if err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+
+	session := fbb.NewSession("LA5NTA", srv.Callsign, "JO39EQ", NewMailbox())
+	session.SetSecureLoginHandleFunc(func() (string, error) { return "wrong", nil })
+	if _, err := session.Exchange(conn); !fbb.IsLoginFailure(err) {
+		t.Errorf("Expected login failure at client, got: %v", err)
+	}
+	if err := <-srvErrs; err != fbb.ErrSecureLoginFailed {
+		t.Errorf("Expected ErrSecureLoginFailed at server, got: %v", err)
+	}
+}
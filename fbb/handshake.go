@@ -6,16 +6,90 @@ package fbb
 
 import (
 	"bufio"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"io"
+	"math/big"
 	"os"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var ErrNoFB2 = errors.New("Remote does not support B2 Forwarding Protocol")
 
+// NoFB2Error is returned when the remote does not support the B2 Forwarding Protocol.
+//
+// It wraps ErrNoFB2, and holds the SID codes advertised by the remote.
+type NoFB2Error struct {
+	SID string // The remote's SID codes
+}
+
+func (e *NoFB2Error) Error() string {
+	return fmt.Sprintf("%s (remote advertises %s)", ErrNoFB2, e.SID)
+}
+
+// Unwrap returns ErrNoFB2.
+func (e *NoFB2Error) Unwrap() error { return ErrNoFB2 }
+
+// ErrRemoteDroppedDuringAuth indicates that the remote went away before we were able to respond to its secure login challenge.
+//
+// This typically happens when the remote times out waiting for the response.
+var ErrRemoteDroppedDuringAuth = errors.New("Remote dropped the connection during secure login")
+
+// SecureLoginDropError is returned when the secure login response could not be written to the remote.
+//
+// It matches ErrRemoteDroppedDuringAuth using errors.Is, and unwraps to the underlying write error.
+type SecureLoginDropError struct {
+	Err error // The write error
+}
+
+func (e *SecureLoginDropError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrRemoteDroppedDuringAuth, e.Err)
+}
+
+// Unwrap returns the underlying write error.
+func (e *SecureLoginDropError) Unwrap() error { return e.Err }
+
+// Is reports whether target is ErrRemoteDroppedDuringAuth.
+func (e *SecureLoginDropError) Is(target error) bool { return target == ErrRemoteDroppedDuringAuth }
+
+// ErrNoSIDCodes is returned when the remote's SID header (i.e. [App-Version-Codes]) holds no feature codes.
+var ErrNoSIDCodes = errors.New("Remote SID has no feature codes")
+
+// ErrTooManyAttempts is returned by Exchange when the session's handshake attempt limit is reached.
+//
+// See Session.SetMaxHandshakeAttempts.
+var ErrTooManyAttempts = errors.New("Too many handshake attempts")
+
+// ErrHandshakeTimeout is returned when the handshake does not complete within the handshake timeout.
+//
+// See Session.SetHandshakeTimeout.
+var ErrHandshakeTimeout = errors.New("Handshake timeout")
+
+// ErrNoHandshake is returned by Transfer if called without a successful Handshake.
+var ErrNoHandshake = errors.New("Handshake not performed")
+
+var ErrAppNotAllowed = errors.New("Remote application is not allowed")
+
+// ErrBIDUnsupported is returned when the remote does not support BID, but it is required.
+//
+// See Session.SetRequireBID.
+var ErrBIDUnsupported = errors.New("Remote does not support BID")
+
+var ErrSecureLoginFailed = errors.New("Secure login failed - account password does not match")
+
+// ErrSecureChallengeTooLong is returned when the remote's secure login challenge exceeds MaxSecureChallengeLength.
+var ErrSecureChallengeTooLong = errors.New("Secure login challenge too long")
+
+// MaxSecureChallengeLength is the maximum length of a secure login challenge (;PQ) accepted from the remote.
+//
+// The challenges used by Winlink are 8 digits.
+const MaxSecureChallengeLength = 64
+
 // IsLoginFailure returns a boolean indicating whether the error is known to
 // report that the secure login failed.
 func IsLoginFailure(err error) bool {
@@ -26,16 +100,75 @@ func IsLoginFailure(err error) bool {
 	return strings.Contains(errStr, "secure login failed")
 }
 
+// transientLoginFailureHints are (lower case) phrases used by servers to report
+// secure login failures that are not caused by the credentials.
+var transientLoginFailureHints = []string{
+	"try again later",
+	"temporarily",
+	"unavailable",
+	"timed out",
+	"timeout",
+	"server error",
+	"database",
+}
+
+// IsTransientLoginFailure returns a boolean indicating whether the error is known to
+// report a secure login failure that is likely to succeed on retry (e.g. the server's
+// authentication backend being down).
+//
+// Failures for which the remote's message gives no such indication (e.g. the password
+// does not match) are considered permanent. IsLoginFailure reports both classes.
+func IsTransientLoginFailure(err error) bool {
+	if !IsLoginFailure(err) {
+		return false
+	}
+	errStr := strings.ToLower(err.Error())
+	if strings.Contains(errStr, "password does not match") {
+		return false
+	}
+	for _, hint := range transientLoginFailureHints {
+		if strings.Contains(errStr, hint) {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Session) handshake(rw io.ReadWriter) error {
+	s.handshakeAttempts++
+
+	start := s.clock.Now()
+	if s.connectSettleDelay > 0 {
+		s.clock.Sleep(s.connectSettleDelay)
+	}
+	if s.handshakeTimeout > 0 && s.clock.Now().Sub(start) >= s.handshakeTimeout {
+		return ErrHandshakeTimeout // The settle delay counts towards the handshake timeout
+	}
+
 	if s.master {
 		// Send MOTD lines
-		for _, line := range s.motd {
+		for _, line := range s.motdLines() {
 			fmt.Fprintf(rw, "%s\r", line)
 		}
 
+		if s.secureLoginVerifier != nil {
+			challenge, err := newSecureChallenge(rand.Reader)
+			if err != nil {
+				return err
+			}
+			s.secureChallenge = challenge
+		}
+
 		if err := s.sendHandshake(rw, ""); err != nil {
 			return err
 		}
+
+		// Estimate the link RTT by waiting for the first byte of the remote's response.
+		// Any read error is left for readHandshake to report.
+		sent := s.clock.Now()
+		if _, err := s.rd.Peek(1); err == nil {
+			s.trafficStats.HandshakeRTT = s.clock.Now().Sub(sent)
+		}
 	}
 
 	hs, err := s.readHandshake()
@@ -48,8 +181,50 @@ func (s *Session) handshake(rw io.ReadWriter) error {
 		return errors.New("No sid in handshake")
 	}
 
+	if !s.isAllowedApp(hs.App) {
+		return ErrAppNotAllowed
+	}
+
+	if s.requireBID && !hs.SID.Has(sBID) {
+		return ErrBIDUnsupported
+	}
+
 	s.remoteSID = hs.SID
+	s.remoteRawSID = hs.RawSID
+	s.remoteRawSIDLine = hs.RawSIDLine
+	s.remoteUA = UserAgent{Name: hs.App, Version: hs.Version}
 	s.remoteFW = hs.FW
+	s.remoteMaxMessageSize = hs.MaxMessageSize
+	s.remoteTimeout = hs.Timeout
+	if hs.Timeout > 0 && !s.turnoverTimeoutSet {
+		s.log.Printf("Using the remote's suggested timeout (%s)", hs.Timeout)
+		s.turnoverTimeout = hs.Timeout
+	}
+	s.remoteFooter = hs.Footer
+	s.remoteTime = hs.Time
+	if !hs.Time.IsZero() {
+		s.clockSkew = s.messageTime().Sub(hs.Time)
+		if s.clockSkew > ClockSkewThreshold || s.clockSkew < -ClockSkewThreshold {
+			s.log.Printf("Warning: The local clock differs from the remote's clock by %s", s.clockSkew)
+		}
+	}
+
+	// Warn if the remote is greeting another station (i.e. a misconfigured gateway)
+	if f := hs.Footer; f != nil && !strings.EqualFold(f.To, s.mycall) {
+		s.log.Printf("Warning: The remote addressed %s, expected %s", f.To, s.Mycall())
+		s.trafficStats.Misaddressed = true
+	}
+
+	// No ;FW line means no forwarders declared (i.e. a Winlink CMS), unless told otherwise.
+	if hs.FW == nil && s.missingFWAsSelf && s.targetcall != "" {
+		s.remoteFW = []Address{AddressFromString(s.targetcall)}
+	}
+
+	if s.hsApproval != nil {
+		if err := s.hsApproval(s.handshakeInfo(hs)); err != nil {
+			return err
+		}
+	}
 
 	var secureResp string
 	if hs.SecureChallenge != "" {
@@ -66,16 +241,163 @@ func (s *Session) handshake(rw io.ReadWriter) error {
 	}
 
 	if !s.master {
-		return s.sendHandshake(rw, secureResp)
+		if err := s.sendHandshake(rw, secureResp); err != nil && secureResp != "" {
+			return &SecureLoginDropError{err}
+		} else if err != nil {
+			return err
+		}
+		s.secureLoginPerformed = secureResp != ""
+		return nil
+	} else if s.secureChallenge != "" {
+		if err := s.verifySecureLogin(hs.SecureResponse); err != nil {
+			return err
+		}
+		s.secureLoginPerformed = true
+		return nil
 	} else {
 		return nil
 	}
 }
 
+// verifySecureLogin checks the remote's response to our secure login challenge.
+func (s *Session) verifySecureLogin(response string) error {
+	password, err := s.secureLoginVerifier(s.Targetcall())
+	if err != nil {
+		return err
+	}
+
+	if response == "" || response != secureLoginResponse(s.secureChallenge, password) {
+		return ErrSecureLoginFailed
+	}
+	return nil
+}
+
+// newSecureChallenge returns a random secure login challenge of 8 digits read from r.
+//
+// The challenge must be unpredictable, or a captured response (;PR) could be replayed.
+func newSecureChallenge(r io.Reader) (string, error) {
+	n, err := rand.Int(r, big.NewInt(100000000))
+	if err != nil {
+		return "", fmt.Errorf("Unable to generate secure login challenge: %w", err)
+	}
+	return fmt.Sprintf("%08d", n), nil
+}
+
+// HandshakeError is returned when the handshake fails due to a read error.
+//
+// Phase describes what part of the remote's handshake was being read when the error occurred.
+type HandshakeError struct {
+	Phase string
+	Err   error
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("Handshake failed while reading %s: %s", e.Phase, e.Err)
+}
+
+// Unwrap returns the underlying read error.
+func (e *HandshakeError) Unwrap() error { return e.Err }
+
+// handshakeReadError attributes a read error to a handshake phase based on
+// what has been read so far (data) and the partially read line (if any).
+//
+// io.EOF is returned as is, as it indicates that the remote hung up.
+func handshakeReadError(data handshakeData, partial string, err error) error {
+	if err == io.EOF {
+		return err
+	}
+
+	var phase string
+	switch {
+	case strings.HasPrefix(partial, "["):
+		phase = "SID"
+	case strings.HasPrefix(partial, ";FW"):
+		phase = "FW line"
+	case strings.HasPrefix(partial, ";PQ"):
+		phase = "secure login challenge"
+	case data.SID == "":
+		phase = "banner (before SID)"
+	default:
+		phase = "banner (after SID)"
+	}
+	return &HandshakeError{Phase: phase, Err: err}
+}
+
 type handshakeData struct {
+	App             string // Application name from the SID header
+	Version         string // Application version from the SID header
 	SID             sid
+	RawSID          string // The SID header as received (i.e. [WL2K-2.8.4.8-B2FWIHJM$])
+	RawSIDLine      string // The complete line containing the SID header, exactly as received
 	FW              []Address
 	SecureChallenge string
+	SecureResponse  string
+	MaxMessageSize  int           // Max message size advertised in the banner (0 if unknown)
+	Timeout         time.Duration // Command timeout advertised in the banner (0 if unknown)
+	Time            time.Time     // The remote's time advertised in the banner (zero if unknown)
+	Footer          *Footer       // The informational footer (nil if not sent)
+	MOTD            []string      // The lines preceding the SID header
+	Banner          []string      // Every line of the handshake, as received
+}
+
+// HandshakeInfo holds what the remote sent during the handshake (see Session.SetHandshakeApprovalFunc).
+type HandshakeInfo struct {
+	Targetcall  string   // The remote's call sign (from the footer if given, otherwise the session's target call sign)
+	App         string   // Application name from the SID header
+	Version     string   // Application version from the SID header
+	SID         string   // The SID header as received (i.e. [WL2K-2.8.4.8-B2FWIHJM$])
+	MOTD        []string // The lines preceding the SID header (i.e. the remote's welcome message)
+	Banner      []string // Every line of the remote's handshake, as received
+	Footer      *Footer  // The informational footer (nil if not sent)
+	SecureLogin bool     // True if the remote requested a secure login
+}
+
+// handshakeInfo returns the HandshakeInfo of the given handshake data.
+func (s *Session) handshakeInfo(hs handshakeData) HandshakeInfo {
+	info := HandshakeInfo{
+		Targetcall:  s.Targetcall(),
+		App:         hs.App,
+		Version:     hs.Version,
+		SID:         hs.RawSID,
+		MOTD:        hs.MOTD,
+		Banner:      hs.Banner,
+		Footer:      hs.Footer,
+		SecureLogin: hs.SecureChallenge != "",
+	}
+	if hs.Footer != nil {
+		info.Targetcall = hs.Footer.From
+	}
+	return info
+}
+
+// Footer is the informational line ending a handshake, i.e. "; N0CALL DE LA5NTA (JO39EQ)".
+type Footer struct {
+	To      string // The call sign addressed by the sender (i.e. N0CALL).
+	From    string // The sender's call sign (i.e. LA5NTA).
+	Locator string // The sender's locator (empty if not given).
+}
+
+var footerRe = regexp.MustCompile(`^;\s*(\S+)\s+DE\s+([^\s()>]+)\s*(?:\(([^)]*)\))?\s*>?$`)
+
+// parseFooter parses a handshake footer line, i.e. "; N0CALL DE LA5NTA (JO39EQ)>".
+func parseFooter(line string) (Footer, bool) {
+	match := footerRe.FindStringSubmatch(line)
+	if match == nil {
+		return Footer{}, false
+	}
+	return Footer{To: match[1], From: match[2], Locator: match[3]}, true
+}
+
+func (s *Session) isAllowedApp(app string) bool {
+	if s.allowedApps == nil {
+		return true
+	}
+	for _, allowed := range s.allowedApps {
+		if strings.EqualFold(allowed, app) {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *Session) readHandshake() (handshakeData, error) {
@@ -84,9 +406,15 @@ func (s *Session) readHandshake() (handshakeData, error) {
 	for {
 		bytes, err := s.rd.Peek(1)
 		if err != nil {
-			return data, err
+			return data, handshakeReadError(data, "", err)
 		} else if bytes[0] == 'F' {
 			return data, nil // Next line is a protocol command, handshake is done
+		} else if bytes[0] == 'f' {
+			// Some non-conforming peers send lowercase commands. As banner lines may
+			// start with a lowercase f, require the command char to be known.
+			if bytes, _ := s.rd.Peek(2); len(bytes) == 2 && isCommandLine(string(bytes)) {
+				return data, nil
+			}
 		}
 
 		// Ignore remote errors here, as the server sometimes sends lines like
@@ -94,7 +422,34 @@ func (s *Session) readHandshake() (handshakeData, error) {
 		// are not errors
 		line, err := s.nextLineRemoteErr(false)
 		if err != nil {
-			return data, err
+			return data, handshakeReadError(data, line, err)
+		}
+		data.Banner = append(data.Banner, line)
+		if data.SID == "" && !strings.Contains(line, `[`) {
+			data.MOTD = append(data.MOTD, line)
+		}
+
+		// The banner may advertise a message size limit
+		n, isSizeHint := parseMaxSizeHint(line)
+		if isSizeHint {
+			data.MaxMessageSize = n
+		}
+
+		// ... and a command timeout
+		d, isTimeoutHint := parseTimeoutHint(line)
+		if isTimeoutHint {
+			data.Timeout = d
+		}
+
+		// ... and the remote's time
+		ts, isTimeHint := parseTimeHint(line)
+		if isTimeHint {
+			data.Time = ts
+		}
+
+		footer, isFooter := parseFooter(line)
+		if isFooter {
+			data.Footer = &footer
 		}
 
 		//REVIEW: We should probably be more strict on what to allow here,
@@ -106,33 +461,142 @@ func (s *Session) readHandshake() (handshakeData, error) {
 			if err != nil {
 				return data, err
 			}
+			data.RawSID = sidRe.FindString(line)
+			data.RawSIDLine = s.rawLine
+			data.App, data.Version = parseSIDApp(line)
 
 			// Do we support the remote's SID codes?
-			if !data.SID.Has(sFBComp2) { // We require FBB compressed protocol v2 for now
-				return data, ErrNoFB2
+			switch {
+			case s.forceUncompressed && data.SID.Has(sFBBasic):
+				// The basic protocol is sufficient
+			case isBasicOnly(data.SID):
+				// The remote forces uncompressed transfers
+			case !data.SID.Has(sFBComp2): // We require FBB compressed protocol v2 for now
+				return data, &NoFB2Error{SID: string(data.SID)}
 			}
-		case strings.HasPrefix(line, ";FW"): // Forwarders
-			data.FW, err = parseFW(line)
+		case strings.HasPrefix(line, ";FW"): // Forwarders (may be split across multiple lines)
+			fw, err := parseFW(line)
 			if err != nil {
 				return data, err
 			}
+			data.FW = append(data.FW, fw...)
+			if data.FW == nil {
+				data.FW = fw // Keep a declared (but empty) FW distinguishable from a missing one
+			}
 		case strings.HasPrefix(line, ";PQ"): // Secure password challenge
-			data.SecureChallenge = line[5:]
+			data.SecureChallenge, err = parseSecureChallenge(line)
+			if err != nil {
+				return data, err
+			}
+
+		case strings.HasPrefix(line, ";PR"): // Secure password response
+			data.SecureResponse = parseSecureResponse(line)
 
 		case strings.HasSuffix(line, ">"): // Prompt
 			return data, nil
-		default:
+		case isSizeHint || isTimeoutHint || isTimeHint || isFooter || s.unknownLine == nil:
 			// Ignore
+		default:
+			if err := s.unknownLine(line); err != nil {
+				return data, err
+			}
 		}
 	}
 }
 
+// parseSecureChallenge returns the challenge given in a ;PQ line.
+func parseSecureChallenge(line string) (string, error) {
+	challenge := strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(line, ";PQ"), ":"))
+	if len(challenge) > MaxSecureChallengeLength {
+		return "", ErrSecureChallengeTooLong
+	}
+	return challenge, nil
+}
+
+// parseSecureResponse returns the response given in a ;PR line.
+func parseSecureResponse(line string) string {
+	return strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(line, ";PR"), ":"))
+}
+
+// Matches banner lines like "Max message size: 120000 bytes", "Max message size is 2 MB" or "Maximum msg size 120KB".
+var maxSizeHintRe = regexp.MustCompile(`(?i)max(?:imum)?\s*(?:message|msg)?\s*size(?:\s+is)?\W*(\d+)\s*([a-z]*)`)
+
+// parseMaxSizeHint returns the message size limit (in bytes) advertised by the given banner line.
+//
+// The unit defaults to bytes. Lines with an unknown unit are not considered a hint.
+func parseMaxSizeHint(line string) (int, bool) {
+	match := maxSizeHintRe.FindStringSubmatch(line)
+	if match == nil {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(match[1])
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	switch strings.ToLower(match[2]) {
+	case "", "b", "byte", "bytes":
+	case "k", "kb", "kbyte", "kbytes":
+		n *= 1024
+	case "m", "mb", "mbyte", "mbytes":
+		n *= 1024 * 1024
+	default:
+		return 0, false
+	}
+	return n, true
+}
+
+// Matches banner lines like "Timeout: 120 seconds" or "Command timeout is 2 min".
+var timeoutHintRe = regexp.MustCompile(`(?i)\btime\s?out\D*?(\d+)\s*(s|secs?|seconds?|m|mins?|minutes?)?\b`)
+
+// parseTimeoutHint returns the command timeout advertised by the given banner line.
+//
+// The unit defaults to seconds.
+func parseTimeoutHint(line string) (time.Duration, bool) {
+	match := timeoutHintRe.FindStringSubmatch(line)
+	if match == nil {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(match[1])
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	d := time.Duration(n) * time.Second
+	if strings.HasPrefix(strings.ToLower(match[2]), "m") {
+		d = time.Duration(n) * time.Minute
+	}
+	return d, true
+}
+
+// Matches timestamps in banner lines like "Gateway time: 2016-03-28 12:43:05 UTC" or "LA1B 2016/03/28 12:43Z".
+var timeHintRe = regexp.MustCompile(`\b(\d{4})[-/.](\d{2})[-/.](\d{2})[ T](\d{2}):(\d{2})(?::(\d{2}))?\s*(?:Z|UTC|GMT)?\b`)
+
+// parseTimeHint returns the time advertised by the given banner line.
+//
+// The time is assumed to be UTC, as all times in the Winlink system.
+func parseTimeHint(line string) (time.Time, bool) {
+	match := timeHintRe.FindStringSubmatch(line)
+	if match == nil {
+		return time.Time{}, false
+	}
+	if match[6] == "" {
+		match[6] = "00"
+	}
+
+	t, err := time.Parse("2006-01-02 15:04:05", fmt.Sprintf("%s-%s-%s %s:%s:%s", match[1], match[2], match[3], match[4], match[5], match[6]))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
 func (s *Session) sendHandshake(writer io.Writer, secureResp string) error {
 	w := bufio.NewWriter(writer)
 
 	// Request messages on behalf of every localFW
 	fmt.Fprintf(w, ";FW:")
-	for i, addr := range s.localFW {
+	for i, addr := range s.fwAddresses(true) {
 		// Include passwordhash for auxiliary calls (required by WL2K-4.x or later)
 		if secureResp != "" && i > 0 {
 			//TODO: Add support for individual passwords
@@ -143,31 +607,97 @@ func (s *Session) sendHandshake(writer io.Writer, secureResp string) error {
 	}
 	fmt.Fprintf(w, "\r")
 
-	writeSID(w, s.ua.Name, s.ua.Version)
+	var extra []string
+	if s.compactHandshake {
+		extra = append(extra, sCompact)
+	}
+	if s.keepaliveInterval > 0 {
+		extra = append(extra, sKeepalive)
+	}
+	writeSID(w, s.ua.Name, s.ua.Version, s.advertisedSID(), extra...)
+
+	if s.master && s.secureChallenge != "" {
+		writeSecureLoginChallenge(w, s.secureChallenge)
+	}
 
 	if secureResp != "" {
 		writeSecureLoginResponse(w, secureResp)
 	}
 
-	fmt.Fprintf(w, "; %s DE %s (%s)", s.targetcall, s.mycall, s.locator)
-	if s.master {
-		fmt.Fprintf(w, ">\r")
-	} else {
-		fmt.Fprintf(w, "\r")
+	switch {
+	case s.master:
+		fmt.Fprintf(w, "; %s DE %s (%s)>\r", s.Targetcall(), s.Mycall(), s.locator)
+	case s.compactHandshake && s.remoteSID.Has(sCompact):
+		// The footer is informational only, and the remote does not need it
+	default:
+		fmt.Fprintf(w, "; %s DE %s (%s)\r", s.Targetcall(), s.Mycall(), s.locator)
 	}
 
 	return w.Flush()
 }
 
+// fwAddresses returns the addresses to request messages on behalf of, in the order they
+// should be sent on the ;FW line.
+//
+// The primary call sign is always first. The auxiliary addresses follows in the order
+// they were added, or in lexical order if fwSort is set. Auxiliary addresses rejected by
+// the authorized calls function are left out. If paged, only the addresses of the current
+// page follow the primary call sign.
+func (s *Session) fwAddresses(paged bool) []Address {
+	fw := make([]Address, len(s.localFW))
+	copy(fw, s.localFW)
+	if s.direction == Send && len(fw) > 1 {
+		fw = fw[:1]
+	}
+	for i, addr := range fw {
+		if addr.Proto == "" {
+			fw[i].Addr = s.callsign(addr.Addr)
+		}
+	}
+	if s.isAuthorizedCall != nil && len(fw) > 1 {
+		authorized := fw[:1]
+		for _, addr := range fw[1:] {
+			if !s.isAuthorizedCall(addr) {
+				if paged {
+					s.log.Printf("Warning: Not requesting messages for %s (not authorized)", addr)
+				}
+				continue
+			}
+			authorized = append(authorized, addr)
+		}
+		fw = authorized
+	}
+	if s.fwSort && len(fw) > 2 {
+		sort.Stable(byAddr(fw[1:]))
+	}
+	if paged && s.fwPageSize > 0 {
+		start, end := 1+s.fwPage*s.fwPageSize, 1+(s.fwPage+1)*s.fwPageSize
+		switch {
+		case start > len(fw):
+			start, end = len(fw), len(fw)
+		case end > len(fw):
+			end = len(fw)
+		}
+		fw = append(fw[:1], fw[start:end]...)
+	}
+	return fw
+}
+
+type byAddr []Address
+
+func (a byAddr) Len() int           { return len(a) }
+func (a byAddr) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byAddr) Less(i, j int) bool { return a[i].Addr < a[j].Addr }
+
 func parseFW(line string) ([]Address, error) {
 	if !strings.HasPrefix(line, ";FW: ") {
 		return nil, errors.New("Malformed forward line")
 	}
 
-	fws := strings.Split(line[5:], " ")
+	fws := strings.Fields(line[5:]) // Ignore repeated spaces
 	addrs := make([]Address, 0, len(fws))
 
-	for _, str := range strings.Split(line[5:], " ") {
+	for _, str := range fws {
 		str = strings.Split(str, "|")[0] // Strip password hashes (unsupported)
 		addrs = append(addrs, AddressFromString(str))
 	}
@@ -192,38 +722,119 @@ const (
 	sI          = "I"  // "Identify"? Palink-unix sends ";target de mycall QTC n" when remote has this
 	sBID        = "$"  // BID supported (must be last character in SID)
 
-	sGzip = "G" // Gzip compressed messages supported (GZIP_EXPERIMENT)
+	sGzip      = "G" // Gzip compressed messages supported (GZIP_EXPERIMENT)
+	sCompact   = "K" // Compact handshake supported (wl2k-go specific, see Session.SetCompactHandshake)
+	sKeepalive = "L" // Keepalive frames supported (wl2k-go specific, see Session.SetKeepalive)
 )
 
+// SIDCode is a feature code advertised in the SID.
+type SIDCode struct {
+	Code        string // The code as it appears in the SID (i.e. "B2").
+	Description string // Human readable description of the feature.
+}
+
+// SupportedSIDCodes returns the SID codes advertised by this package, in the order they appear in the SID.
+func SupportedSIDCodes() []SIDCode {
+	codes := []SIDCode{
+		{sFBComp2, "FBB compressed protocol v2 (B2F)"},
+		{sFBBasic, "FBB basic ascii protocol"},
+		{sHL, "Hierarchical Location designators"},
+		{sMID, "Message identifiers"},
+		{sBID, "BID"},
+	}
+
+	if gzipExperimentEnabled() {
+		// Inserted before BID, as done by writeSID
+		bid := codes[len(codes)-1]
+		codes = append(codes[:len(codes)-1], SIDCode{sGzip, "Gzip compressed messages (GZIP_EXPERIMENT)"}, bid)
+	}
+
+	return codes
+}
+
 func gzipExperimentEnabled() bool { return os.Getenv("GZIP_EXPERIMENT") == "1" }
 
-func writeSID(w io.Writer, appName, appVersion string) error {
-	sid := localSID
+// advertisedSID returns the SID codes we advertise. The compressed protocol is omitted when
+// forcing uncompressed transfers (see SetForceUncompressed).
+func (s *Session) advertisedSID() string {
+	if s.forceUncompressed {
+		return strings.Replace(localSID, sFBComp2, "", 1)
+	}
+	return localSID
+}
+
+// basicMode returns true if messages are transferred using the FBB basic protocol, either
+// because we force uncompressed transfers or because the remote does.
+func (s *Session) basicMode() bool {
+	return s.forceUncompressed || isBasicOnly(s.remoteSID)
+}
+
+// isBasicOnly returns true if the SID advertises the FBB basic protocol, but no compressed protocol.
+func isBasicOnly(code sid) bool {
+	return code.Has(sFBBasic) && !code.Has(sFBComp0)
+}
 
+// writeSID writes the SID header with the given codes. The extra codes are inserted before the BID code.
+func writeSID(w io.Writer, appName, appVersion, sid string, extra ...string) error {
 	if gzipExperimentEnabled() {
-		sid = sid[0:len(sid)-1] + sGzip + sid[len(sid)-1:]
+		extra = append([]string{sGzip}, extra...)
+	}
+	for _, code := range extra {
+		sid = sid[0:len(sid)-1] + code + sid[len(sid)-1:]
 	}
 
 	_, err := fmt.Fprintf(w, "[%s-%s-%s]\r", appName, appVersion, sid)
 	return err
 }
 
+func writeSecureLoginChallenge(w io.Writer, challenge string) error {
+	_, err := fmt.Fprintf(w, ";PQ: %s\r", challenge)
+	return err
+}
+
 func writeSecureLoginResponse(w io.Writer, response string) error {
 	_, err := fmt.Fprintf(w, ";PR: %s\r", response)
 	return err
 }
 
+// Matches the first SID header in a line. Anything following the closing bracket is ignored.
+var sidRe = regexp.MustCompile(`\[[^\[\]]*-([^\[\]-]*)\]`)
+
 func parseSID(str string) (sid, error) {
-	code := regexp.MustCompile(`\[.*-(.*)\]`).FindStringSubmatch(str)
+	code := sidRe.FindStringSubmatch(str)
 	if len(code) != 2 {
 		return sid(""), errors.New(`Bad SID line: ` + str)
 	}
+	if strings.TrimSpace(code[1]) == "" {
+		return sid(""), ErrNoSIDCodes
+	}
 
 	return sid(
 		strings.ToUpper(code[len(code)-1]),
 	), nil
 }
 
+// parseSIDApp returns the application name and version fields of the SID header.
+//
+// The fields are separated by dashes, i.e. [RMS Express-1.2.35.0-B2FHM$].
+func parseSIDApp(str string) (app, version string) {
+	start := strings.Index(str, "[")
+	if start < 0 {
+		return "", ""
+	}
+	end := strings.Index(str[start:], "]")
+	if end < 0 {
+		return "", ""
+	}
+	end += start
+
+	fields := strings.Split(str[start+1:end], "-")
+	if len(fields) < 2 {
+		return "", ""
+	}
+	return fields[0], strings.Join(fields[1:len(fields)-1], "-")
+}
+
 func (s sid) Has(code string) bool {
 	return strings.Contains(string(s), strings.ToUpper(code))
 }
@@ -5,10 +5,20 @@
 package fbb
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
 	"reflect"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 func TestParseFW(t *testing.T) {
@@ -42,3 +52,1248 @@ func TestIsLoginFailure(t *testing.T) {
 		}
 	}
 }
+
+func TestIsTransientLoginFailure(t *testing.T) {
+	tests := map[error]bool{
+		fmt.Errorf("[1] Secure login failed - account password does not match. - Disconnecting (88.90.2.192)"):  false,
+		fmt.Errorf("[1] Secure login failed - authentication service temporarily unavailable. - Disconnecting"): true,
+		fmt.Errorf("[1] Secure login failed - database timeout, try again later - Disconnecting"):               true,
+		fmt.Errorf("[1] Authentication service temporarily unavailable - Disconnecting"):                        false,
+		ErrSecureLoginFailed: false,
+		io.EOF:               false,
+		nil:                  false,
+	}
+
+	for err, expect := range tests {
+		if got := IsTransientLoginFailure(err); got != expect {
+			t.Errorf("'%v' - Expected %t got %t", err, expect, got)
+		}
+		if err != nil && IsTransientLoginFailure(err) && !IsLoginFailure(err) {
+			t.Errorf("'%v' - Transient login failure not reported by IsLoginFailure", err)
+		}
+	}
+}
+
+func TestParseSID(t *testing.T) {
+	tests := map[string]sid{
+		"[WL2K-2.8.4.8-B2FWIHJM$]":       "B2FWIHJM$",
+		"[RMS Express-1.2.35.0-b2fhm$]":  "B2FHM$",
+		"[App-Ver-B2]something":          "B2",
+		"[App-Ver-B2]-trailing]":         "B2",
+		"[App-Ver-B2] [Other-1.0-FHM$]":  "B2",
+		"prefix [App-Ver-B2FHM$] suffix": "B2FHM$",
+	}
+
+	for input, expected := range tests {
+		got, err := parseSID(input)
+		if err != nil {
+			t.Errorf("'%s': Unexpected error: %s", input, err)
+		} else if got != expected {
+			t.Errorf("'%s': Expected %q, got %q", input, expected, got)
+		}
+	}
+}
+
+func TestParseSIDApp(t *testing.T) {
+	tests := map[string][2]string{
+		"[WL2K-2.8.4.8-B2FWIHJM$]":      {"WL2K", "2.8.4.8"},
+		"[RMS Express-1.2.35.0-B2FHM$]": {"RMS Express", "1.2.35.0"},
+		"[FBB-FHM$]":                    {"FBB", ""},
+		"[B2FHM$]":                      {"", ""},
+		"[App-Ver-B2]something":         {"App", "Ver"},
+		"[App-Ver-B2]-trailing]":        {"App", "Ver"},
+	}
+
+	for input, expected := range tests {
+		app, version := parseSIDApp(input)
+		if app != expected[0] || version != expected[1] {
+			t.Errorf("'%s': Expected %q, got %q", input, expected, [2]string{app, version})
+		}
+	}
+}
+
+func TestAllowedApps(t *testing.T) {
+	tests := []struct {
+		allowed []string
+		expect  error
+	}{
+		{nil, nil},
+		{[]string{"WL2KGO"}, nil},
+		{[]string{"RMS Express", "wl2kgo"}, nil},
+		{[]string{"RMS Express"}, ErrAppNotAllowed},
+		{[]string{}, ErrAppNotAllowed},
+	}
+
+	for i, test := range tests {
+		client, master := tcpPipe(t)
+
+		go func() {
+			s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+			s.Exchange(client)
+		}()
+
+		s := NewSession("N0CALL", "LA5NTA", "JO39EQ", nil)
+		s.IsMaster(true)
+		s.SetAllowedApps(test.allowed)
+		if _, err := s.Exchange(master); err != test.expect {
+			t.Errorf("%d: Expected %v, got %v", i, test.expect, err)
+		}
+	}
+}
+
+func TestHandshakeRequireBID(t *testing.T) {
+	tests := []struct {
+		sid     string
+		require bool
+		expect  error
+	}{
+		{"[WL2K-5.0-B2FWIHJM$]", true, nil},
+		{"[WL2K-5.0-B2FWIHJM]", true, ErrBIDUnsupported},
+		{"[WL2K-5.0-B2FWIHJM]", false, nil},
+	}
+	for _, test := range tests {
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+		s.SetLogger(log.New(ioutil.Discard, "", 0))
+		s.SetRequireBID(test.require)
+		s.rd = bufio.NewReader(strings.NewReader(test.sid + "\rCMS >\r"))
+		err := s.handshake(struct {
+			io.Reader
+			io.Writer
+		}{s.rd, ioutil.Discard})
+		if err != test.expect {
+			t.Errorf("%s (require=%t): Expected %v, got %v", test.sid, test.require, test.expect, err)
+		}
+	}
+}
+
+func TestRawRemoteSID(t *testing.T) {
+	const raw = "[RMS Express-1.5.0-b2fWiHm$]"
+
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+	s.SetLogger(log.New(ioutil.Discard, "", 0))
+	s.rd = bufio.NewReader(strings.NewReader(raw + "\rCMS >\r"))
+	err := s.handshake(struct {
+		io.Reader
+		io.Writer
+	}{s.rd, ioutil.Discard})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if got := s.RemoteSID(); got != "B2FWIHM$" {
+		t.Errorf("Expected normalized SID %q, got %q", "B2FWIHM$", got)
+	}
+	if got := s.RawRemoteSID(); got != raw {
+		t.Errorf("Expected raw SID %q, got %q", raw, got)
+	}
+}
+
+func TestHandshakeWithoutSecureLogin(t *testing.T) {
+	const gateway = "Welcome to the basic login gateway\r[JNOS-2.0-B2FHIM$]\r;FW: N0CALL\rN0CALL BBS >\r"
+
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+	s.SetLogger(log.New(ioutil.Discard, "", 0))
+	s.AddAuxiliaryAddress(Address{Addr: "LA1B"})
+
+	var sent bytes.Buffer
+	s.rd = bufio.NewReader(strings.NewReader(gateway))
+	err := s.handshake(struct {
+		io.Reader
+		io.Writer
+	}{s.rd, &sent})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// No password hashes or secure login response without a challenge
+	if !strings.HasPrefix(sent.String(), ";FW: LA5NTA LA1B\r") {
+		t.Errorf("Unexpected FW line in %q", sent.String())
+	}
+	if strings.Contains(sent.String(), ";PR") {
+		t.Errorf("Unexpected secure login response in %q", sent.String())
+	}
+
+	// A challenge still requires a handler
+	s = NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+	s.SetLogger(log.New(ioutil.Discard, "", 0))
+	s.rd = bufio.NewReader(strings.NewReader("[WL2K-5.0-B2FWIHJM$]\r;PQ: 12345678\rCMS >\r"))
+	err = s.handshake(struct {
+		io.Reader
+		io.Writer
+	}{s.rd, ioutil.Discard})
+	if err == nil {
+		t.Errorf("Expected error on secure login challenge without a handler")
+	}
+}
+
+func TestRawRemoteSIDLine(t *testing.T) {
+	tests := []string{
+		"[RMS Express-1.5.0-b2fWiHm$]",
+		"  [WL2K-2.8.4.8-B2FWIHJM$] \x00",
+		"Hello [JNOS-2.0-B2FHIM$] world",
+	}
+	for _, raw := range tests {
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+		s.SetLogger(log.New(ioutil.Discard, "", 0))
+		s.rd = bufio.NewReader(strings.NewReader("Welcome\r" + raw + "\r;FW: N0CALL\rCMS >\r"))
+		err := s.handshake(struct {
+			io.Reader
+			io.Writer
+		}{s.rd, ioutil.Discard})
+		if err != nil {
+			t.Fatalf("%q: Unexpected error: %s", raw, err)
+		}
+		if got := s.RawRemoteSIDLine(); got != raw {
+			t.Errorf("Expected raw SID line %q, got %q", raw, got)
+		}
+	}
+}
+
+func TestReadHandshakeUnknownLineFunc(t *testing.T) {
+	const handshake = "Welcome to Test CMS\r" +
+		"Max message size: 1000 bytes\r" +
+		"[WL2K-2.8.4.8-B2FWIHJM$]\r" +
+		";FW: LA5NTA\r" +
+		";FOO: bar\r" +
+		";PQ: 12345678\r" +
+		"CMS >\r"
+
+	errUnknown := errors.New("unknown line")
+	for _, fail := range []bool{false, true} {
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+		s.SetLogger(log.New(ioutil.Discard, "", 0))
+		s.rd = bufio.NewReader(strings.NewReader(handshake))
+
+		var got []string
+		s.SetUnknownLineFunc(func(line string) error {
+			got = append(got, line)
+			if fail {
+				return errUnknown
+			}
+			return nil
+		})
+
+		_, err := s.readHandshake()
+		switch {
+		case fail && err != errUnknown:
+			t.Errorf("Expected the handshake to fail with the func's error, got %v", err)
+		case fail && !reflect.DeepEqual(got, []string{"Welcome to Test CMS"}):
+			t.Errorf("Expected the handshake to fail on the first unknown line, got %q", got)
+		case !fail && err != nil:
+			t.Errorf("Unexpected error: %s", err)
+		case !fail && !reflect.DeepEqual(got, []string{"Welcome to Test CMS", ";FOO: bar"}):
+			t.Errorf("Unexpected unknown lines: %q", got)
+		}
+	}
+}
+
+// chunkReader returns the data of r in chunks of the given sizes (repeated), like frames of a packet transport.
+type chunkReader struct {
+	r     io.Reader
+	sizes []int
+	i     int
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	n := c.sizes[c.i%len(c.sizes)]
+	c.i++
+	if n < len(p) {
+		p = p[:n]
+	}
+	return c.r.Read(p)
+}
+
+func TestReadHandshakeFramed(t *testing.T) {
+	const handshake = "Welcome\r\n" +
+		"Max message size: 1000 bytes\r" +
+		"[WL2K-2.8.4.8-B2FWIHJM$]\r" +
+		";FW: LA5NTA LE1OF\r" +
+		";PQ: 12345678\r" +
+		"CMS >\r" +
+		"FF\r"
+
+	readers := map[string]func() io.Reader{
+		"one byte":    func() io.Reader { return iotest.OneByteReader(strings.NewReader(handshake)) },
+		"half frames": func() io.Reader { return iotest.HalfReader(strings.NewReader(handshake)) },
+		"odd frames":  func() io.Reader { return &chunkReader{r: strings.NewReader(handshake), sizes: []int{3, 1, 7, 13, 2}} },
+		"big frames":  func() io.Reader { return &chunkReader{r: strings.NewReader(handshake), sizes: []int{40}} },
+	}
+
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+	s.SetLogger(log.New(ioutil.Discard, "", 0))
+	s.rd = bufio.NewReader(strings.NewReader(handshake))
+	expected, err := s.readHandshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, newReader := range readers {
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+		s.SetLogger(log.New(ioutil.Discard, "", 0))
+		s.rd = bufio.NewReader(newReader())
+
+		got, err := s.readHandshake()
+		if err != nil {
+			t.Errorf("%s: Unexpected error: %s", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: Unexpected handshake.\nGot:      %+v\nExpected: %+v", name, got, expected)
+		}
+		if line, _ := s.rd.ReadString('\r'); line != "FF\r" {
+			t.Errorf("%s: Expected the handshake to end before FF, next line was %q", name, line)
+		}
+	}
+}
+
+// frameConn is a net.Conn reading at most n bytes at a time.
+type frameConn struct {
+	net.Conn
+	n int
+}
+
+func (c frameConn) Read(p []byte) (int, error) {
+	if len(p) > c.n {
+		p = p[:c.n]
+	}
+	return c.Conn.Read(p)
+}
+
+func TestSessionFramedTransport(t *testing.T) {
+	for _, n := range []int{1, 7} {
+		client, master := tcpPipe(t)
+
+		msg := newTestMessage("LA5NTA", "N0CALL", 1000)
+		cs := NewSession("LA5NTA", "N0CALL", "JO39EQ", newMemMBox(msg))
+		cs.SetLogger(log.New(ioutil.Discard, "", 0))
+		mbox := newMemMBox()
+		ms := NewSession("N0CALL", "LA5NTA", "JO39EQ", mbox)
+		ms.SetLogger(log.New(ioutil.Discard, "", 0))
+
+		if _, _, cErr, mErr := exchangeConns(cs, ms, frameConn{client, n}, frameConn{master, n}); cErr != nil || mErr != nil {
+			t.Fatalf("n=%d: Exchange failed: %v, %v", n, cErr, mErr)
+		}
+		if inbox := mbox.inbox(); len(inbox) != 1 || inbox[0].MID() != msg.MID() {
+			t.Errorf("n=%d: Message not received", n)
+		}
+	}
+}
+
+func TestMasterReadsClientSID(t *testing.T) {
+	tests := []struct {
+		handshake string
+		gzip      bool // Enable GZIP_EXPERIMENT
+		expect    Capabilities
+		err       error
+	}{
+		{ // B1-only client
+			handshake: "[FBB-7.00-B1FHM$]\r; N0CALL DE LA5NTA (JO39EQ)>\r",
+			err:       ErrNoFB2,
+		},
+		{ // Gzip-capable client
+			handshake: "[RMS Express-1.5.0-B2FGHM$]\r;FW: LA5NTA\r; N0CALL DE LA5NTA (JO39EQ)>\r",
+			expect: Capabilities{
+				RemoteUA:  UserAgent{Name: "RMS Express", Version: "1.5.0"},
+				RemoteSID: "B2FGHM$",
+				RemoteFW:  []Address{AddressFromString("LA5NTA")},
+			},
+		},
+		{ // Gzip-capable client, with gzip enabled locally
+			handshake: "[RMS Express-1.5.0-B2FGHM$]\r;FW: LA5NTA\r; N0CALL DE LA5NTA (JO39EQ)>\r",
+			gzip:      true,
+			expect: Capabilities{
+				RemoteUA:  UserAgent{Name: "RMS Express", Version: "1.5.0"},
+				RemoteSID: "B2FGHM$",
+				RemoteFW:  []Address{AddressFromString("LA5NTA")},
+				Gzip:      true,
+			},
+		},
+	}
+	defer os.Unsetenv("GZIP_EXPERIMENT")
+	for i, test := range tests {
+		if test.gzip {
+			os.Setenv("GZIP_EXPERIMENT", "1")
+		} else {
+			os.Unsetenv("GZIP_EXPERIMENT")
+		}
+
+		client, master := tcpPipe(t)
+		fmt.Fprint(client, test.handshake)
+
+		s := NewSession("N0CALL", "LA5NTA", "JO39EQ", nil)
+		s.SetLogger(log.New(ioutil.Discard, "", 0))
+		s.IsMaster(true)
+
+		caps, err := s.Handshake(master)
+		switch {
+		case test.err != nil:
+			if !errors.Is(err, test.err) {
+				t.Errorf("%d: Expected %v, got %v", i, test.err, err)
+			}
+		case err != nil:
+			t.Errorf("%d: Unexpected error: %s", i, err)
+		case !reflect.DeepEqual(caps, test.expect):
+			t.Errorf("%d: Unexpected capabilities.\nGot:      %+v\nExpected: %+v", i, caps, test.expect)
+		case s.RemoteSID() != test.expect.RemoteSID || s.RemoteUserAgent() != test.expect.RemoteUA:
+			t.Errorf("%d: Unexpected remote SID %q and user agent %+v", i, s.RemoteSID(), s.RemoteUserAgent())
+		}
+		s.Close()
+		client.Close()
+	}
+}
+
+func TestParseMaxSizeHint(t *testing.T) {
+	tests := map[string]int{
+		"Max message size: 120000 bytes":   120000,
+		"Max message size is 120000 bytes": 120000,
+		"MAXIMUM MSG SIZE 120KB":           120 * 1024,
+		"Max msg size: 120 kbytes":         120 * 1024,
+		"Max message size: 120 k":          120 * 1024,
+		"Max message size is 2 MB":         2 * 1024 * 1024,
+		"Max message size: 120000":         120000,
+		";maxsize=5000":                    5000,
+		"Max message size: 120 blocks":     0,
+		"Max message size: 2 GB":           0,
+		"Brentwood CMS >":                  0,
+		"Max size: 0":                      0,
+	}
+
+	for input, expected := range tests {
+		got, ok := parseMaxSizeHint(input)
+		if ok != (expected > 0) || got != expected {
+			t.Errorf("'%s': Expected %d, got %d (ok=%t)", input, expected, got, ok)
+		}
+	}
+}
+
+func TestParseTimeoutHint(t *testing.T) {
+	tests := map[string]time.Duration{
+		"Timeout: 120 seconds":       120 * time.Second,
+		"Command timeout is 2 min":   2 * time.Minute,
+		"Session time out after 45s": 45 * time.Second,
+		"timeout 5 minutes":          5 * time.Minute,
+		"Brentwood CMS >":            0,
+		"Timeout: 0":                 0,
+	}
+
+	for input, expected := range tests {
+		got, ok := parseTimeoutHint(input)
+		if ok != (expected > 0) || got != expected {
+			t.Errorf("'%s': Expected %s, got %s (ok=%t)", input, expected, got, ok)
+		}
+	}
+}
+
+func TestHandshakeRemoteSuggestedTimeout(t *testing.T) {
+	const handshake = "Welcome\rTimeout: 120 seconds\r[WL2K-5.0-B2FWIHJM$]\rCMS >\r"
+
+	tests := []struct {
+		explicit       time.Duration
+		set            bool
+		expectTurnover time.Duration
+	}{
+		{0, false, 120 * time.Second},
+		{30 * time.Second, true, 30 * time.Second},
+		{0, true, 0}, // Explicitly no limit
+	}
+	for _, test := range tests {
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+		s.SetLogger(log.New(ioutil.Discard, "", 0))
+		if test.set {
+			s.SetTurnoverTimeout(test.explicit)
+		}
+		s.rd = bufio.NewReader(strings.NewReader(handshake))
+		err := s.handshake(struct {
+			io.Reader
+			io.Writer
+		}{s.rd, ioutil.Discard})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if got := s.RemoteSuggestedTimeout(); got != 120*time.Second {
+			t.Errorf("Expected suggested timeout 2m0s, got %s", got)
+		}
+		if s.turnoverTimeout != test.expectTurnover {
+			t.Errorf("explicit=%s (set=%t): Expected turnover timeout %s, got %s", test.explicit, test.set, test.expectTurnover, s.turnoverTimeout)
+		}
+	}
+}
+
+func TestParseTimeHint(t *testing.T) {
+	tests := map[string]time.Time{
+		"Gateway time: 2016-03-28 12:43:05 UTC": time.Date(2016, 3, 28, 12, 43, 5, 0, time.UTC),
+		"LA1B 2016/03/28 12:43Z":                time.Date(2016, 3, 28, 12, 43, 0, 0, time.UTC),
+		"Connected 2016.03.28 12:43":            time.Date(2016, 3, 28, 12, 43, 0, 0, time.UTC),
+		"Brentwood CMS >":                       {},
+		"Timeout: 120 seconds":                  {},
+		"Bad date 2016-13-45 12:43 UTC":         {},
+	}
+
+	for input, expected := range tests {
+		got, ok := parseTimeHint(input)
+		if ok != !expected.IsZero() || !got.Equal(expected) {
+			t.Errorf("'%s': Expected %s, got %s (ok=%t)", input, expected, got, ok)
+		}
+	}
+}
+
+func TestHandshakeRemoteTime(t *testing.T) {
+	remote := time.Date(2016, 3, 28, 12, 43, 0, 0, time.UTC)
+	tests := []struct {
+		handshake string
+		local     time.Time
+		skew      time.Duration
+		warning   bool
+	}{
+		{"[WL2K-5.0-B2FWIHJM$]\rCMS >\r", remote, 0, false},
+		{"Time: 2016-03-28 12:43 UTC\r[WL2K-5.0-B2FWIHJM$]\rCMS >\r", remote.Add(time.Minute), time.Minute, false},
+		{"Time: 2016-03-28 12:43 UTC\r[WL2K-5.0-B2FWIHJM$]\rCMS >\r", remote.Add(-time.Hour), -time.Hour, true},
+	}
+	for i, test := range tests {
+		var logged bytes.Buffer
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+		s.SetLogger(log.New(&logged, "", 0))
+		s.SetClockSource(func() time.Time { return test.local })
+		s.rd = bufio.NewReader(strings.NewReader(test.handshake))
+		err := s.handshake(struct {
+			io.Reader
+			io.Writer
+		}{s.rd, ioutil.Discard})
+		if err != nil {
+			t.Fatalf("%d: Unexpected error: %s", i, err)
+		}
+
+		expectTime := remote
+		if !strings.HasPrefix(test.handshake, "Time:") {
+			expectTime = time.Time{}
+		}
+		if got := s.RemoteTime(); !got.Equal(expectTime) {
+			t.Errorf("%d: Expected remote time %s, got %s", i, expectTime, got)
+		}
+		if got := s.ClockSkew(); got != test.skew {
+			t.Errorf("%d: Expected skew %s, got %s", i, test.skew, got)
+		}
+		if got := strings.Contains(logged.String(), "clock"); got != test.warning {
+			t.Errorf("%d: Expected warning=%t, got log %q", i, test.warning, logged.String())
+		}
+	}
+}
+
+// errorInjectingReader reads from r, but fails with err when offset n is reached.
+type errorInjectingReader struct {
+	r   io.Reader
+	n   int
+	err error
+}
+
+func (e *errorInjectingReader) Read(p []byte) (int, error) {
+	if e.n <= 0 {
+		return 0, e.err
+	}
+	if len(p) > e.n {
+		p = p[:e.n]
+	}
+	n, err := e.r.Read(p)
+	e.n -= n
+	return n, err
+}
+
+func TestReadHandshakeErrorPhase(t *testing.T) {
+	const handshake = "Welcome\r[WL2K-5.0-B2FWIHJM$]\r;FW: LA5NTA N0CALL\r;PQ: 12345678\rCMS >\r"
+	errInjected := errors.New("injected error")
+
+	tests := []struct {
+		offset int
+		phase  string
+	}{
+		{strings.Index(handshake, "come"), "banner (before SID)"},
+		{strings.Index(handshake, "WL2K"), "SID"},
+		{strings.Index(handshake, ";FW"), "banner (after SID)"},
+		{strings.Index(handshake, "N0CALL"), "FW line"},
+		{strings.Index(handshake, "5678"), "secure login challenge"},
+	}
+
+	for _, test := range tests {
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+		s.SetLogger(log.New(ioutil.Discard, "", 0))
+		s.rd = bufio.NewReader(&errorInjectingReader{strings.NewReader(handshake), test.offset, errInjected})
+
+		_, err := s.readHandshake()
+		hErr, ok := err.(*HandshakeError)
+		switch {
+		case !ok:
+			t.Errorf("Offset %d: Expected HandshakeError, got %v", test.offset, err)
+		case hErr.Phase != test.phase:
+			t.Errorf("Offset %d: Expected phase %q, got %q", test.offset, test.phase, hErr.Phase)
+		case !errors.Is(err, errInjected):
+			t.Errorf("Offset %d: Expected the injected error to be wrapped, got %v", test.offset, hErr.Err)
+		}
+	}
+
+	// EOF (remote hang up) should not be wrapped
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+	s.SetLogger(log.New(ioutil.Discard, "", 0))
+	s.rd = bufio.NewReader(&errorInjectingReader{strings.NewReader(handshake), 10, io.EOF})
+	if _, err := s.readHandshake(); err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+}
+
+func TestReadHandshakeNoFB2(t *testing.T) {
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+	s.SetLogger(log.New(ioutil.Discard, "", 0))
+	s.rd = bufio.NewReader(strings.NewReader("[FBB-7.00-B1FHM$]\rFBB >\r"))
+
+	_, err := s.readHandshake()
+	if !errors.Is(err, ErrNoFB2) {
+		t.Fatalf("Expected ErrNoFB2, got %v", err)
+	}
+	if e, ok := err.(*NoFB2Error); !ok || e.SID != "B1FHM$" {
+		t.Errorf("Expected NoFB2Error with SID B1FHM$, got %#v", err)
+	}
+	if !strings.Contains(err.Error(), "B1FHM$") {
+		t.Errorf("Expected error message to include the remote SID, got '%s'", err)
+	}
+}
+
+func TestConnectSettleDelay(t *testing.T) {
+	for _, delay := range []time.Duration{0, 2 * time.Second} {
+		clock := newFakeClock()
+
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+		s.SetLogger(log.New(ioutil.Discard, "", 0))
+		s.SetConnectSettleDelay(delay)
+		s.clock = clock
+
+		// The handshake should not be read before the delay has passed
+		s.rd = bufio.NewReader(readFunc(func(p []byte) (int, error) {
+			if len(clock.Sleeps()) == 0 && delay > 0 {
+				t.Errorf("Handshake read before settle delay")
+			}
+			return 0, io.EOF
+		}))
+		s.handshake(struct {
+			io.Reader
+			io.Writer
+		}{s.rd, ioutil.Discard})
+
+		if delay == 0 && len(clock.Sleeps()) > 0 {
+			t.Errorf("Unexpected delay: %v", clock.Sleeps())
+		} else if delay > 0 && !reflect.DeepEqual(clock.Sleeps(), []time.Duration{delay}) {
+			t.Errorf("Expected delay of %s, got %v", delay, clock.Sleeps())
+		}
+	}
+}
+
+func TestHandshakeRTT(t *testing.T) {
+	const rtt = 850 * time.Millisecond
+	for _, master := range []bool{true, false} {
+		clock := newFakeClock()
+
+		s := NewSession("N0CALL", "LA5NTA", "JO39EQ", nil)
+		s.SetLogger(log.New(ioutil.Discard, "", 0))
+		s.IsMaster(master)
+		s.clock = clock
+
+		// The remote responds rtt after our handshake
+		remote := strings.NewReader("[WL2K-3.2.11.2-B2FWIHJM$]\r; LA5NTA DE N0CALL (JO39EQ)>\r")
+		s.rd = bufio.NewReader(readFunc(func(p []byte) (int, error) {
+			if remote.Len() > 0 && remote.Len() == int(remote.Size()) {
+				clock.Advance(rtt)
+			}
+			return remote.Read(p)
+		}))
+		err := s.handshake(struct {
+			io.Reader
+			io.Writer
+		}{s.rd, ioutil.Discard})
+		if err != nil {
+			t.Fatalf("master=%t: Unexpected error: %s", master, err)
+		}
+
+		switch got := s.trafficStats.HandshakeRTT; {
+		case master && got != rtt:
+			t.Errorf("Expected RTT %s, got %s", rtt, got)
+		case !master && got != 0:
+			t.Errorf("Expected no RTT measurement for client, got %s", got)
+		}
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	// The remote never completes its handshake
+	client, srv := tcpPipe(t)
+	defer srv.Close()
+	fmt.Fprint(srv, "[WL2K-2.8.4.8-B2FWIHJM$]\r")
+
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+	s.SetLogger(log.New(ioutil.Discard, "", 0))
+	s.SetHandshakeTimeout(100 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := s.Exchange(client); err != ErrHandshakeTimeout {
+		t.Errorf("Expected ErrHandshakeTimeout, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Handshake timeout took %s", d)
+	}
+
+	// The settle delay counts towards the timeout
+	clock := newFakeClock()
+	s = NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+	s.SetLogger(log.New(ioutil.Discard, "", 0))
+	s.SetConnectSettleDelay(2 * time.Second)
+	s.SetHandshakeTimeout(time.Second)
+	s.clock = clock
+	s.rd = bufio.NewReader(readFunc(func(p []byte) (int, error) {
+		t.Errorf("Handshake read after the timeout was exceeded")
+		return 0, io.EOF
+	}))
+	err := s.handshake(struct {
+		io.Reader
+		io.Writer
+	}{s.rd, ioutil.Discard})
+	if err != ErrHandshakeTimeout {
+		t.Errorf("Expected ErrHandshakeTimeout after settle delay, got %v", err)
+	}
+}
+
+func TestParseFooter(t *testing.T) {
+	tests := map[string]*Footer{
+		"; LA5NTA DE N0CALL (JO39EQ)>":  {"LA5NTA", "N0CALL", "JO39EQ"},
+		"; LA5NTA DE N0CALL (JO39EQ)":   {"LA5NTA", "N0CALL", "JO39EQ"},
+		";LA5NTA DE N0CALL>":            {"LA5NTA", "N0CALL", ""},
+		"; la5nta DE n0call ()":         {"la5nta", "n0call", ""},
+		"; WL2K DE LA5NTA-10 (JP20QH)>": {"WL2K", "LA5NTA-10", "JP20QH"},
+		";FW: LA5NTA":                   nil,
+		"; Hello there":                 nil,
+		"CMS >":                         nil,
+	}
+	for line, expect := range tests {
+		got, ok := parseFooter(line)
+		switch {
+		case expect == nil && ok:
+			t.Errorf("%q: Unexpected footer %+v", line, got)
+		case expect != nil && (!ok || got != *expect):
+			t.Errorf("%q: Expected %+v, got %+v (ok=%t)", line, *expect, got, ok)
+		}
+	}
+}
+
+func TestHandshakeFooterAddressing(t *testing.T) {
+	tests := map[string]bool{
+		"; LA5NTA DE N0CALL (JO39EQ)>": false,
+		"; la5nta DE N0CALL (JO39EQ)>": false,
+		"; LA1B DE N0CALL (JO39EQ)>":   true,
+	}
+	for footer, misaddressed := range tests {
+		var logged bytes.Buffer
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+		s.SetLogger(log.New(&logged, "", 0))
+		s.rd = bufio.NewReader(strings.NewReader("[WL2K-2.8.4.8-B2FWIHJM$]\r" + footer + "\r"))
+		err := s.handshake(struct {
+			io.Reader
+			io.Writer
+		}{s.rd, ioutil.Discard})
+		if err != nil {
+			t.Fatalf("%q: Unexpected error: %s", footer, err)
+		}
+
+		f, ok := s.RemoteFooter()
+		if expect, _ := parseFooter(footer); !ok || f != expect {
+			t.Errorf("%q: Unexpected remote footer %+v (ok=%t)", footer, f, ok)
+		}
+		if s.trafficStats.Misaddressed != misaddressed {
+			t.Errorf("%q: Expected misaddressed %t", footer, misaddressed)
+		}
+		if warned := strings.Contains(logged.String(), "Warning: The remote addressed"); warned != misaddressed {
+			t.Errorf("%q: Expected warning to be logged: %t, log: %q", footer, misaddressed, logged.String())
+		}
+	}
+
+	// No footer
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+	s.SetLogger(log.New(ioutil.Discard, "", 0))
+	s.rd = bufio.NewReader(strings.NewReader("[WL2K-2.8.4.8-B2FWIHJM$]\rCMS >\r"))
+	s.handshake(struct {
+		io.Reader
+		io.Writer
+	}{s.rd, ioutil.Discard})
+	if _, ok := s.RemoteFooter(); ok || s.trafficStats.Misaddressed {
+		t.Errorf("Expected no footer")
+	}
+}
+
+type readFunc func(p []byte) (int, error)
+
+func (f readFunc) Read(p []byte) (int, error) { return f(p) }
+
+func TestSupportedSIDCodes(t *testing.T) {
+	var str string
+	for _, c := range SupportedSIDCodes() {
+		if c.Description == "" {
+			t.Errorf("Missing description for %q", c.Code)
+		}
+		str += c.Code
+	}
+	if str != localSID {
+		t.Errorf("Expected codes to match %q, got %q", localSID, str)
+	}
+}
+
+func TestReadHandshakeSecureChallengeLength(t *testing.T) {
+	tests := map[string]error{
+		";PQ: 23753528":                      nil,
+		";PQ: " + strings.Repeat("1", 64):    nil,
+		";PQ: " + strings.Repeat("1", 65):    ErrSecureChallengeTooLong,
+		";PQ: " + strings.Repeat("1", 10000): ErrSecureChallengeTooLong,
+		";PQ":                                nil,
+	}
+	for line, expected := range tests {
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+		s.SetLogger(log.New(ioutil.Discard, "", 0))
+		s.rd = bufio.NewReader(strings.NewReader("[WL2K-2.8.4.8-B2FWIHJM$]\r" + line + "\rCMS >\r"))
+
+		hs, err := s.readHandshake()
+		if err != expected {
+			t.Errorf("%.20q: Expected error %v, got %v", line, expected, err)
+		} else if err != nil && hs.SecureChallenge != "" {
+			t.Errorf("%.20q: Expected the challenge to be discarded", line)
+		}
+	}
+}
+
+func TestReadHandshakeSecureResponse(t *testing.T) {
+	tests := map[string]string{
+		";PR: 72768415":  "72768415",
+		";PR:  72768415": "72768415",
+		";PR:":           "",
+		";PR":            "",
+	}
+	for line, expected := range tests {
+		s := NewSession("N0CALL", "LA5NTA", "JO39EQ", nil)
+		s.SetLogger(log.New(ioutil.Discard, "", 0))
+		s.IsMaster(true)
+		s.rd = bufio.NewReader(strings.NewReader("[WL2K-2.8.4.8-B2FWIHJM$]\r" + line + "\rFF\r"))
+
+		hs, err := s.readHandshake()
+		if err != nil {
+			t.Errorf("%q: Unexpected error: %s", line, err)
+		} else if hs.SecureResponse != expected {
+			t.Errorf("%q: Expected response %q, got %q", line, expected, hs.SecureResponse)
+		}
+	}
+}
+
+func TestReadHandshakeMultipleFW(t *testing.T) {
+	s := NewSession("N0CALL", "LA5NTA", "JO39EQ", nil)
+	s.SetLogger(log.New(ioutil.Discard, "", 0))
+	s.rd = bufio.NewReader(strings.NewReader("[WL2K-2.8.4.8-B2FWIHJM$]\r;FW: LA5NTA LE1OF\r;FW: LA3F\rCMS >\r"))
+
+	hs, err := s.readHandshake()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := []Address{AddressFromString("LA5NTA"), AddressFromString("LE1OF"), AddressFromString("LA3F")}
+	if !reflect.DeepEqual(hs.FW, expected) {
+		t.Errorf("Expected FW %v, got %v", expected, hs.FW)
+	}
+}
+
+func TestReadHandshakePaddedLines(t *testing.T) {
+	s := NewSession("N0CALL", "LA5NTA", "JO39EQ", nil)
+	s.SetLogger(log.New(ioutil.Discard, "", 0))
+	s.rd = bufio.NewReader(strings.NewReader("[WL2K-2.8.4.8-B2FWIHJM$]  \r;FW: LA5NTA  LE1OF \rCMS > \rFF\r"))
+
+	hs, err := s.readHandshake()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if hs.SID != "B2FWIHJM$" || hs.App != "WL2K" || hs.Version != "2.8.4.8" {
+		t.Errorf("Unexpected SID: %+v", hs)
+	}
+	expected := []Address{AddressFromString("LA5NTA"), AddressFromString("LE1OF")}
+	if !reflect.DeepEqual(hs.FW, expected) {
+		t.Errorf("Expected FW %v, got %v", expected, hs.FW)
+	}
+	if line, _ := s.rd.ReadString('\r'); line != "FF\r" {
+		t.Errorf("Expected the padded prompt to end the handshake, next line was %q", line)
+	}
+}
+
+func TestReadHandshakeLowercaseCommand(t *testing.T) {
+	s := NewSession("N0CALL", "LA5NTA", "JO39EQ", nil)
+	s.SetLogger(log.New(ioutil.Discard, "", 0))
+	s.rd = bufio.NewReader(strings.NewReader("[WL2K-2.8.4.8-B2FWIHJM$]\rfine weather today\rfc EM TJKYEIMMHSRB 527 123 0\r"))
+
+	hs, err := s.readHandshake()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if hs.SID != "B2FWIHJM$" {
+		t.Errorf("Unexpected SID: %q", hs.SID)
+	}
+	if line, _ := s.rd.ReadString('\r'); line != "fc EM TJKYEIMMHSRB 527 123 0\r" {
+		t.Errorf("Expected the handshake to end at the lowercase command, next line was %q", line)
+	}
+}
+
+func TestMaxHandshakeAttempts(t *testing.T) {
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+	s.SetLogger(log.New(ioutil.Discard, "", 0))
+	s.SetMaxHandshakeAttempts(2)
+
+	for i := 1; i <= 3; i++ {
+		client, srv := net.Pipe()
+		srv.Close() // Remote hangs up before the handshake
+
+		_, err := s.Exchange(client)
+		switch {
+		case i <= 2 && err != io.ErrUnexpectedEOF:
+			t.Errorf("Attempt %d: Expected io.ErrUnexpectedEOF, got %v", i, err)
+		case i > 2 && err != ErrTooManyAttempts:
+			t.Errorf("Attempt %d: Expected ErrTooManyAttempts, got %v", i, err)
+		}
+	}
+
+	if n := s.HandshakeAttempts(); n != 2 {
+		t.Errorf("Expected 2 handshake attempts, got %d", n)
+	}
+}
+
+func TestReadHandshakeNoSIDCodes(t *testing.T) {
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+	s.SetLogger(log.New(ioutil.Discard, "", 0))
+	s.rd = bufio.NewReader(strings.NewReader("[FBB-7.00-]\rFBB >\r"))
+
+	if _, err := s.readHandshake(); err != ErrNoSIDCodes {
+		t.Errorf("Expected ErrNoSIDCodes, got %v", err)
+	}
+}
+
+type writeFunc func(p []byte) (int, error)
+
+func (f writeFunc) Write(p []byte) (int, error) { return f(p) }
+
+func TestHandshakeRemoteDroppedDuringAuth(t *testing.T) {
+	errWrite := errors.New("broken pipe")
+	for _, challenge := range []bool{true, false} {
+		handshake := "[WL2K-2.8.4.8-B2FWIHJM$]\r"
+		if challenge {
+			handshake += ";PQ: 23753528\r"
+		}
+		handshake += "CMS >\r"
+
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+		s.SetLogger(log.New(ioutil.Discard, "", 0))
+		s.SetSecureLoginHandleFunc(func() (string, error) { return "foobar", nil })
+		s.rd = bufio.NewReader(strings.NewReader(handshake))
+
+		err := s.handshake(struct {
+			io.Reader
+			io.Writer
+		}{s.rd, writeFunc(func(p []byte) (int, error) { return 0, errWrite })})
+
+		switch {
+		case !errors.Is(err, errWrite):
+			t.Errorf("challenge=%t: Expected the write error to be wrapped, got %v", challenge, err)
+		case challenge != errors.Is(err, ErrRemoteDroppedDuringAuth):
+			t.Errorf("challenge=%t: Unexpected error: %v", challenge, err)
+		}
+	}
+}
+
+func TestSendHandshakeNormalizeCallsigns(t *testing.T) {
+	tests := []struct {
+		normalize  bool
+		fw, footer string
+	}{
+		{true, ";FW: LA5NTA LE1OF\r", "; N0CALL DE LA5NTA (JO39EQ)"},
+		{false, ";FW: la5nta le1of\r", "; n0call DE la5nta (JO39EQ)"},
+	}
+	for _, test := range tests {
+		s := NewSession("la5nta", "n0call", "JO39EQ", nil)
+		s.AddAuxiliaryAddress(Address{Addr: "le1of"})
+		s.SetNormalizeCallsigns(test.normalize)
+
+		var buf bytes.Buffer
+		if err := s.sendHandshake(&buf, ""); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if !strings.HasPrefix(buf.String(), test.fw) {
+			t.Errorf("normalize=%t: Expected FW line %q, got %q", test.normalize, test.fw, buf.String())
+		}
+		if !strings.HasSuffix(buf.String(), test.footer+"\r") {
+			t.Errorf("normalize=%t: Expected footer %q, got %q", test.normalize, test.footer, buf.String())
+		}
+	}
+}
+
+func TestSendHandshakeFWSort(t *testing.T) {
+	aux := []Address{{Addr: "LE1OF"}, {Addr: "la3f"}, {Addr: "LA1B"}, {Addr: "N0CALL"}}
+	tests := []struct {
+		sort      bool
+		direction ExchangeDirection
+		fw        string
+	}{
+		{false, Both, ";FW: LA5NTA LE1OF LA3F LA1B N0CALL\r"},
+		{true, Both, ";FW: LA5NTA LA1B LA3F LE1OF N0CALL\r"},
+		{true, Send, ";FW: LA5NTA\r"},
+	}
+	for _, test := range tests {
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+		s.AddAuxiliaryAddress(aux...)
+		s.SetFWSort(test.sort)
+		s.SetDirection(test.direction)
+
+		var buf bytes.Buffer
+		if err := s.sendHandshake(&buf, ""); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if !strings.HasPrefix(buf.String(), test.fw) {
+			t.Errorf("sort=%t: Expected FW line %q, got %q", test.sort, test.fw, buf.String())
+		}
+	}
+
+	// Sorting must not affect the order of the auxiliary addresses
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+	s.AddAuxiliaryAddress(aux...)
+	s.SetFWSort(true)
+	s.sendHandshake(ioutil.Discard, "")
+	if s.localFW[1].Addr != "LE1OF" {
+		t.Errorf("Sorting modified the auxiliary addresses: %v", s.localFW)
+	}
+}
+
+func TestCompactHandshake(t *testing.T) {
+	tests := []struct{ client, master, expectCompact bool }{
+		{false, false, false},
+		{true, false, false},
+		{false, true, false},
+		{true, true, true},
+	}
+	var sent [2]int // Bytes written by the client (standard, compact)
+	for _, test := range tests {
+		client, master := tcpPipe(t)
+
+		var written bytes.Buffer
+		cs := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+		cs.SetLogger(log.New(ioutil.Discard, "", 0))
+		cs.SetCompactHandshake(test.client)
+		ms := NewSession("N0CALL", "LA5NTA", "JO39EQ", nil)
+		ms.SetLogger(log.New(ioutil.Discard, "", 0))
+		ms.SetCompactHandshake(test.master)
+		conn := writeHookConn{client, func(p []byte) { written.Write(p) }}
+		if _, _, cErr, mErr := exchangeConns(cs, ms, conn, master); cErr != nil || mErr != nil {
+			t.Fatalf("%+v: Exchange failed: %v, %v", test, cErr, mErr)
+		}
+
+		hasFooter := strings.Contains(written.String(), "; N0CALL DE LA5NTA (JO39EQ)\r")
+		switch {
+		case hasFooter == test.expectCompact:
+			t.Errorf("%+v: Unexpected client handshake: %q", test, written.String())
+		case !test.client && !test.master:
+			sent[0] = written.Len()
+		case test.expectCompact:
+			sent[1] = written.Len()
+		}
+	}
+	t.Logf("Client sent %d bytes using the standard handshake, %d bytes using the compact handshake", sent[0], sent[1])
+}
+
+func TestSessionMOTDLimits(t *testing.T) {
+	motd := []string{"Welcome", "to", "the gateway"} // 8 + 3 + 12 bytes
+	tests := []struct {
+		maxLines, maxBytes int
+		expect             []string
+	}{
+		{0, 0, motd},
+		{3, 23, motd},
+		{2, 0, []string{"Welcome", MOTDEllipsis}},
+		{1, 0, []string{MOTDEllipsis}},
+		{0, 22, []string{"Welcome", "to", MOTDEllipsis}},
+		{0, 14, []string{"Welcome", MOTDEllipsis}},
+		{0, 11, []string{MOTDEllipsis}},
+		{0, 3, nil},
+		{2, 22, []string{"Welcome", MOTDEllipsis}},
+	}
+	for _, test := range tests {
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+		s.SetMOTD(motd...)
+		s.SetMOTDLimits(test.maxLines, test.maxBytes)
+		if got := s.motdLines(); !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("limits (%d, %d): Expected %q, got %q", test.maxLines, test.maxBytes, test.expect, got)
+		}
+	}
+
+	// Truncation must not modify the configured MOTD
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+	s.SetMOTD(motd...)
+	s.SetMOTDLimits(2, 0)
+	s.motdLines()
+	if !reflect.DeepEqual(s.motd, motd) {
+		t.Errorf("MOTD modified: %q", s.motd)
+	}
+}
+
+func TestHandshakeMOTDTruncated(t *testing.T) {
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+	s.IsMaster(true)
+	s.SetMOTD("Welcome", "to", "the gateway")
+	s.SetMOTDLimits(2, 0)
+
+	var buf bytes.Buffer
+	s.rd = bufio.NewReader(strings.NewReader("[WL2K-3.2-B2FWIHJM$]\r;PQ: 12345678\rCMS>\r"))
+	s.handshake(struct {
+		io.Reader
+		io.Writer
+	}{s.rd, &buf})
+	if !strings.HasPrefix(buf.String(), "Welcome\r...\r;FW:") {
+		t.Errorf("Unexpected MOTD output: %q", buf.String())
+	}
+}
+
+func TestSendHandshakeAuthorizedCalls(t *testing.T) {
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+	s.SetLogger(log.New(ioutil.Discard, "", 0))
+	s.AddAuxiliaryAddress(Address{Addr: "LE1OF"}, Address{Addr: "la3f"}, Address{Addr: "LA1B"})
+
+	var checked []Address
+	s.SetAuthorizedCallsFunc(func(addr Address) bool {
+		checked = append(checked, addr)
+		return addr.Addr != "LA3F"
+	})
+
+	var buf bytes.Buffer
+	if err := s.sendHandshake(&buf, ""); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if expect := ";FW: LA5NTA LE1OF LA1B\r"; !strings.HasPrefix(buf.String(), expect) {
+		t.Errorf("Expected FW line %q, got %q", expect, buf.String())
+	}
+
+	// The primary call sign is never checked, and the auxiliary addresses are checked after normalization
+	expect := []Address{{Addr: "LE1OF"}, {Addr: "LA3F"}, {Addr: "LA1B"}}
+	if !reflect.DeepEqual(checked, expect) {
+		t.Errorf("Expected %v to be checked, got %v", expect, checked)
+	}
+}
+
+func TestHandshakeSendMOTDDisabled(t *testing.T) {
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+	s.SetLogger(log.New(ioutil.Discard, "", 0))
+	s.IsMaster(true)
+	s.SetMOTD("", "Welcome", "")
+	s.SetSendMOTD(false)
+
+	var buf bytes.Buffer
+	s.rd = bufio.NewReader(strings.NewReader("[WL2K-3.2-B2FWIHJM$]\r;FW: N0CALL\rN0CALL>\r"))
+	s.handshake(struct {
+		io.Reader
+		io.Writer
+	}{s.rd, &buf})
+
+	// Our handshake (;FW and the SID header) must be the first bytes sent
+	const expect = ";FW: LA5NTA\r[wl2kgo-"
+	if !strings.HasPrefix(buf.String(), expect) {
+		t.Errorf("Expected output to start with %q, got %q", expect, buf.String())
+	}
+}
+
+func TestHandshakeApprovalFunc(t *testing.T) {
+	const handshake = "Welcome to Test CMS\rMaintenance tonight\r[WL2K-5.0-B2FWIHJM$]\r;PQ: 23753528\r; LA5NTA DE N0CALL (JO39EQ)\rCMS >\r"
+	errMaintenance := errors.New("Gateway in maintenance")
+
+	for _, reject := range []bool{false, true} {
+		var got HandshakeInfo
+		var written bytes.Buffer
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+		s.SetLogger(log.New(ioutil.Discard, "", 0))
+		s.SetSecureLoginHandleFunc(func() (string, error) { return "password", nil })
+		s.SetHandshakeApprovalFunc(func(info HandshakeInfo) error {
+			got = info
+			for _, line := range info.MOTD {
+				if reject && strings.Contains(line, "Maintenance") {
+					return errMaintenance
+				}
+			}
+			return nil
+		})
+		s.rd = bufio.NewReader(strings.NewReader(handshake))
+		err := s.handshake(struct {
+			io.Reader
+			io.Writer
+		}{s.rd, &written})
+
+		switch {
+		case !reject && err != nil:
+			t.Errorf("Unexpected error: %s", err)
+		case !reject && !strings.Contains(written.String(), ";PR:"):
+			t.Errorf("Expected secure login response, got %q", written.String())
+		case reject && err != errMaintenance:
+			t.Errorf("Expected the approval error, got %v", err)
+		case reject && written.Len() > 0:
+			t.Errorf("Expected nothing written when rejected, got %q", written.String())
+		}
+
+		expect := HandshakeInfo{
+			Targetcall:  "N0CALL",
+			App:         "WL2K",
+			Version:     "5.0",
+			SID:         "[WL2K-5.0-B2FWIHJM$]",
+			MOTD:        []string{"Welcome to Test CMS", "Maintenance tonight"},
+			Banner:      strings.Split(strings.TrimSuffix(handshake, "\r"), "\r"),
+			Footer:      &Footer{To: "LA5NTA", From: "N0CALL", Locator: "JO39EQ"},
+			SecureLogin: true,
+		}
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("reject=%t:\nExpected %+v\nGot      %+v", reject, expect, got)
+		}
+	}
+}
+
+func TestSendHandshakeFWPages(t *testing.T) {
+	var aux []Address
+	for i := 0; i < 1000; i++ {
+		aux = append(aux, Address{Addr: fmt.Sprintf("T%04d", i)})
+	}
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+	s.AddAuxiliaryAddress(aux...)
+	if n := s.FWPages(); n != 1 {
+		t.Errorf("Expected 1 page when paging is disabled, got %d", n)
+	}
+
+	s.SetFWPage(0, 300)
+	if n := s.FWPages(); n != 4 {
+		t.Fatalf("Expected 4 pages, got %d", n)
+	}
+
+	var requested []Address
+	for page := 0; page <= 4; page++ {
+		s.SetFWPage(page, 300)
+		var buf bytes.Buffer
+		if err := s.sendHandshake(&buf, ""); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		line, _ := bufio.NewReader(&buf).ReadString('\r')
+		fw, err := parseFW(strings.TrimSuffix(line, "\r"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expect := 300
+		switch page {
+		case 3:
+			expect = 100
+		case 4:
+			expect = 0 // Beyond the last page
+		}
+		if fw[0].Addr != "LA5NTA" || len(fw)-1 != expect {
+			t.Errorf("Page %d: Expected LA5NTA followed by %d addresses, got %d addresses starting with %s", page, expect, len(fw), fw[0])
+		}
+		requested = append(requested, fw[1:]...)
+	}
+	if !reflect.DeepEqual(requested, aux) {
+		t.Errorf("Expected every auxiliary address to be requested exactly once")
+	}
+}
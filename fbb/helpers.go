@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"unicode"
 )
 
 type ByDate []*Message
@@ -46,9 +47,14 @@ func (s *Session) nextLineRemoteErr(parseErr bool) (string, error) {
 		return line, err
 	}
 
+	s.rawLine = strings.TrimSuffix(line, "\r")
 	line = cleanString(line)
 	s.pLog.Println(line)
 
+	if s.isKeepalive(line) {
+		return s.nextLineRemoteErr(parseErr)
+	}
+
 	if err := errLine(line); parseErr && err != nil {
 		return "", err
 	} else {
@@ -73,16 +79,10 @@ func errLine(str string) error {
 	return fmt.Errorf(strings.TrimSpace(str[idx+1:]))
 }
 
+// cleanString strips surrounding whitespace and NUL padding from a received line.
+//
+// Some gateways pad lines with trailing spaces or NULs, which would otherwise
+// break prefix and suffix checks (i.e. the ">" of a prompt line).
 func cleanString(str string) string {
-	str = strings.TrimSpace(str)
-	if len(str) < 1 {
-		return str
-	}
-	if str[0] == byte(0) {
-		str = str[1:]
-	}
-	if str[len(str)-1] == byte(0) {
-		str = str[0 : len(str)-2]
-	}
-	return str
+	return strings.TrimFunc(str, func(r rune) bool { return r == 0 || unicode.IsSpace(r) })
 }
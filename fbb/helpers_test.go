@@ -29,3 +29,20 @@ func TestErrLine(t *testing.T) {
 		t.Errorf("Expected no error, got non nil")
 	}
 }
+
+func TestCleanString(t *testing.T) {
+	tests := map[string]string{
+		"FF\r":            "FF",
+		"CMS >  \r":       "CMS >",
+		"\nFF\r":          "FF",
+		"\x00FF\x00":      "FF",
+		"CMS > \x00\r":    "CMS >",
+		" \t;FW: LA5NTA ": ";FW: LA5NTA",
+		"":                "",
+	}
+	for input, expect := range tests {
+		if got := cleanString(input); got != expect {
+			t.Errorf("%q: Expected %q, got %q", input, expect, got)
+		}
+	}
+}
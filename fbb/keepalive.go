@@ -0,0 +1,74 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// keepaliveFrame is the protocol line sent to keep an idle remote waiting (see Session.SetKeepalive).
+const keepaliveFrame = "FL"
+
+// SetKeepalive enables keepalive frames at the given interval. Zero disables keepalives (the default).
+//
+// The keepalive frames are sent while the remote is waiting for us: While paused (see Pause), while
+// answering the remote's proposals and while storing the received messages. The remote's keepalive frames
+// are discarded, and count as a response to our session turnover (see SetTurnoverTimeout).
+//
+// Keepalives are specific to wl2k-go, and advertised with the L SID code. The frames are only sent if the
+// remote advertises the code too, as other implementations would not understand them.
+func (s *Session) SetKeepalive(interval time.Duration) { s.keepaliveInterval = interval }
+
+// keepaliveNegotiated returns true if both sides advertised keepalive support.
+func (s *Session) keepaliveNegotiated() bool {
+	return s.keepaliveInterval > 0 && s.remoteSID.Has(sKeepalive)
+}
+
+// isKeepalive returns true if the line is a keepalive frame from the remote, and keepalives are negotiated.
+func (s *Session) isKeepalive(line string) bool {
+	return line == keepaliveFrame && s.keepaliveNegotiated()
+}
+
+// keepalive calls f, sending keepalive frames to w at the keepalive interval until f returns (if negotiated).
+func (s *Session) keepalive(w io.Writer, f func()) {
+	if !s.keepaliveNegotiated() {
+		f()
+		return
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	ticker := time.NewTicker(s.keepaliveInterval)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-ticker.C:
+				s.pLog.Print(">" + keepaliveFrame)
+				if _, err := fmt.Fprintf(w, "%s\r", keepaliveFrame); err != nil {
+					return // Left for the caller to detect
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	f()
+	ticker.Stop()
+	close(done)
+	wg.Wait() // Never write after f returns
+}
+
+// waitInboundAnswer returns the answer to the remote's proposal (see inboundAnswer), sending keepalive frames to
+// w while waiting for the handler.
+func (s *Session) waitInboundAnswer(w io.Writer, p Proposal) (answer ProposalAnswer, reason string) {
+	s.keepalive(w, func() { answer, reason = s.inboundAnswer(p) })
+	return
+}
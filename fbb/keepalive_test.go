@@ -0,0 +1,100 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// frameCounter is a net.Conn counting the keepalive frames written.
+type frameCounter struct {
+	net.Conn
+	mu sync.Mutex
+	n  int
+}
+
+func (c *frameCounter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.n += bytes.Count(p, []byte(keepaliveFrame+"\r"))
+	c.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+func (c *frameCounter) frames() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+func TestSessionKeepalive(t *testing.T) {
+	tests := []struct{ client, master bool }{
+		{true, true},
+		{true, false},
+		{false, true},
+	}
+	for _, test := range tests {
+		client, master := tcpPipe(t)
+		conn := &frameCounter{Conn: client}
+
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", newMemMBox(newTestMessage("LA5NTA", "N0CALL", 100)))
+		if test.client {
+			s.SetKeepalive(10 * time.Millisecond)
+		}
+		s.Pause()
+		time.AfterFunc(100*time.Millisecond, s.Resume)
+
+		m := NewSession("N0CALL", "LA5NTA", "JO39EQ", newMemMBox())
+		if test.master {
+			m.SetKeepalive(10 * time.Millisecond)
+		}
+		if _, _, cErr, mErr := exchangeConns(s, m, conn, master); cErr != nil || mErr != nil {
+			t.Fatalf("%+v: Unexpected errors: %v, %v", test, cErr, mErr)
+		}
+
+		mutual := test.client && test.master
+		if caps := s.capabilities(); caps.Keepalive != mutual {
+			t.Errorf("%+v: Expected Keepalive=%t, got %t", test, mutual, caps.Keepalive)
+		}
+		switch n := conn.frames(); {
+		case mutual && n == 0:
+			t.Errorf("%+v: Expected keepalive frames while paused", test)
+		case !mutual && n > 0:
+			t.Errorf("%+v: Expected no keepalive frames, got %d", test, n)
+		}
+	}
+}
+
+func TestPeekTurnoverKeepalive(t *testing.T) {
+	client, srv := tcpPipe(t)
+	defer client.Close()
+	defer srv.Close()
+
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+	s.SetKeepalive(time.Second)
+	s.SetTurnoverTimeout(50 * time.Millisecond)
+	s.remoteSID = sid("B2FHML$")
+	s.rd = bufio.NewReader(client)
+
+	// Each keepalive frame restarts the timeout
+	go func() {
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(srv, "%s\r", keepaliveFrame)
+			time.Sleep(30 * time.Millisecond)
+		}
+		fmt.Fprint(srv, "FF\r")
+	}()
+	if _, err := s.peekTurnover(client); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if line, _ := s.nextLine(); line != "FF" {
+		t.Errorf("Expected the keepalive frames to be discarded, got %q", line)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"strconv"
+	"strings"
+)
+
+// KnownIssue describes a known problem with a range of versions of a remote application.
+type KnownIssue struct {
+	App        string // The application name as given in the SID (case insensitive).
+	MinVersion string // The first affected version (inclusive). Empty means no lower bound.
+	MaxVersion string // The last affected version (inclusive). Empty means no upper bound.
+
+	Description string // A short description of the issue, included in the logged warning.
+}
+
+// KnownIssues is the registry of remote application versions known to cause problems.
+//
+// When the remote's user agent matches an entry, a warning is logged after the
+// handshake and the issue is reported in TrafficStats.KnownIssues. Add entries to
+// extend the registry.
+var KnownIssues []KnownIssue
+
+// Matches returns true if the user agent is affected by the issue.
+func (k KnownIssue) Matches(ua UserAgent) bool {
+	switch {
+	case !strings.EqualFold(k.App, ua.Name):
+		return false
+	case k.MinVersion != "" && compareVersions(ua.Version, k.MinVersion) < 0:
+		return false
+	case k.MaxVersion != "" && compareVersions(ua.Version, k.MaxVersion) > 0:
+		return false
+	default:
+		return true
+	}
+}
+
+// knownIssues returns the entries of KnownIssues matching the remote's user agent.
+func (s *Session) knownIssues() []KnownIssue {
+	var matches []KnownIssue
+	for _, k := range KnownIssues {
+		if k.Matches(s.remoteUA) {
+			matches = append(matches, k)
+		}
+	}
+	return matches
+}
+
+// compareVersions compares two dot separated version strings (i.e. 2.8.4.8).
+//
+// Numeric components are compared numerically, others lexically. A missing
+// component is less than any present component (2.8 < 2.8.0).
+//
+// The result is 0 if a == b, -1 if a < b and +1 if a > b.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if c := compareVersionComponents(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs):
+		return 1
+	default:
+		return 0
+	}
+}
+
+func compareVersionComponents(a, b string) int {
+	an, aErr := strconv.Atoi(a)
+	bn, bErr := strconv.Atoi(b)
+	switch {
+	case aErr == nil && bErr == nil && an < bn:
+		return -1
+	case aErr == nil && bErr == nil && an > bn:
+		return 1
+	case aErr == nil && bErr == nil:
+		return 0
+	}
+	return strings.Compare(a, b)
+}
@@ -0,0 +1,92 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b   string
+		expect int
+	}{
+		{"2.8.4.8", "2.8.4.8", 0},
+		{"2.8.4.8", "2.8.4.10", -1},
+		{"2.10", "2.9.9", 1},
+		{"2.8", "2.8.0", -1},
+		{"1.0b", "1.0a", 1},
+		{"5.0", "4.0", 1},
+	}
+	for _, test := range tests {
+		if got := compareVersions(test.a, test.b); got != test.expect {
+			t.Errorf("compareVersions(%q, %q): Expected %d, got %d", test.a, test.b, test.expect, got)
+		}
+	}
+}
+
+func TestKnownIssueMatches(t *testing.T) {
+	k := KnownIssue{App: "WL2K", MinVersion: "2.8.0", MaxVersion: "2.8.4.8"}
+	tests := map[UserAgent]bool{
+		{Name: "WL2K", Version: "2.8.0"}:   true,
+		{Name: "wl2k", Version: "2.8.4.7"}: true,
+		{Name: "WL2K", Version: "2.8.4.8"}: true,
+		{Name: "WL2K", Version: "2.8.4.9"}: false,
+		{Name: "WL2K", Version: "2.7.9"}:   false,
+		{Name: "RMS", Version: "2.8.1"}:    false,
+	}
+	for ua, expect := range tests {
+		if got := k.Matches(ua); got != expect {
+			t.Errorf("%+v: Expected %t, got %t", ua, expect, got)
+		}
+	}
+
+	if !(KnownIssue{App: "WL2K"}).Matches(UserAgent{Name: "WL2K", Version: "1.0"}) {
+		t.Errorf("Expected an issue without version bounds to match every version")
+	}
+}
+
+func TestSessionKnownIssues(t *testing.T) {
+	defer func(orig []KnownIssue) { KnownIssues = orig }(KnownIssues)
+	KnownIssues = []KnownIssue{{App: "WL2K", MaxVersion: "3.0", Description: "Broken forwarding"}}
+
+	for version, affected := range map[string]bool{"2.8.4.8": true, "5.0": false} {
+		client, srv := net.Pipe()
+
+		var logged bytes.Buffer
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+		s.SetLogger(log.New(&logged, "", 0))
+
+		cerrs := make(chan error, 1)
+		go func() {
+			stats, err := s.Exchange(client)
+			if err == nil && affected != (len(stats.KnownIssues) == 1) {
+				err = fmt.Errorf("unexpected known issues: %v", stats.KnownIssues)
+			}
+			cerrs <- err
+		}()
+
+		fmt.Fprintf(srv, "[WL2K-%s-B2FWIHJM$]\rCMS >\r", version)
+		rd := bufio.NewReader(srv)
+		for line := ""; line != "FF\r"; {
+			line, _ = rd.ReadString('\r')
+		}
+		fmt.Fprint(srv, "FQ\r")
+		srv.Close()
+
+		if err := <-cerrs; err != nil {
+			t.Errorf("%s: %s", version, err)
+		}
+		if got := strings.Contains(logged.String(), "Broken forwarding"); got != affected {
+			t.Errorf("%s: Expected warning logged to be %t, got log %q", version, affected, logged.String())
+		}
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"errors"
+	"math"
+)
+
+// ErrInvalidLatLon is returned when a latitude or longitude is out of range.
+var ErrInvalidLatLon = errors.New("Latitude or longitude out of range")
+
+// MaidenheadLocator returns the 6-character Maidenhead locator (i.e. JO39EQ) of the given position.
+//
+// The latitude must be within [-90, 90] and the longitude within [-180, 180] (decimal degrees).
+func MaidenheadLocator(lat, lon float64) (string, error) {
+	if math.IsNaN(lat) || math.IsNaN(lon) || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return "", ErrInvalidLatLon
+	}
+
+	// Shift the origin to the south pole and the antimeridian.
+	// The north pole and the antimeridian (east) belongs to the last field.
+	lon = math.Min(lon+180, 360-1e-9)
+	lat = math.Min(lat+90, 180-1e-9)
+
+	loc := []byte{
+		'A' + byte(lon/20), // Field (20x10 degrees)
+		'A' + byte(lat/10),
+		'0' + byte(math.Mod(lon, 20)/2), // Square (2x1 degrees)
+		'0' + byte(math.Mod(lat, 10)),
+		'A' + byte(math.Mod(lon, 2)*12), // Subsquare (5x2.5 minutes)
+		'A' + byte(math.Mod(lat, 1)*24),
+	}
+	return string(loc), nil
+}
+
+// SetLocatorFromLatLon sets this session's locator to the Maidenhead locator of the given position.
+//
+// See MaidenheadLocator.
+func (s *Session) SetLocatorFromLatLon(lat, lon float64) error {
+	loc, err := MaidenheadLocator(lat, lon)
+	if err != nil {
+		return err
+	}
+	s.locator = loc
+	return nil
+}
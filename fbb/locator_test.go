@@ -0,0 +1,58 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestMaidenheadLocator(t *testing.T) {
+	tests := []struct {
+		lat, lon float64
+		expect   string
+	}{
+		{48.14666, 11.60833, "JN58TD"},    // Munich
+		{41.714775, -72.727260, "FN31PR"}, // W1AW, Newington
+		{-33.8568, 151.2153, "QF56OD"},    // Sydney Opera House
+		{-90, -180, "AA00AA"},
+		{90, 180, "RR99XX"},
+		{0, 0, "JJ00AA"},
+	}
+	for _, test := range tests {
+		got, err := MaidenheadLocator(test.lat, test.lon)
+		if err != nil {
+			t.Errorf("%f,%f: Unexpected error: %s", test.lat, test.lon, err)
+		} else if got != test.expect {
+			t.Errorf("%f,%f: Expected %s, got %s", test.lat, test.lon, test.expect, got)
+		}
+	}
+
+	for _, pos := range [][2]float64{{90.1, 0}, {-90.1, 0}, {0, 180.1}, {0, -180.1}, {math.NaN(), 0}} {
+		if _, err := MaidenheadLocator(pos[0], pos[1]); err != ErrInvalidLatLon {
+			t.Errorf("%v: Expected ErrInvalidLatLon, got %v", pos, err)
+		}
+	}
+}
+
+func TestSessionSetLocatorFromLatLon(t *testing.T) {
+	s := NewSession("LA5NTA", "N0CALL", "", nil)
+	if err := s.SetLocatorFromLatLon(91, 0); err != ErrInvalidLatLon {
+		t.Errorf("Expected ErrInvalidLatLon, got %v", err)
+	}
+	if err := s.SetLocatorFromLatLon(48.14666, 11.60833); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := s.sendHandshake(&buf, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(buf.String(), "; N0CALL DE LA5NTA (JN58TD)\r") {
+		t.Errorf("Expected the computed locator in the footer, got %q", buf.String())
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyConn is a net.Conn dropping and corrupting the bytes written to it.
+//
+// The first skip bytes are passed through untouched (i.e. to let the handshake succeed).
+// After that, each byte is dropped with probability drop, or else replaced by a random
+// byte with probability corrupt. The decisions are made by a rand.Rand seeded with the
+// given seed, so a given seed and write sequence always results in the same output.
+type lossyConn struct {
+	net.Conn
+
+	mu            sync.Mutex
+	rand          *rand.Rand
+	skip          int
+	drop, corrupt float64
+}
+
+// lossyPipe returns both ends of a loopback TCP connection, with the writes of both ends
+// (in both directions) passed through their own lossyConn.
+func lossyPipe(t *testing.T, seed int64, skip int, drop, corrupt float64) (a, b net.Conn) {
+	a, b = tcpPipe(t)
+	return &lossyConn{Conn: a, rand: rand.New(rand.NewSource(seed)), skip: skip, drop: drop, corrupt: corrupt},
+		&lossyConn{Conn: b, rand: rand.New(rand.NewSource(seed + 1)), skip: skip, drop: drop, corrupt: corrupt}
+}
+
+func (c *lossyConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	out := make([]byte, 0, len(p))
+	for _, b := range p {
+		if c.skip > 0 {
+			c.skip--
+			out = append(out, b)
+			continue
+		}
+		switch r := c.rand.Float64(); {
+		case r < c.drop:
+			continue
+		case r < c.drop+c.corrupt:
+			b ^= byte(1 + c.rand.Intn(255)) // Guaranteed to change the byte
+		}
+		out = append(out, b)
+	}
+	c.mu.Unlock()
+
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func TestLossyConnDeterministic(t *testing.T) {
+	data := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog. "), 100)
+
+	output := func(seed int64) []byte {
+		a, b := lossyPipe(t, seed, 10, 0.01, 0.01)
+		defer a.Close()
+		defer b.Close()
+		go func() {
+			for i := 0; i < len(data); i += 100 {
+				a.Write(data[i : i+100])
+			}
+			a.Close()
+		}()
+		got, _ := ioutil.ReadAll(b)
+		return got
+	}
+
+	first := output(42)
+	if !bytes.Equal(first[:10], data[:10]) {
+		t.Errorf("Expected the first bytes to pass through untouched")
+	}
+	if bytes.Equal(first, data) {
+		t.Fatalf("Expected the data to be modified")
+	}
+	if !bytes.Equal(first, output(42)) {
+		t.Errorf("Expected identical output with the same seed")
+	}
+	if bytes.Equal(first, output(43)) {
+		t.Errorf("Expected different output with another seed")
+	}
+}
+
+// The handshake is a few hundred bytes. Corrupt the rest of the exchange.
+const lossySkip = 512
+
+func TestSessionLossyTransport(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping lossy transport tests in short mode")
+	}
+
+	tests := []struct {
+		drop, corrupt float64
+	}{
+		{0, 0.001},
+		{0, 0.01},
+		{0.001, 0},
+		{0.01, 0.01},
+	}
+	for _, test := range tests {
+		var failed int
+		for seed := int64(1); seed <= 10; seed++ {
+			if !testLossyExchange(t, seed, test.drop, test.corrupt) {
+				failed++
+			}
+		}
+		if failed == 0 {
+			t.Errorf("drop=%g, corrupt=%g: Expected the error paths to be exercised", test.drop, test.corrupt)
+		}
+	}
+}
+
+// testLossyExchange runs an exchange over a lossyPipe, asserting that it either succeeds or fails
+// cleanly (without hanging, panicking or storing a damaged message). It returns true if both ends succeeded.
+func testLossyExchange(t *testing.T, seed int64, drop, corrupt float64) (ok bool) {
+	client, master := lossyPipe(t, seed, lossySkip, drop, corrupt)
+
+	clientMsgs := []*Message{newTestMessage("LA5NTA", "N0CALL", 2000), newTestMessage("LA5NTA", "N0CALL", 500)}
+	masterMsgs := []*Message{newTestMessage("N0CALL", "LA5NTA", 2000)}
+	clientMBox, masterMBox := newMemMBox(clientMsgs...), newMemMBox(masterMsgs...)
+
+	cs := NewSession("LA5NTA", "N0CALL", "JO39EQ", clientMBox)
+	ms := NewSession("N0CALL", "LA5NTA", "JO39EQ", masterMBox)
+	for _, s := range []*Session{cs, ms} {
+		s.SetLogger(log.New(ioutil.Discard, "", 0))
+		s.SetTurnoverTimeout(2 * time.Second)
+	}
+
+	var cErr, mErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _, cErr, mErr = exchangeConns(cs, ms, client, master)
+	}()
+
+	// Lost bytes may leave the receiver waiting for data that never arrives.
+	// Closing the connections must make both ends fail.
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		client.Close()
+		master.Close()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("seed %d (drop=%g, corrupt=%g): Exchange did not return after the connection was closed", seed, drop, corrupt)
+		}
+	}
+	ok = cErr == nil && mErr == nil
+	client.Close()
+	master.Close()
+
+	// Anything stored must be intact
+	assertIntact := func(received, sent []*Message) {
+		for _, got := range received {
+			var orig *Message
+			for _, msg := range sent {
+				if msg.MID() == got.MID() {
+					orig = msg
+				}
+			}
+			if orig == nil {
+				t.Errorf("seed %d (drop=%g, corrupt=%g): Received unknown message %s", seed, drop, corrupt, got.MID())
+				continue
+			}
+			gotBody, _ := got.Body()
+			origBody, _ := orig.Body()
+			if gotBody != origBody || got.Subject() != orig.Subject() {
+				t.Errorf("seed %d (drop=%g, corrupt=%g): Damaged message %s was stored", seed, drop, corrupt, got.MID())
+			}
+		}
+	}
+	assertIntact(masterMBox.inbox(), clientMsgs)
+	assertIntact(clientMBox.inbox(), masterMsgs)
+	return ok
+}
@@ -16,6 +16,7 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 )
 
 // ValidationError is the error type returned by functions validating a message.
@@ -116,6 +117,34 @@ func NewMessage(t MsgType, mycall string) *Message {
 	return msg
 }
 
+// NewOutboundMessage returns a new Private message from the given call sign, ready to be sent.
+//
+// The MID, Date, Mbo and From header fields are set as by NewMessage. The message is
+// validated (see Validate) before it is returned, and a ValidationError is returned if
+// any required field is missing or invalid.
+func NewOutboundMessage(from string, to []string, subject, body string) (*Message, error) {
+	if strings.TrimSpace(from) == "" {
+		return nil, ValidationError{"From", "Empty From field"}
+	}
+	for _, addr := range to {
+		if strings.TrimSpace(addr) == "" {
+			return nil, ValidationError{"To/Cc", "Empty recipient"}
+		}
+	}
+
+	msg := NewMessage(Private, strings.TrimSpace(from))
+	msg.AddTo(to...)
+	msg.SetSubject(subject)
+	if err := msg.SetBody(body); err != nil {
+		return nil, err
+	}
+
+	if err := msg.Validate(); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
 // Validate returns an error if this message violates any Winlink Message Structure constraints
 func (m *Message) Validate() error {
 	switch {
@@ -141,7 +170,7 @@ func (m *Message) Validate() error {
 	// The CMS seems to except this, but according to the winlink.org/B2F document it is not allowed:
 	//  "... and the file name (up to 50 characters) of the original file."
 	for _, f := range m.Files() {
-		if len(f.Name()) > 50 {
+		if len(f.Name()) > MaxFileNameLength {
 			return ValidationError{"Files", fmt.Sprintf("Attachment file name too long: %s", f.Name())}
 		}
 	}
@@ -288,6 +317,23 @@ func (m *Message) Cc() (cc []Address) {
 	return
 }
 
+// ParseMessage parses a message in the Winlink Message format (i.e. as produced by Message.Bytes).
+//
+// Unlike ReadFrom, ParseMessage fails if any of the attachments can't be parsed.
+// Truncated input results in an error wrapping io.ErrUnexpectedEOF.
+func ParseMessage(r io.Reader) (*Message, error) {
+	m := new(Message)
+	if err := m.ReadFrom(r); err != nil {
+		return nil, fmt.Errorf("Unable to parse message: %w", err)
+	}
+	for _, f := range m.files {
+		if f.err != nil {
+			return nil, fmt.Errorf("Unable to parse attachment '%s': %w", f.name, f.err)
+		}
+	}
+	return m, nil
+}
+
 // Implements ReaderFrom for Message.
 //
 // Reads the given io.Reader and fills in values fetched from the stream.
@@ -295,12 +341,20 @@ func (m *Message) ReadFrom(r io.Reader) error {
 	reader := bufio.NewReader(r)
 
 	if h, err := textproto.NewReader(reader).ReadMIMEHeader(); err != nil {
+		if _, peekErr := reader.Peek(1); peekErr == io.EOF {
+			return io.ErrUnexpectedEOF // The input ended before the end of the headers
+		}
 		return err
 	} else {
 		m.Header = Header(h)
 	}
 
 	// Read body
+	if v := m.Header.Get(HEADER_BODY); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n < 0 {
+			return fmt.Errorf("Invalid Body header: '%s'", v)
+		}
+	}
 	var err error
 	m.body, err = readSection(reader, m.BodySize())
 	if err != nil {
@@ -320,7 +374,11 @@ func (m *Message) ReadFrom(r io.Reader) error {
 			continue
 		}
 
-		size, _ := strconv.Atoi(slice[0])
+		size, convErr := strconv.Atoi(slice[0])
+		if convErr != nil || size < 0 {
+			file.err = errors.New(`Invalid file size in file header. Got: ` + value)
+			continue
+		}
 
 		// The name part of this header may be utf8 encoded by Winlink Express. Use WordDecoder to be safe.
 		file.name, _ = dec.DecodeHeader(slice[1])
@@ -388,7 +446,13 @@ func (m *Message) Proposal(code PropCode) (*Proposal, error) {
 		return nil, err
 	}
 
-	return NewProposal(m.MID(), m.Subject(), code, data), m.Validate()
+	prop := NewProposal(m.MID(), m.Subject(), code, data)
+	prop.from = m.From().Addr
+	if rcpts := m.Receivers(); len(rcpts) > 0 {
+		prop.to = rcpts[0].Addr
+	}
+
+	return prop, m.Validate()
 }
 
 // Receivers returns a slice of all receivers of this message.
@@ -416,7 +480,42 @@ func (m *Message) AddFile(f *File) {
 	m.Header.Add(HEADER_FILE, fmt.Sprintf("%d %s", f.Size(), encodedName))
 }
 
-// Bytes returns the message in the Winlink Message format.
+// Limits enforced by AddAttachment.
+const (
+	MaxFileNameLength  = 50     // The max length of an attachment file name (according to winlink.org/B2F).
+	MaxAttachmentsSize = 120000 // The max total size of a message's attachments (in bytes).
+)
+
+// AddAttachment adds the given data as an attachment to m, with the given file name.
+//
+// A ValidationError is returned if the file name is empty, too long or contains path separators
+// or control characters, or if the total size of the attachments would exceed MaxAttachmentsSize.
+func (m *Message) AddAttachment(name string, data []byte) error {
+	switch {
+	case name == "" || name == "." || name == "..":
+		return ValidationError{"Files", "Empty attachment file name"}
+	case len(name) > MaxFileNameLength:
+		return ValidationError{"Files", fmt.Sprintf("Attachment file name too long: %s", name)}
+	case strings.ContainsAny(name, `/\`) || strings.IndexFunc(name, unicode.IsControl) >= 0:
+		return ValidationError{"Files", fmt.Sprintf("Illegal attachment file name: %q", name)}
+	}
+
+	total := len(data)
+	for _, f := range m.Files() {
+		total += f.Size()
+	}
+	if total > MaxAttachmentsSize {
+		return ValidationError{"Files", fmt.Sprintf("Attachments too large (%d bytes, max %d)", total, MaxAttachmentsSize)}
+	}
+
+	m.AddFile(NewFile(name, data))
+	return nil
+}
+
+// Bytes returns the message in the Winlink Message format, as sent on the wire (before compression).
+//
+// The header fields are written in a stable order (Mid first), so the output is reproducible.
+// The result can be parsed using ParseMessage.
 func (m *Message) Bytes() ([]byte, error) {
 	var buf bytes.Buffer
 	if err := m.Write(&buf); err != nil {
@@ -427,7 +526,7 @@ func (m *Message) Bytes() ([]byte, error) {
 
 // Writes Message to the given Writer in the Winlink Message format.
 //
-// If the Date header field is not formatted correctly, an error will be returned.
+// If the Date header field is not formatted correctly, or the MID is missing, an error will be returned.
 func (m *Message) Write(w io.Writer) (err error) {
 	// Ensure Date field is in correct format
 	if _, err = ParseDate(m.Header.Get(HEADER_DATE)); err != nil {
@@ -438,7 +537,9 @@ func (m *Message) Write(w io.Writer) (err error) {
 	writer := bufio.NewWriter(w)
 
 	// Header
-	m.Header.Write(writer)
+	if err = m.Header.Write(writer); err != nil {
+		return
+	}
 	writer.WriteString("\r\n") // end of headers
 
 	// Body
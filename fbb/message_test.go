@@ -6,7 +6,11 @@ package fbb
 
 import (
 	"bytes"
+	"errors"
+	"io"
+	"math/rand"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 	"unicode"
@@ -96,3 +100,252 @@ func IsIllegalHeader(str string) bool {
 func IsGraphicASCII(c rune) bool {
 	return c <= unicode.MaxASCII && unicode.IsGraphic(c)
 }
+
+func TestNewOutboundMessageInvalid(t *testing.T) {
+	tests := []struct {
+		from, subject, body string
+		to                  []string
+		field               string
+	}{
+		{"", "Subject", "Body", []string{"N0CALL"}, "From"},
+		{"LA5NTA", "Subject", "Body", nil, "To/Cc"},
+		{"LA5NTA", "Subject", "Body", []string{"N0CALL", " "}, "To/Cc"},
+		{"LA5NTA", "", "Body", []string{"N0CALL"}, HEADER_SUBJECT},
+		{"LA5NTA", "Subject", "", []string{"N0CALL"}, "Body"},
+	}
+	for i, test := range tests {
+		msg, err := NewOutboundMessage(test.from, test.to, test.subject, test.body)
+		if verr, ok := err.(ValidationError); !ok || verr.Field != test.field {
+			t.Errorf("%d: Expected ValidationError for %s, got %v", i, test.field, err)
+		}
+		if msg != nil {
+			t.Errorf("%d: Expected nil message", i)
+		}
+	}
+}
+
+func TestNewOutboundMessageExchange(t *testing.T) {
+	msg, err := NewOutboundMessage("LA5NTA", []string{"N0CALL", "foo@example.com"}, "Hello", "Hello,\nWorld!")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(msg.MID()) != 12 || msg.Header.Get(HEADER_DATE) == "" || msg.Mbo() != "LA5NTA" {
+		t.Errorf("Missing required header fields: %v", msg.Header)
+	}
+
+	clientMBox, masterMBox := newMemMBox(msg), newMemMBox()
+	client, master := tcpPipe(t)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := NewSession("LA5NTA", "N0CALL", "JO39EQ", clientMBox).Exchange(client)
+		errs <- err
+	}()
+	s := NewSession("N0CALL", "LA5NTA", "JO39EQ", masterMBox)
+	s.IsMaster(true)
+	if _, err := s.Exchange(master); err != nil {
+		t.Fatalf("Unexpected master error: %s", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Unexpected client error: %s", err)
+	}
+
+	received := masterMBox.inbox()
+	if len(received) != 1 {
+		t.Fatalf("Expected 1 received message, got %d", len(received))
+	}
+	got := received[0]
+	body, _ := got.Body()
+	sentBody, _ := msg.Body()
+	switch {
+	case got.MID() != msg.MID():
+		t.Errorf("Expected MID %s, got %s", msg.MID(), got.MID())
+	case got.Subject() != "Hello":
+		t.Errorf("Unexpected subject: %q", got.Subject())
+	case body != sentBody:
+		t.Errorf("Unexpected body: %q", body)
+	case !reflect.DeepEqual(got.Receivers(), msg.Receivers()):
+		t.Errorf("Unexpected receivers: %v", got.Receivers())
+	case got.Validate() != nil:
+		t.Errorf("Received message is not valid: %s", got.Validate())
+	}
+}
+
+func TestMessageAddAttachmentInvalid(t *testing.T) {
+	tests := map[string][]byte{
+		"":                               []byte("data"),
+		"..":                             []byte("data"),
+		"dir/file.txt":                   []byte("data"),
+		`dir\file.txt`:                   []byte("data"),
+		"file\r\n.txt":                   []byte("data"),
+		strings.Repeat("a", 51):          []byte("data"),
+		"large.bin":                      make([]byte, MaxAttachmentsSize+1),
+		strings.Repeat("a", 46) + ".txt": []byte("data"), // 50 chars, should be ok
+	}
+	for name, data := range tests {
+		msg := NewMessage(Private, "LA5NTA")
+		err := msg.AddAttachment(name, data)
+		if len(name) == MaxFileNameLength {
+			if err != nil {
+				t.Errorf("%q: Unexpected error: %s", name, err)
+			}
+			continue
+		}
+		if _, ok := err.(ValidationError); !ok {
+			t.Errorf("%q: Expected ValidationError, got %v", name, err)
+		}
+		if len(msg.Files()) != 0 || msg.Header.Get(HEADER_FILE) != "" {
+			t.Errorf("%q: Expected no attachment to be added", name)
+		}
+	}
+
+	// The size limit applies to the total size
+	msg := NewMessage(Private, "LA5NTA")
+	if err := msg.AddAttachment("a.bin", make([]byte, MaxAttachmentsSize/2)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := msg.AddAttachment("b.bin", make([]byte, MaxAttachmentsSize/2+1)); err == nil {
+		t.Errorf("Expected error when exceeding the total size limit")
+	}
+}
+
+func TestMessageAddAttachmentExchange(t *testing.T) {
+	data := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(data)
+	copy(data, "\r\n\r\n\x00") // Line endings and NULs must not be touched
+
+	msg, err := NewOutboundMessage("LA5NTA", []string{"N0CALL"}, "Attachment", "See attached")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := msg.AddAttachment("data.bin", data); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	clientMBox, masterMBox := newMemMBox(msg), newMemMBox()
+	client, master := tcpPipe(t)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := NewSession("LA5NTA", "N0CALL", "JO39EQ", clientMBox).Exchange(client)
+		errs <- err
+	}()
+	s := NewSession("N0CALL", "LA5NTA", "JO39EQ", masterMBox)
+	s.IsMaster(true)
+	if _, err := s.Exchange(master); err != nil {
+		t.Fatalf("Unexpected master error: %s", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Unexpected client error: %s", err)
+	}
+
+	received := masterMBox.inbox()
+	if len(received) != 1 {
+		t.Fatalf("Expected 1 received message, got %d", len(received))
+	}
+	files := received[0].Files()
+	switch {
+	case len(files) != 1:
+		t.Fatalf("Expected 1 attachment, got %d", len(files))
+	case files[0].Name() != "data.bin":
+		t.Errorf("Unexpected file name: %q", files[0].Name())
+	case !bytes.Equal(files[0].Data(), data):
+		t.Errorf("Received attachment differs from the sent data")
+	}
+}
+
+func TestParseMessage(t *testing.T) {
+	msg, _ := NewOutboundMessage("LA5NTA", []string{"N0CALL"}, "Parse me", "Hello, World!")
+	msg.AddAttachment("data.bin", []byte("\x00\x01\r\n\x02"))
+	data, err := msg.Bytes()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	got, err := ParseMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	gotBody, _ := got.Body()
+	msgBody, _ := msg.Body()
+	switch {
+	case got.MID() != msg.MID() || got.Subject() != "Parse me" || !reflect.DeepEqual(got.Receivers(), msg.Receivers()):
+		t.Errorf("Unexpected headers: %v", got.Header)
+	case gotBody != msgBody:
+		t.Errorf("Unexpected body: %q", gotBody)
+	case len(got.Files()) != 1 || got.Files()[0].Name() != "data.bin" || !bytes.Equal(got.Files()[0].Data(), []byte("\x00\x01\r\n\x02")):
+		t.Errorf("Unexpected attachments: %v", got.Files())
+	}
+
+	// Truncated in the headers, body and attachment
+	for _, n := range []int{0, 20, bytes.Index(data, []byte("Hello")) + 5, len(data) - 4} {
+		if _, err := ParseMessage(bytes.NewReader(data[:n])); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Truncated at %d/%d: Expected io.ErrUnexpectedEOF, got %v", n, len(data), err)
+		}
+	}
+}
+
+func TestParseMessageMalformed(t *testing.T) {
+	tests := []string{
+		"Mid: ABC\r\nBody: foo\r\n\r\nbody\r\n",
+		"Mid: ABC\r\nBody: -1\r\n\r\nbody\r\n",
+		"Mid: ABC\r\nBody: 4\r\nFile: 4\r\n\r\nbody\r\ndata\r\n",
+		"Mid: ABC\r\nBody: 4\r\nFile: -4 data.bin\r\n\r\nbody\r\ndata\r\n",
+		"Mid: ABC\r\nDate: 2016/01/02 15:04\r\nBody: 4\r\n\r\nbodyXX\r\n", // Missing section terminator
+	}
+	for _, test := range tests {
+		if msg, err := ParseMessage(strings.NewReader(test)); err == nil {
+			t.Errorf("%q: Expected error, got %v", test, msg)
+		}
+	}
+}
+
+func TestMessageBytesGolden(t *testing.T) {
+	msg := NewMessage(Private, "LA5NTA")
+	msg.Header.Set(HEADER_MID, "ABCDEFGHIJKL")
+	msg.SetDate(time.Date(2016, 3, 28, 12, 43, 0, 0, time.UTC))
+	msg.AddTo("N0CALL", "foo@example.com")
+	msg.AddCc("LE1OF")
+	msg.SetSubject("Golden")
+	msg.SetBody("Hello,\nWorld!")
+	msg.AddAttachment("a.txt", []byte("data\r\n"))
+
+	const golden = "Mid: ABCDEFGHIJKL\r\n" +
+		"Body: 16\r\n" +
+		"Cc: LE1OF\r\n" +
+		"Content-Transfer-Encoding: 8bit\r\n" +
+		"Content-Type: text/plain; charset=ISO-8859-1\r\n" +
+		"Date: 2016/03/28 12:43\r\n" +
+		"File: 6 a.txt\r\n" +
+		"From: LA5NTA\r\n" +
+		"Mbo: LA5NTA\r\n" +
+		"Subject: Golden\r\n" +
+		"To: N0CALL\r\n" +
+		"To: SMTP:foo@example.com\r\n" +
+		"Type: Private\r\n" +
+		"\r\n" +
+		"Hello,\r\nWorld!\r\n" +
+		"\r\n" +
+		"data\r\n" +
+		"\r\n"
+
+	got, err := msg.Bytes()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if string(got) != golden {
+		t.Errorf("Unexpected output.\nGot:\n%q\nExpected:\n%q", got, golden)
+	}
+
+	// Round trip
+	parsed, err := ParseMessage(bytes.NewReader(got))
+	if err != nil {
+		t.Fatalf("Unexpected parse error: %s", err)
+	}
+	if again, _ := parsed.Bytes(); !bytes.Equal(again, got) {
+		t.Errorf("Round trip mismatch.\nGot:\n%q\nExpected:\n%q", again, got)
+	}
+
+	msg.Header.Del(HEADER_MID)
+	if _, err := msg.Bytes(); err == nil {
+		t.Errorf("Expected error for missing MID")
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// The metrics reported to a MetricsCollector, named according to the Prometheus conventions.
+const (
+	MetricSessions          = "wl2k_sessions_total"             // Counter: Exchanges started
+	MetricSessionErrors     = "wl2k_session_errors_total"       // Counter: Exchanges failed
+	MetricLoginFailures     = "wl2k_login_failures_total"       // Counter: Exchanges failed due to secure login
+	MetricMessagesReceived  = "wl2k_messages_received_total"    // Counter: Messages received
+	MetricMessagesSent      = "wl2k_messages_sent_total"        // Counter: Messages sent
+	MetricBytesReceived     = "wl2k_bytes_received_total"       // Counter: Compressed bytes of the messages received
+	MetricBytesSent         = "wl2k_bytes_sent_total"           // Counter: Compressed bytes of the messages sent
+	MetricHandshakeDuration = "wl2k_handshake_duration_seconds" // Observation: Duration of successful handshakes
+)
+
+// MetricsCollector receives the metrics of a session (see Session.SetMetricsCollector).
+//
+// The collector decides how the metrics are stored and exposed, so that the session does
+// not depend on a metrics library. Implementations must be safe for concurrent use if shared
+// by sessions running concurrently.
+type MetricsCollector interface {
+	// Add adds delta to the named counter.
+	Add(name string, delta float64)
+
+	// Observe records an observation (i.e. a duration in seconds) of the named histogram.
+	Observe(name string, value float64)
+}
+
+// SetMetricsCollector sets the collector receiving the session's metrics (see the Metric consts).
+func (s *Session) SetMetricsCollector(c MetricsCollector) { s.metrics = c }
+
+// addMetric adds delta to the named counter of the metrics collector (if any).
+func (s *Session) addMetric(name string, delta float64) {
+	if s.metrics != nil {
+		s.metrics.Add(name, delta)
+	}
+}
+
+// observeMetric records an observation of the named histogram of the metrics collector (if any).
+func (s *Session) observeMetric(name string, value float64) {
+	if s.metrics != nil {
+		s.metrics.Observe(name, value)
+	}
+}
+
+// MetricsRegistry is an in-memory MetricsCollector, exposing the metrics in the Prometheus text format.
+//
+// Observations are exposed as summaries (sum and count), as no buckets are known. Use an adapter of
+// MetricsCollector for a metrics library to get proper histograms.
+type MetricsRegistry struct {
+	mu       sync.Mutex
+	counters map[string]float64
+	sums     map[string]float64
+	counts   map[string]uint64
+}
+
+// NewMetricsRegistry returns a new, empty MetricsRegistry.
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{
+		counters: make(map[string]float64),
+		sums:     make(map[string]float64),
+		counts:   make(map[string]uint64),
+	}
+}
+
+// Add adds delta to the named counter.
+func (r *MetricsRegistry) Add(name string, delta float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counters[name] += delta
+}
+
+// Observe records an observation of the named histogram.
+func (r *MetricsRegistry) Observe(name string, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sums[name] += value
+	r.counts[name]++
+}
+
+// Counter returns the value of the named counter.
+func (r *MetricsRegistry) Counter(name string) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counters[name]
+}
+
+// Observations returns the sum and the number of observations of the named histogram.
+func (r *MetricsRegistry) Observations(name string) (sum float64, count uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sums[name], r.counts[name]
+}
+
+// WriteTo writes the metrics to w in the Prometheus text exposition format, sorted by name.
+func (r *MetricsRegistry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var n int64
+	write := func(format string, args ...interface{}) error {
+		m, err := fmt.Fprintf(w, format, args...)
+		n += int64(m)
+		return err
+	}
+
+	for _, name := range sortedKeys(r.counters) {
+		if err := write("# TYPE %s counter\n%s %g\n", name, name, r.counters[name]); err != nil {
+			return n, err
+		}
+	}
+	for _, name := range sortedKeys(r.sums) {
+		if err := write("# TYPE %s summary\n%s_sum %g\n%s_count %d\n", name, name, r.sums[name], name, r.counts[name]); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,80 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestSessionMetrics(t *testing.T) {
+	out := newTestMessage("LA5NTA", "N0CALL", 100)
+	in := newTestMessage("N0CALL", "LA5NTA", 2000)
+	outProp, _ := out.Proposal(Wl2kProposal)
+	inProp, _ := in.Proposal(Wl2kProposal)
+
+	metrics := NewMetricsRegistry()
+	client := NewSession("LA5NTA", "N0CALL", "JO39EQ", newMemMBox(out))
+	client.SetMetricsCollector(metrics)
+	master := NewSession("N0CALL", "LA5NTA", "JO39EQ", newMemMBox(in))
+	exchange(t, client, master)
+
+	expect := map[string]float64{
+		MetricSessions:         1,
+		MetricSessionErrors:    0,
+		MetricLoginFailures:    0,
+		MetricMessagesSent:     1,
+		MetricMessagesReceived: 1,
+		MetricBytesSent:        float64(outProp.compressedSize),
+		MetricBytesReceived:    float64(inProp.compressedSize),
+	}
+	for name, value := range expect {
+		if got := metrics.Counter(name); got != value {
+			t.Errorf("%s: Expected %g, got %g", name, value, got)
+		}
+	}
+	if _, n := metrics.Observations(MetricHandshakeDuration); n != 1 {
+		t.Errorf("Expected 1 handshake duration observation, got %d", n)
+	}
+
+	var buf bytes.Buffer
+	if _, err := metrics.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE wl2k_sessions_total counter\nwl2k_sessions_total 1\n",
+		"# TYPE wl2k_handshake_duration_seconds summary\n",
+		"wl2k_handshake_duration_seconds_count 1\n",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("Expected %q in the text format, got:\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestSessionMetricsLoginFailure(t *testing.T) {
+	client, master := tcpPipe(t)
+
+	metrics := NewMetricsRegistry()
+	cs := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+	cs.SetLogger(log.New(ioutil.Discard, "", 0))
+	cs.SetSecureLoginHandleFunc(func() (string, error) { return "wrong", nil })
+	cs.SetMetricsCollector(metrics)
+	ms := NewSession("N0CALL", "LA5NTA", "JO39EQ", nil)
+	ms.SetLogger(log.New(ioutil.Discard, "", 0))
+	ms.SetSecureLoginVerifier(func(string) (string, error) { return "foobar", nil })
+	if _, _, cErr, mErr := exchangeConns(cs, ms, client, master); cErr == nil || mErr == nil {
+		t.Fatalf("Expected the exchange to fail, got %v, %v", cErr, mErr)
+	}
+
+	for name, value := range map[string]float64{MetricSessions: 1, MetricSessionErrors: 1, MetricLoginFailures: 1} {
+		if got := metrics.Counter(name); got != value {
+			t.Errorf("%s: Expected %g, got %g", name, value, got)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"crypto/md5"
 	"encoding/base32"
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -22,3 +23,24 @@ func GenerateMid(callsign string) string {
 func midPayload(callsign string, t time.Time) []byte {
 	return []byte(fmt.Sprintf("%s-%s", time.Now(), callsign))
 }
+
+// MIDMismatchError is returned when a received message's MID does not match the MID given in the proposal.
+type MIDMismatchError struct {
+	Proposed string // The MID given in the proposal.
+	Received string // The MID of the received message.
+}
+
+func (e *MIDMismatchError) Error() string {
+	return fmt.Sprintf("MID mismatch: %s was proposed, but %s was received", e.Proposed, e.Received)
+}
+
+// verifyMID checks that the MID of msg matches the MID of the proposal it was received for.
+//
+// Both sides of the session use the MID to reference the message, so a mismatch would
+// cause the message to be acknowledged under the wrong identifier.
+func verifyMID(p *Proposal, msg *Message) error {
+	if !strings.EqualFold(p.MID(), msg.MID()) {
+		return &MIDMismatchError{Proposed: p.MID(), Received: msg.MID()}
+	}
+	return nil
+}
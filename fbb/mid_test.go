@@ -0,0 +1,91 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"testing"
+)
+
+func TestGenerateMid(t *testing.T) {
+	valid := regexp.MustCompile(`^[A-Z2-7]{12}$`)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		mid := GenerateMid("LA5NTA")
+		if !valid.MatchString(mid) {
+			t.Errorf("Invalid MID: %q", mid)
+		}
+		seen[mid] = true
+	}
+	if len(seen) < 100 {
+		t.Errorf("Expected unique MIDs, got %d duplicates", 100-len(seen))
+	}
+}
+
+func TestSessionInboundMIDMismatch(t *testing.T) {
+	for _, mismatch := range []bool{false, true} {
+		msg := newTestMessage("N0CALL", "LA5NTA", 500)
+		mid := msg.MID()
+		if mismatch {
+			mid = GenerateMid("N0CALL")
+		}
+
+		// The compressed transfer, as written by the remote
+		data, _ := msg.Bytes()
+		prop := NewProposal(mid, msg.Subject(), Wl2kProposal, data)
+		var transfer bytes.Buffer
+		sender := NewSession("N0CALL", "LA5NTA", "JO39EQ", nil)
+		sender.SetLogger(log.New(ioutil.Discard, "", 0))
+		if err := sender.writeCompressed(struct {
+			io.Reader
+			io.Writer
+		}{nil, &transfer}, prop); err != nil {
+			t.Fatalf("Unable to prepare transfer: %s", err)
+		}
+
+		client, srv := tcpPipe(t)
+		mbox := newMemMBox()
+		errs := make(chan error)
+		go func() {
+			_, err := NewSession("LA5NTA", "N0CALL", "JO39EQ", mbox).Exchange(client)
+			errs <- err
+		}()
+
+		line := fmt.Sprintf("FC EM %s %d %d 0\r", prop.MID(), prop.size, prop.compressedSize)
+		var checksum int
+		for _, c := range line {
+			checksum += int(c)
+		}
+		fmt.Fprint(srv, "[WL2K-2.8.4.8-B2FWIHJM$]\rCMS >\r")
+		fmt.Fprintf(srv, "%sF> %02X\r", line, (-checksum)&0xff)
+		srv.Write(transfer.Bytes())
+		fmt.Fprint(srv, "FQ\r")
+
+		err := <-errs
+		srv.Close()
+
+		if !mismatch {
+			if err != nil {
+				t.Errorf("Unexpected error: %s", err)
+			} else if inbox := mbox.inbox(); len(inbox) != 1 || inbox[0].MID() != prop.MID() {
+				t.Errorf("Expected %s to be received", prop.MID())
+			}
+			continue
+		}
+
+		if e, ok := err.(*MIDMismatchError); !ok || e.Proposed != mid || e.Received != msg.MID() {
+			t.Errorf("Expected MIDMismatchError, got %#v", err)
+		}
+		if len(mbox.inbox()) > 0 {
+			t.Errorf("Expected mismatching message to be discarded")
+		}
+	}
+}
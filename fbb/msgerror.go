@@ -0,0 +1,85 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MessageError is an error handling a single message during an exchange.
+type MessageError struct {
+	MID string // The MID of the message.
+	Err error  // The underlying error.
+}
+
+func (e *MessageError) Error() string { return fmt.Sprintf("%s: %s", e.MID, e.Err) }
+
+// MarshalJSON encodes the error with the underlying error as a string.
+func (e *MessageError) MarshalJSON() ([]byte, error) {
+	var errStr string
+	if e.Err != nil {
+		errStr = e.Err.Error()
+	}
+	return json.Marshal(struct {
+		MID string
+		Err string
+	}{e.MID, errStr})
+}
+
+// Unwrap returns the underlying error.
+func (e *MessageError) Unwrap() error { return e.Err }
+
+// MessageErrors is a collection of the per-message errors seen during an exchange.
+//
+// It is returned by Exchange when enabled by Session.SetReturnMessageErrors.
+type MessageErrors []*MessageError
+
+func (e MessageErrors) Error() string {
+	strs := make([]string, len(e))
+	for i, err := range e {
+		strs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d message error(s): %s", len(e), strings.Join(strs, "; "))
+}
+
+// Is reports whether any of the errors matches target.
+func (e MessageErrors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first error that matches target, and if so, sets target to that error value and returns true.
+func (e MessageErrors) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetReturnMessageErrors sets whether Exchange should return the per-message errors of an otherwise successful exchange.
+//
+// Per-message errors (i.e. an invalid outbound message that was skipped) does not
+// abort the exchange, and are always reported in TrafficStats.Errors. When enabled,
+// Exchange also returns them combined as MessageErrors. Errors aborting the exchange
+// are returned as is.
+func (s *Session) SetReturnMessageErrors(ret bool) { s.returnMsgErrors = ret }
+
+// messageFailed records a per-message error. Only the first error of each message is recorded.
+func (s *Session) messageFailed(mid string, err error) {
+	if s.failed[mid] {
+		return
+	}
+	s.failed[mid] = true
+	s.trafficStats.Errors = append(s.trafficStats.Errors, &MessageError{MID: mid, Err: err})
+}
@@ -0,0 +1,67 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"errors"
+	"sort"
+	"testing"
+)
+
+func TestSessionMessageErrors(t *testing.T) {
+	for _, ret := range []bool{false, true} {
+		client, master := tcpPipe(t)
+
+		noSubject := newTestMessage("LA5NTA", "N0CALL", 100)
+		noSubject.SetSubject("")
+		noBody := newTestMessage("LA5NTA", "N0CALL", 0)
+		valid := newTestMessage("LA5NTA", "N0CALL", 100)
+
+		cs := NewSession("LA5NTA", "N0CALL", "JO39EQ", newMemMBox(noSubject, valid, noBody))
+		cs.SetReturnMessageErrors(ret)
+		mbox := newMemMBox()
+		ms := NewSession("N0CALL", "LA5NTA", "JO39EQ", mbox)
+		ms.IsMaster(true)
+
+		merrs := make(chan error, 1)
+		go func() { _, err := ms.Exchange(master); merrs <- err }()
+		stats, err := cs.Exchange(client)
+		if err := <-merrs; err != nil {
+			t.Fatalf("ret=%t: Master exchange failed: %s", ret, err)
+		}
+
+		// Every error is reported, and the valid message is still delivered
+		var failed []string
+		for _, e := range stats.Errors {
+			failed = append(failed, e.MID)
+			if _, ok := e.Err.(ValidationError); !ok {
+				t.Errorf("ret=%t: Expected ValidationError for %s, got %v", ret, e.MID, e.Err)
+			}
+		}
+		expected := []string{noSubject.MID(), noBody.MID()}
+		sort.Strings(failed)
+		sort.Strings(expected)
+		if len(failed) != 2 || failed[0] != expected[0] || failed[1] != expected[1] {
+			t.Errorf("ret=%t: Expected errors for %v, got %v", ret, expected, failed)
+		}
+		if len(mbox.inbox()) != 1 || mbox.inbox()[0].MID() != valid.MID() {
+			t.Errorf("ret=%t: Expected the valid message to be delivered", ret)
+		}
+
+		switch {
+		case !ret && err != nil:
+			t.Errorf("Unexpected error: %s", err)
+		case ret:
+			merr, ok := err.(MessageErrors)
+			if !ok || len(merr) != 2 {
+				t.Fatalf("Expected MessageErrors with 2 errors, got %v", err)
+			}
+			var verr ValidationError
+			if !errors.As(err, &verr) {
+				t.Errorf("Expected MessageErrors to match ValidationError")
+			}
+		}
+	}
+}
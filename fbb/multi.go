@@ -0,0 +1,281 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// Gateway is a remote node to exchange messages with (see MultiExchange).
+type Gateway struct {
+	Targetcall string // The gateway's call sign.
+
+	// Dial connects to the gateway.
+	Dial func(ctx context.Context) (net.Conn, error)
+}
+
+// MultiExchangeConfig holds the configuration of a MultiExchange.
+type MultiExchangeConfig struct {
+	Mycall  string
+	Locator string
+	Handler MBoxHandler // The mailbox shared by all exchanges.
+
+	// Auxiliary addresses to request messages on behalf of (see Session.AddAuxiliaryAddress).
+	AuxAddrs []Address
+
+	// The max number of concurrent exchanges. Zero or one exchanges with one gateway at a time, in the given order.
+	Concurrency int
+
+	// If set, Configure is called with each session before the exchange starts (i.e. for Session.SetPassword).
+	Configure func(s *Session, gw Gateway)
+}
+
+// GatewayResult holds the outcome of the exchange with a single gateway.
+type GatewayResult struct {
+	Targetcall string
+	Stats      TrafficStats
+	Err        error // Non-nil if the exchange failed.
+}
+
+// MergedResult holds the outcome of a MultiExchange.
+type MergedResult struct {
+	Received []string // Received message MIDs, without duplicates.
+	Sent     []string // Sent message MIDs, without duplicates.
+
+	Gateways []GatewayResult // The result of every gateway, in the given order.
+}
+
+// ErrNoGateways is returned by MultiExchange when no gateways are given.
+var ErrNoGateways = errors.New("No gateways given")
+
+// MultiExchange exchanges messages with every gateway, using the same mailbox and auxiliary addresses.
+//
+// The mailbox is shared by all exchanges, and its methods are never called concurrently. Messages are
+// deduplicated by MID (BID) across the exchanges: An inbound message received from one gateway is
+// rejected by the others, and an outbound message is only proposed to one gateway at a time. A message
+// deferred by a gateway is not proposed to it again, but may be sent to another. The mailbox's SetDeferred is
+// called after the last exchange, for the deferred messages not sent to any gateway.
+//
+// The exchanges are aborted (see Session.Close) when ctx is done. An exchange failing does not affect
+// the others. The errors are reported in MergedResult.Gateways, and an error is only returned if every
+// exchange failed (the error of the first gateway).
+func MultiExchange(ctx context.Context, gateways []Gateway, cfg MultiExchangeConfig) (MergedResult, error) {
+	result := MergedResult{Gateways: make([]GatewayResult, len(gateways))}
+	if len(gateways) == 0 {
+		return result, ErrNoGateways
+	}
+
+	concurrency := cfg.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	m := &multiMBox{
+		h:        cfg.Handler,
+		inbound:  make(map[string]*Gateway),
+		outbound: make(map[string]*Gateway),
+		received: make(map[string]bool),
+		sent:     make(map[string]bool),
+		deferred: make(map[string]map[*Gateway]bool),
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for i := range gateways {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			result.Gateways[i] = GatewayResult{Targetcall: gateways[i].Targetcall, Err: ctx.Err()}
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			result.Gateways[i] = m.exchange(ctx, &gateways[i], cfg)
+		}(i)
+	}
+	wg.Wait()
+	m.setDeferred()
+
+	result.Received, result.Sent = m.receivedMIDs, m.sentMIDs
+	for _, gw := range result.Gateways {
+		if gw.Err == nil {
+			return result, nil
+		}
+	}
+	return result, result.Gateways[0].Err
+}
+
+// multiMBox is the MBoxHandler shared by the sessions of a MultiExchange.
+//
+// It serializes the calls to the underlying handler, and keeps track of the messages
+// claimed by each gateway (the messages being proposed).
+type multiMBox struct {
+	mu       sync.Mutex
+	h        MBoxHandler
+	inbound  map[string]*Gateway // Inbound MIDs accepted from a gateway, awaiting transfer
+	outbound map[string]*Gateway // Outbound MIDs proposed to a gateway, awaiting confirmation
+	received map[string]bool
+	sent     map[string]bool
+	deferred map[string]map[*Gateway]bool // Outbound MIDs deferred by each gateway
+
+	receivedMIDs, sentMIDs, deferredMIDs []string
+}
+
+func (m *multiMBox) exchange(ctx context.Context, gw *Gateway, cfg MultiExchangeConfig) GatewayResult {
+	result := GatewayResult{Targetcall: gw.Targetcall}
+
+	conn, err := gw.Dial(ctx)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	s := NewSession(cfg.Mycall, gw.Targetcall, cfg.Locator, &gatewayMBox{m, gw})
+	s.AddAuxiliaryAddress(cfg.AuxAddrs...)
+	if cfg.Configure != nil {
+		cfg.Configure(s, *gw)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-done:
+		}
+	}()
+
+	result.Stats, result.Err = s.Exchange(conn)
+	m.release(gw)
+	return result
+}
+
+// release releases the messages claimed by the gateway.
+func (m *multiMBox) release(gw *Gateway) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for mid, owner := range m.inbound {
+		if owner == gw {
+			delete(m.inbound, mid)
+		}
+	}
+	for mid, owner := range m.outbound {
+		if owner == gw {
+			delete(m.outbound, mid)
+		}
+	}
+}
+
+// setDeferred marks the messages deferred by a gateway, and not sent to any other, as deferred.
+func (m *multiMBox) setDeferred() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, mid := range m.deferredMIDs {
+		if !m.sent[mid] {
+			m.h.SetDeferred(mid)
+		}
+	}
+}
+
+// gatewayMBox is the MBoxHandler of the session with a single gateway.
+type gatewayMBox struct {
+	*multiMBox
+	gw *Gateway
+}
+
+func (g *gatewayMBox) Prepare() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.h.Prepare()
+}
+
+func (g *gatewayMBox) GetOutbound(fw ...Address) []*Message {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var msgs []*Message
+	for _, msg := range g.h.GetOutbound(fw...) {
+		if owner, ok := g.outbound[msg.MID()]; g.sent[msg.MID()] || ok && owner != g.gw {
+			continue // Sent or being proposed to another gateway
+		}
+		if g.deferred[msg.MID()][g.gw] {
+			continue // Deferred by this gateway
+		}
+		g.outbound[msg.MID()] = g.gw
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func (g *gatewayMBox) SetSent(MID string, rejected bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.outbound, MID)
+	if !g.sent[MID] {
+		g.sent[MID] = true
+		if !rejected {
+			g.sentMIDs = append(g.sentMIDs, MID)
+		}
+	}
+	g.h.SetSent(MID, rejected)
+}
+
+func (g *gatewayMBox) SetDeferred(MID string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.outbound, MID)
+	if g.deferred[MID] == nil {
+		g.deferred[MID] = make(map[*Gateway]bool)
+		g.deferredMIDs = append(g.deferredMIDs, MID)
+	}
+	g.deferred[MID][g.gw] = true
+}
+
+func (g *gatewayMBox) GetInboundAnswer(p Proposal) ProposalAnswer {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	switch owner, ok := g.inbound[p.MID()]; {
+	case g.received[p.MID()]:
+		return Reject // Already received from another gateway
+	case ok && owner != g.gw:
+		return Defer // Being received from another gateway
+	}
+
+	answer := g.h.GetInboundAnswer(p)
+	if answer == Accept {
+		g.inbound[p.MID()] = g.gw
+	}
+	return answer
+}
+
+func (g *gatewayMBox) ProcessInbound(msgs ...*Message) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var unique []*Message
+	for _, msg := range msgs {
+		if !g.received[msg.MID()] {
+			unique = append(unique, msg)
+		}
+	}
+	if err := g.h.ProcessInbound(unique...); err != nil {
+		return err
+	}
+	for _, msg := range unique {
+		delete(g.inbound, msg.MID())
+		g.received[msg.MID()] = true
+		g.receivedMIDs = append(g.receivedMIDs, msg.MID())
+	}
+	return nil
+}
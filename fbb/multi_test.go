@@ -0,0 +1,158 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestMultiExchange(t *testing.T) {
+	for _, concurrency := range []int{1, 2} {
+		x, y, z := newTestMessage("LE1OF", "LA5NTA", 100), newTestMessage("LE1OF", "LA5NTA", 200), newTestMessage("LE1OF", "LA5NTA", 300)
+		out := newTestMessage("LA5NTA", "N0CALL", 400)
+
+		// Two gateways offering overlapping messages, and one failing to connect
+		gwMBoxes := []*memMBox{newMemMBox(x, y), newMemMBox(y, z)}
+		gatewayErrs := make(chan error, len(gwMBoxes))
+		var gateways []Gateway
+		for i, mbox := range gwMBoxes {
+			mbox, call := mbox, []string{"N0CALL", "N1CALL"}[i]
+			gateways = append(gateways, Gateway{
+				Targetcall: call,
+				Dial: func(ctx context.Context) (net.Conn, error) {
+					client, srv := tcpPipe(t)
+					go func() {
+						s := NewSession(call, "LA5NTA", "JO39EQ", mbox)
+						s.IsMaster(true)
+						_, err := s.Exchange(srv)
+						gatewayErrs <- err
+					}()
+					return client, nil
+				},
+			})
+		}
+		errDial := errors.New("no route")
+		gateways = append(gateways, Gateway{Targetcall: "N2CALL", Dial: func(context.Context) (net.Conn, error) { return nil, errDial }})
+
+		mbox := newMemMBox(out)
+		mbox.answerFunc = func(Proposal) ProposalAnswer { return Accept } // Leave deduplication to MultiExchange
+		result, err := MultiExchange(context.Background(), gateways, MultiExchangeConfig{
+			Mycall:      "LA5NTA",
+			Locator:     "JO39EQ",
+			Handler:     mbox,
+			Concurrency: concurrency,
+		})
+		if err != nil {
+			t.Fatalf("concurrency=%d: Unexpected error: %s", concurrency, err)
+		}
+		for range gwMBoxes {
+			if err := <-gatewayErrs; err != nil {
+				t.Errorf("concurrency=%d: Unexpected gateway error: %s", concurrency, err)
+			}
+		}
+
+		var received []string
+		for _, msg := range mbox.inbox() {
+			received = append(received, msg.MID())
+		}
+		sort.Strings(received)
+		sort.Strings(result.Received)
+		expect := []string{x.MID(), y.MID(), z.MID()}
+		sort.Strings(expect)
+		switch {
+		case !reflect.DeepEqual(received, expect):
+			t.Errorf("concurrency=%d: Expected %v to be stored once, got %v", concurrency, expect, received)
+		case !reflect.DeepEqual(result.Received, expect):
+			t.Errorf("concurrency=%d: Expected merged received %v, got %v", concurrency, expect, result.Received)
+		case !reflect.DeepEqual(result.Sent, []string{out.MID()}):
+			t.Errorf("concurrency=%d: Expected merged sent [%s], got %v", concurrency, out.MID(), result.Sent)
+		case len(gwMBoxes[0].inbox())+len(gwMBoxes[1].inbox()) != 1:
+			t.Errorf("concurrency=%d: Expected the outbound message to be sent to one gateway only", concurrency)
+		case len(result.Gateways) != 3 || result.Gateways[2].Err != errDial:
+			t.Errorf("concurrency=%d: Expected the dial error of the last gateway, got %+v", concurrency, result.Gateways)
+		}
+	}
+}
+
+func TestMultiExchangeAllFailed(t *testing.T) {
+	errDial := errors.New("no route")
+	dial := func(context.Context) (net.Conn, error) { return nil, errDial }
+
+	_, err := MultiExchange(context.Background(), []Gateway{{"N0CALL", dial}, {"N1CALL", dial}}, MultiExchangeConfig{Mycall: "LA5NTA", Handler: newMemMBox()})
+	if err != errDial {
+		t.Errorf("Expected the dial error, got %v", err)
+	}
+	if _, err := MultiExchange(context.Background(), nil, MultiExchangeConfig{}); err != ErrNoGateways {
+		t.Errorf("Expected ErrNoGateways, got %v", err)
+	}
+}
+
+func TestMultiExchangeDeferred(t *testing.T) {
+	out := newTestMessage("LA5NTA", "N0CALL", 100)
+
+	// gateways returns gateways answering the outbound proposal with the given answers, in order
+	gateways := func(answers ...ProposalAnswer) ([]Gateway, []*memMBox) {
+		var gateways []Gateway
+		var mboxes []*memMBox
+		for i, answer := range answers {
+			mbox, answer, call := newMemMBox(), answer, []string{"N0CALL", "N1CALL"}[i]
+			mbox.answerFunc = func(Proposal) ProposalAnswer { return answer }
+			mboxes = append(mboxes, mbox)
+			gateways = append(gateways, Gateway{
+				Targetcall: call,
+				Dial: func(ctx context.Context) (net.Conn, error) {
+					client, srv := tcpPipe(t)
+					go func() {
+						s := NewSession(call, "LA5NTA", "JO39EQ", mbox)
+						s.IsMaster(true)
+						s.Exchange(srv)
+					}()
+					return client, nil
+				},
+			})
+		}
+		return gateways, mboxes
+	}
+	nAnswered := func(m *memMBox) int {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return len(m.answered)
+	}
+
+	// Deferred by the first gateway, sent to the second
+	gws, gwMBoxes := gateways(Defer, Accept)
+	mbox := newMemMBox(out)
+	result, err := MultiExchange(context.Background(), gws, MultiExchangeConfig{Mycall: "LA5NTA", Locator: "JO39EQ", Handler: mbox})
+	switch {
+	case err != nil:
+		t.Fatalf("Unexpected error: %s", err)
+	case len(gwMBoxes[0].inbox()) != 0 || len(gwMBoxes[1].inbox()) != 1:
+		t.Errorf("Expected the deferred message to be sent to the second gateway")
+	case !reflect.DeepEqual(result.Sent, []string{out.MID()}):
+		t.Errorf("Expected merged sent [%s], got %v", out.MID(), result.Sent)
+	case mbox.deferred[out.MID()]:
+		t.Errorf("Expected the sent message not to be marked as deferred")
+	}
+
+	// Deferred by every gateway
+	gws, gwMBoxes = gateways(Defer, Defer)
+	mbox = newMemMBox(out)
+	result, err = MultiExchange(context.Background(), gws, MultiExchangeConfig{Mycall: "LA5NTA", Locator: "JO39EQ", Handler: mbox})
+	switch {
+	case err != nil:
+		t.Fatalf("Unexpected error: %s", err)
+	case nAnswered(gwMBoxes[0]) != 1 || nAnswered(gwMBoxes[1]) != 1:
+		t.Errorf("Expected the message to be proposed once to each gateway, got %d and %d", nAnswered(gwMBoxes[0]), nAnswered(gwMBoxes[1]))
+	case len(result.Sent) != 0:
+		t.Errorf("Expected no messages sent, got %v", result.Sent)
+	case !mbox.deferred[out.MID()]:
+		t.Errorf("Expected the message to be marked as deferred after the last gateway")
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import "time"
+
+// Pause holds the exchange at the start of our next turn, until Resume is called. It is safe
+// to call from another go-routine.
+//
+// The connection is kept open while paused. The remote's turns are not affected, as we must
+// keep reading what the remote sends. If the remote advertised a command timeout (see
+// RemoteSuggestedTimeout), a pause lasts at most half of it, to avoid having the remote drop
+// the connection. Otherwise the remote may time out if paused for too long, in which case
+// Exchange fails with the resulting error. Abort and Close end the pause.
+func (s *Session) Pause() {
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+	if s.resume == nil {
+		s.resume = make(chan struct{})
+	}
+}
+
+// Resume resumes an exchange held by Pause. It is safe to call from another go-routine.
+func (s *Session) Resume() {
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+	if s.resume != nil {
+		close(s.resume)
+		s.resume = nil
+	}
+}
+
+// Paused returns true if the session is paused (see Pause).
+func (s *Session) Paused() bool {
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+	return s.resume != nil
+}
+
+// waitPaused blocks while the session is paused.
+func (s *Session) waitPaused() {
+	s.pauseMu.Lock()
+	resume := s.resume
+	s.pauseMu.Unlock()
+	if resume == nil {
+		return
+	}
+
+	var timeout <-chan time.Time
+	if s.remoteTimeout > 0 {
+		timer := time.NewTimer(s.remoteTimeout / 2)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	s.log.Println("Exchange paused")
+	select {
+	case <-resume:
+		s.log.Println("Exchange resumed")
+	case <-timeout:
+		s.log.Printf("Resuming paused exchange to avoid the remote's timeout (%s)", s.remoteTimeout)
+
+		// End the pause, unless it was already ended (and maybe restarted) by Resume.
+		s.pauseMu.Lock()
+		if s.resume == resume {
+			close(resume)
+			s.resume = nil
+		}
+		s.pauseMu.Unlock()
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionPauseResume(t *testing.T) {
+	for _, abort := range []bool{false, true} {
+		clientMBox := newMemMBox(newTestMessage("LA5NTA", "N0CALL", 100), newTestMessage("LA5NTA", "N0CALL", 200))
+		client, master := tcpPipe(t)
+
+		// Signal when the client holds the exchange
+		held := make(chan struct{}, 1)
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", clientMBox)
+		s.SetMaxInFlight(1) // One message per turn
+		s.SetLogger(log.New(writeFunc(func(p []byte) (int, error) {
+			if strings.Contains(string(p), "Exchange paused") {
+				held <- struct{}{}
+			}
+			return len(p), nil
+		}), "", 0))
+		events := s.Events()
+
+		// Pause from another go-routine when the first message is sent
+		paused := make(chan struct{})
+		go func() {
+			for e := range events {
+				if e.Type == MessageCompleted && e.Direction == Outbound {
+					s.Pause()
+					close(paused)
+					return
+				}
+			}
+		}()
+
+		// The master stores the first message when the pause is in effect, so that the
+		// client can't start its next turn before Pause is called.
+		var mu sync.Mutex
+		var received []*Message
+		m := NewSession("N0CALL", "LA5NTA", "JO39EQ", nil)
+		m.IsMaster(true)
+		m.SetMessageSink(funcSink(func(msg *Message) error {
+			<-paused
+			mu.Lock()
+			defer mu.Unlock()
+			received = append(received, msg)
+			return nil
+		}))
+		nReceived := func() int {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(received)
+		}
+
+		clientErrs, masterErrs := make(chan error, 1), make(chan error, 1)
+		go func() {
+			_, err := s.Exchange(client)
+			clientErrs <- err
+		}()
+		go func() {
+			_, err := m.Exchange(master)
+			masterErrs <- err
+		}()
+
+		// The second message should be held until resumed
+		select {
+		case <-held:
+		case err := <-clientErrs:
+			t.Fatalf("abort=%t: Exchange returned before pausing: %v", abort, err)
+		}
+		if n := nReceived(); n != 1 {
+			t.Errorf("abort=%t: Expected 1 message transferred before pausing, got %d", abort, n)
+		}
+
+		if abort {
+			s.Abort()
+			if err := <-clientErrs; err != ErrAborted {
+				t.Errorf("Expected ErrAborted, got %v", err)
+			}
+			<-masterErrs
+			if n := nReceived(); n != 1 {
+				t.Errorf("Expected 1 message transferred before abort, got %d", n)
+			}
+			continue
+		}
+
+		s.Resume()
+		if err := <-clientErrs; err != nil {
+			t.Errorf("Unexpected client error: %s", err)
+		}
+		if err := <-masterErrs; err != nil {
+			t.Errorf("Unexpected master error: %s", err)
+		}
+		if n := nReceived(); n != 2 {
+			t.Errorf("Expected 2 messages transferred after resume, got %d", n)
+		}
+	}
+}
+
+func TestSessionPauseRemoteTimeout(t *testing.T) {
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+	s.remoteTimeout = 50 * time.Millisecond
+	s.Pause()
+
+	done := make(chan struct{})
+	go func() {
+		s.waitPaused()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the pause to end before the remote's timeout")
+	}
+	if s.Paused() {
+		t.Errorf("Expected the session to be resumed after the remote's timeout")
+	}
+
+	// The next turn must not be held by the expired pause
+	s.remoteTimeout = time.Hour
+	done = make(chan struct{})
+	go func() {
+		s.waitPaused()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the next turn not to wait after the pause expired")
+	}
+}
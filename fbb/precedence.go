@@ -0,0 +1,82 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Precedence is the precedence (priority) of a message.
+//
+// Winlink has no header or proposal field for the precedence. It is given as a prefix to the
+// subject (i.e. "//WL2K P/ Subject"), so it's part of the proposal title, and survives relaying
+// by nodes unaware of it.
+type Precedence int
+
+const (
+	Routine   Precedence = iota // The default (no prefix, or //WL2K R/)
+	Priority                    // //WL2K P/
+	Immediate                   // //WL2K O/
+	Flash                       // //WL2K Z/
+)
+
+var precedenceCodes = map[Precedence]string{Routine: "R", Priority: "P", Immediate: "O", Flash: "Z"}
+
+var precedenceRe = regexp.MustCompile(`(?i)^//WL2K ([RPOZ])/\s*`)
+
+func (p Precedence) String() string {
+	switch p {
+	case Routine:
+		return "Routine"
+	case Priority:
+		return "Priority"
+	case Immediate:
+		return "Immediate"
+	case Flash:
+		return "Flash"
+	default:
+		return "Unknown"
+	}
+}
+
+// parsePrecedence returns the precedence given by the subject prefix (if any), and the subject without it.
+func parsePrecedence(subject string) (Precedence, string) {
+	match := precedenceRe.FindStringSubmatch(subject)
+	if match == nil {
+		return Routine, subject
+	}
+	for p, code := range precedenceCodes {
+		if strings.EqualFold(code, match[1]) {
+			return p, subject[len(match[0]):]
+		}
+	}
+	return Routine, subject
+}
+
+// Precedence returns the message's precedence, as given by the subject prefix (Routine if none).
+func (m *Message) Precedence() Precedence {
+	p, _ := parsePrecedence(m.Subject())
+	return p
+}
+
+// SetPrecedence sets the message's precedence by replacing the subject prefix.
+//
+// Routine messages are given no prefix.
+func (m *Message) SetPrecedence(p Precedence) {
+	_, subject := parsePrecedence(m.Subject())
+	if code, ok := precedenceCodes[p]; ok && p != Routine {
+		subject = "//WL2K " + code + "/ " + subject
+	}
+	m.SetSubject(subject)
+}
+
+// Precedence returns the precedence of the proposed message, as given by the title (Routine if unknown).
+//
+// The title of an inbound proposal is not known until the message is received.
+func (p *Proposal) Precedence() Precedence {
+	prec, _ := parsePrecedence(p.title)
+	return prec
+}
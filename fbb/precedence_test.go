@@ -0,0 +1,72 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import "testing"
+
+func TestMessagePrecedence(t *testing.T) {
+	tests := map[string]Precedence{
+		"Hello":               Routine,
+		"//WL2K R/ Hello":     Routine,
+		"//WL2K P/ Hello":     Priority,
+		"//wl2k o/Hello":      Immediate,
+		"//WL2K Z/ Hello":     Flash,
+		"//WL2K X/ Hello":     Routine,
+		"Re: //WL2K Z/ Hello": Routine,
+	}
+	for subject, expect := range tests {
+		msg := NewMessage(Private, "LA5NTA")
+		msg.SetSubject(subject)
+		if got := msg.Precedence(); got != expect {
+			t.Errorf("%q: Expected %s, got %s", subject, expect, got)
+		}
+	}
+
+	msg := NewMessage(Private, "LA5NTA")
+	msg.SetSubject("//WL2K P/ Hello")
+	msg.SetPrecedence(Flash)
+	if got := msg.Subject(); got != "//WL2K Z/ Hello" {
+		t.Errorf("Unexpected subject: %q", got)
+	}
+	msg.SetPrecedence(Routine)
+	if got := msg.Subject(); got != "Hello" {
+		t.Errorf("Unexpected subject: %q", got)
+	}
+}
+
+func TestSessionPrecedenceOrder(t *testing.T) {
+	routine := newTestMessage("LA5NTA", "N0CALL", 100)
+	priority := newTestMessage("LA5NTA", "N0CALL", 2000)
+	priority.SetPrecedence(Priority)
+	flash := newTestMessage("LA5NTA", "N0CALL", 1000)
+	flash.SetPrecedence(Flash)
+
+	masterMBox := newMemMBox()
+
+	client := NewSession("LA5NTA", "N0CALL", "JO39EQ", newMemMBox(routine, priority, flash))
+	master := NewSession("N0CALL", "LA5NTA", "JO39EQ", masterMBox)
+	exchange(t, client, master)
+
+	// Offered by precedence, not size
+	expect := []string{flash.MID(), priority.MID(), routine.MID()}
+	if len(masterMBox.answered) != len(expect) {
+		t.Fatalf("Expected %d proposals, got %d", len(expect), len(masterMBox.answered))
+	}
+	for i, p := range masterMBox.answered {
+		if p.MID() != expect[i] {
+			t.Errorf("Proposal %d: Expected %s, got %s", i, expect[i], p.MID())
+		}
+	}
+
+	received := make(map[string]Precedence)
+	for _, msg := range masterMBox.inbox() {
+		received[msg.MID()] = msg.Precedence()
+	}
+	for _, msg := range []*Message{routine, priority, flash} {
+		if got, ok := received[msg.MID()]; !ok || got != msg.Precedence() {
+			t.Errorf("%s: Expected precedence %s to survive the transfer, got %s", msg.MID(), msg.Precedence(), got)
+		}
+	}
+}
@@ -7,9 +7,11 @@ package fbb
 import (
 	"bytes"
 	"compress/gzip"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"strconv"
 	"strings"
 
@@ -35,6 +37,9 @@ const (
 	// Offset not supported yet
 )
 
+// MarshalText encodes the answer as the character used in the proposal answer line (i.e. "+").
+func (a ProposalAnswer) MarshalText() ([]byte, error) { return []byte{byte(a)}, nil }
+
 // Proposal is the type representing a inbound or outbound proposal.
 type Proposal struct {
 	code           PropCode
@@ -43,10 +48,20 @@ type Proposal struct {
 	answer         ProposalAnswer
 	title          string
 	offset         int
+	held           bool // True if the remote answered Defer with 'H' (hold)
 	sent           bool
 	size           int
 	compressedData []byte
 	compressedSize int
+
+	// Sender and recipient for basic (uncompressed) proposals
+	from string
+	to   string
+}
+
+// stats returns the MessageStats of the proposed message.
+func (p *Proposal) stats(dir Direction) MessageStats {
+	return MessageStats{MID: p.mid, Direction: dir, Size: p.size, CompressedSize: p.compressedSize}
 }
 
 // Constructor for a new Proposal given a Winlink Message.
@@ -68,19 +83,8 @@ func NewProposal(MID, title string, code PropCode, data []byte) *Proposal {
 		prop.title = `No title`
 	}
 
-	var (
-		z   io.WriteCloser
-		buf bytes.Buffer
-	)
-	switch prop.code {
-	case GzipProposal:
-		z, _ = gzip.NewWriterLevel(&buf, gzip.BestCompression)
-	default:
-		z = lzhuf.NewB2Writer(&buf)
-	}
-
-	z.Write(data)
-	if err := z.Close(); err != nil {
+	var buf bytes.Buffer
+	if err := compress(&buf, prop.code, data); err != nil {
 		panic(err)
 	}
 
@@ -110,6 +114,48 @@ func (p *Proposal) Title() string {
 	return p.title
 }
 
+// From returns the sender of the proposed message, if provided by the remote.
+//
+// The B2F proposal itself does not hold the sender, but the Winlink CMS announce
+// pending messages (;PM) before proposing them. The zero Address is returned if unknown.
+func (p *Proposal) From() Address {
+	if p.from == "" {
+		return Address{}
+	}
+	return AddressFromString(p.from)
+}
+
+// To returns the recipient of the proposed message, if provided by the remote.
+//
+// The zero Address is returned if unknown.
+func (p *Proposal) To() Address {
+	if p.to == "" {
+		return Address{}
+	}
+	return AddressFromString(p.to)
+}
+
+// pendingMessage holds the information given by the remote in a ;PM line.
+type pendingMessage struct {
+	to, mid, from string
+	size          int
+}
+
+// ;PM: LA5NTA TJKYEIMMHSRB 123 martin.h.pedersen@gmail.com
+func parsePendingMessage(line string) (pendingMessage, bool) {
+	if !strings.HasPrefix(line, ";PM: ") {
+		return pendingMessage{}, false
+	}
+
+	parts := strings.Fields(line[5:])
+	if len(parts) != 4 {
+		return pendingMessage{}, false
+	}
+
+	size, _ := strconv.Atoi(parts[2])
+	return pendingMessage{to: parts[0], mid: parts[1], size: size, from: parts[3]}, true
+}
+
 func (p *Proposal) Message() (*Message, error) {
 	buf := bytes.NewBuffer(p.Data())
 	m := new(Message)
@@ -119,29 +165,235 @@ func (p *Proposal) Message() (*Message, error) {
 
 // Data returns the decompressed raw message
 func (p *Proposal) Data() []byte {
-	var r io.ReadCloser
-	var err error
+	var buf bytes.Buffer
+	if err := decompress(&buf, p.code, bytes.NewReader(p.compressedData)); err != nil {
+		panic(err) //TODO: Should return error
+	}
 
-	switch p.code {
+	return buf.Bytes()
+}
+
+// CompressMessage writes msg to w in the compressed format used by the B2F protocol (lzhuf).
+func CompressMessage(w io.Writer, msg *Message) error {
+	data, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	return compress(w, Wl2kProposal, data)
+}
+
+// DecompressMessage reads and decompresses a B2F compressed message (lzhuf) from r.
+//
+// It is the inverse of CompressMessage.
+func DecompressMessage(r io.Reader) (*Message, error) {
+	var buf bytes.Buffer
+	if err := decompress(&buf, Wl2kProposal, r); err != nil {
+		return nil, err
+	}
+
+	m := new(Message)
+	err := m.ReadFrom(&buf)
+	return m, err
+}
+
+// compress writes data to w using the compression algorithm implied by the proposal code.
+func compress(w io.Writer, code PropCode, data []byte) error {
+	var z io.WriteCloser
+	switch code {
+	case BasicProposal: // Uncompressed
+		_, err := w.Write(data)
+		return err
 	case GzipProposal:
-		r, err = gzip.NewReader(bytes.NewBuffer(p.compressedData))
+		z, _ = gzip.NewWriterLevel(w, gzip.BestCompression)
 	default:
-		r, err = lzhuf.NewB2Reader(bytes.NewBuffer(p.compressedData))
+		z = lzhuf.NewB2Writer(w)
+	}
+
+	if _, err := z.Write(data); err != nil {
+		return err
 	}
+	return z.Close()
+}
+
+// decompress reads compressed data from r and writes the decompressed data to w
+// using the compression algorithm implied by the proposal code.
+func decompress(w io.Writer, code PropCode, r io.Reader) error {
+	var z io.ReadCloser
+	var err error
 
+	switch code {
+	case BasicProposal: // Uncompressed
+		_, err = io.Copy(w, r)
+		return err
+	case GzipProposal:
+		z, err = gzip.NewReader(r)
+	default:
+		z, err = lzhuf.NewB2Reader(r)
+	}
 	if err != nil {
-		panic(err) //TODO: Should return error
+		return err
+	}
+
+	if _, err := io.Copy(w, z); err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+// decompressWriter is an io.WriteCloser decompressing the data written to it into an underlying writer.
+type decompressWriter struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	err  error // The decompression result (valid after done is closed)
+	n    int   // Number of decompressed bytes written (valid after done is closed)
+}
+
+func newDecompressWriter(w io.Writer, code PropCode) *decompressWriter {
+	pr, pw := io.Pipe()
+	d := &decompressWriter{pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(d.done)
+		d.err = decompress(countingWriter{w, &d.n}, code, pr)
+		if d.err == nil {
+			_, d.err = io.Copy(ioutil.Discard, pr) // Don't block the writer on trailing data
+		}
+		pr.CloseWithError(d.err)
+	}()
+	return d
+}
+
+func (d *decompressWriter) Write(p []byte) (int, error) { return d.pw.Write(p) }
+
+// Close flushes the remaining data and returns the decompression result.
+func (d *decompressWriter) Close() error { return d.CloseWithError(nil) }
+
+// CloseWithError aborts the decompression with the given error, or completes it if err is nil.
+//
+// The decompression result is returned.
+func (d *decompressWriter) CloseWithError(err error) error {
+	d.pw.CloseWithError(err)
+	<-d.done
+	return d.err
+}
+
+// countingWriter counts the number of bytes written to the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n *int
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	*c.n += n
+	return n, err
+}
+
+// ErrSizeMismatch is returned when the size of a received message does not match the size given in the proposal.
+var ErrSizeMismatch = errors.New("Message size mismatch")
+
+// SizeMismatchError is returned when the decompressed size of a received message does not match the size given in the proposal.
+//
+// It matches ErrSizeMismatch using errors.Is.
+type SizeMismatchError struct {
+	MID      string
+	Declared int // The size given in the proposal.
+	Actual   int // The size of the received (decompressed) message.
+}
+
+func (e *SizeMismatchError) Error() string {
+	return fmt.Sprintf("Message size mismatch for %s: proposed %d bytes, got %d bytes", e.MID, e.Declared, e.Actual)
+}
+
+// Is returns true if target is ErrSizeMismatch.
+func (e *SizeMismatchError) Is(target error) bool { return target == ErrSizeMismatch }
+
+// checkSize returns a SizeMismatchError if n does not equal the proposed size.
+func (p *Proposal) checkSize(n int) error {
+	if n != p.size {
+		return &SizeMismatchError{MID: p.mid, Declared: p.size, Actual: n}
+	}
+	return nil
+}
+
+// ErrTruncatedMessage is returned when a compressed message ends before all of its data is received (i.e. the
+// remote closed the connection mid-message).
+var ErrTruncatedMessage = errors.New("Truncated message")
+
+// TruncatedMessageError is returned when a compressed message ends before all of its data is received.
+//
+// It matches ErrTruncatedMessage using errors.Is, and unwraps to the underlying read or decompression error.
+type TruncatedMessageError struct {
+	MID      string
+	Received int   // The number of compressed bytes received.
+	Expected int   // The compressed size given in the proposal.
+	Err      error // The underlying error (i.e. io.EOF).
+}
+
+func (e *TruncatedMessageError) Error() string {
+	return fmt.Sprintf("Truncated message %s: got %d of %d compressed bytes (%s)", e.MID, e.Received, e.Expected, e.Err)
+}
+
+// Is returns true if target is ErrTruncatedMessage.
+func (e *TruncatedMessageError) Is(target error) bool { return target == ErrTruncatedMessage }
+
+// Unwrap returns the underlying error.
+func (e *TruncatedMessageError) Unwrap() error { return e.Err }
+
+// ErrCompressionMismatch is returned when received data is not compressed in the format implied by the proposal.
+var ErrCompressionMismatch = errors.New("Compression format mismatch")
+
+// checkFormat performs sanity checks on the first bytes (head) of the received compressed data,
+// detecting data compressed in another format than the one proposed.
+func (p *Proposal) checkFormat(head []byte) error {
+	isGzip := len(head) >= 2 && head[0] == 0x1f && head[1] == 0x8b // The gzip magic number
+
+	switch p.code {
+	case GzipProposal:
+		if !isGzip {
+			return fmt.Errorf("%w: %s was proposed as gzip, but the data is not gzip compressed", ErrCompressionMismatch, p.mid)
+		}
+	case Wl2kProposal:
+		if isGzip {
+			return fmt.Errorf("%w: %s was proposed as lzhuf, but the data is gzip compressed", ErrCompressionMismatch, p.mid)
+		}
+		// The lzhuf header is the CRC16 followed by the uncompressed size (little endian),
+		// which lets us detect a size mismatch before decompressing.
+		if len(head) >= lzhufHeaderLength {
+			return p.checkSize(int(binary.LittleEndian.Uint32(head[2:lzhufHeaderLength])))
+		}
 	}
+	return nil
+}
 
+// inboundMessage decompresses and parses a received message, verifying the size given in the proposal.
+func (p *Proposal) inboundMessage() (*Message, error) {
 	var buf bytes.Buffer
-	if _, err := io.Copy(&buf, r); err != nil {
-		panic(err) //TODO
+	if err := decompress(&buf, p.code, bytes.NewReader(p.compressedData)); err != nil && len(p.compressedData) < p.compressedSize {
+		return nil, &TruncatedMessageError{MID: p.mid, Received: len(p.compressedData), Expected: p.compressedSize, Err: err}
+	} else if err != nil {
+		return nil, err
+	}
+	if err := p.checkSize(buf.Len()); err != nil {
+		return nil, err
 	}
 
-	return buf.Bytes()
+	// A zero-length message has no headers to parse. Keep what is known from the proposal.
+	if buf.Len() == 0 {
+		m := &Message{Header: make(Header)}
+		m.Header.Set(HEADER_MID, p.mid)
+		m.Header.Set(HEADER_BODY, "0")
+		m.SetSubject(p.title)
+		return m, nil
+	}
+
+	m := new(Message)
+	err := m.ReadFrom(&buf)
+	return m, err
 }
 
-func parseProposal(line string, prop *Proposal) (err error) {
+// parseProposal parses a proposal line. FB proposals are parsed as FBB basic proposals if basic is true.
+// Otherwise they are compressed binary proposals (B/B1), which are not supported.
+func parseProposal(line string, prop *Proposal, basic bool) (err error) {
 	if len(line) < 1 {
 		return
 	} else if line[0] != 'F' {
@@ -151,7 +403,11 @@ func parseProposal(line string, prop *Proposal) (err error) {
 	prop.code = PropCode(line[1])
 
 	switch prop.code {
-	case BasicProposal, AsciiProposal: // TODO: implement
+	case BasicProposal:
+		if basic {
+			err = parseBasicProposal(line, prop)
+		}
+	case AsciiProposal: // TODO: implement
 	case Wl2kProposal, GzipProposal:
 		err = parseB2Proposal(line, prop)
 	default:
@@ -197,3 +453,26 @@ func parseB2Proposal(line string, prop *Proposal) (err error) {
 	}
 	return
 }
+
+// FB P F6FBB FC1GHV FC1MVP 24657_F6FBB 1345
+func parseBasicProposal(line string, prop *Proposal) (err error) {
+	if len(line) < 4 || PropCode(line[1]) != BasicProposal {
+		return errors.New("Not a type B proposal")
+	}
+
+	// Type, from, @BBS, to, BID and size must all be present
+	parts := strings.Split(line[3:], " ")
+	if len(parts) != 6 {
+		return errors.New(`Malformed proposal: ` + line[2:])
+	}
+
+	prop.msgType = parts[0]
+	prop.from = parts[1]
+	prop.to = parts[3]
+	prop.mid = parts[4]
+	if prop.size, err = strconv.Atoi(parts[5]); err != nil {
+		return fmt.Errorf("Malformed size in proposal: %s", parts[5])
+	}
+	prop.compressedSize = prop.size // Uncompressed
+	return nil
+}
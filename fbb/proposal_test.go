@@ -5,6 +5,8 @@
 package fbb
 
 import (
+	"bytes"
+	"io/ioutil"
 	"reflect"
 	"testing"
 )
@@ -19,11 +21,20 @@ func TestParseProposal(t *testing.T) {
 			size:           527,
 			compressedSize: 123,
 		},
+		"FB P F6FBB FC1GHV FC1MVP 24657_F6FB 1345": Proposal{
+			code:           BasicProposal,
+			msgType:        "P",
+			mid:            "24657_F6FB",
+			size:           1345,
+			compressedSize: 1345,
+			from:           "F6FBB",
+			to:             "FC1MVP",
+		},
 	}
 
 	for input, expected := range tests {
 		got := Proposal{}
-		err := parseProposal(input, &got)
+		err := parseProposal(input, &got, true)
 		if err != nil {
 			t.Errorf("Got unexpected error while parsing proposal '%s': %s", input, err)
 		} else if !reflect.DeepEqual(got, expected) {
@@ -31,3 +42,67 @@ func TestParseProposal(t *testing.T) {
 		}
 	}
 }
+
+func TestParseProposalCompressedFB(t *testing.T) {
+	// Outside the basic protocol, FB proposals are compressed binary messages (B/B1)
+	got := Proposal{}
+	if err := parseProposal("FB P F6FBB FC1GHV FC1MVP 24657_F6FB 1345", &got, false); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if expected := (Proposal{code: BasicProposal}); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got %#v, expected %#v", got, expected)
+	}
+}
+
+func TestCompressMessageRoundtrip(t *testing.T) {
+	msg := newTestMessage("LA5NTA", "N0CALL", 10000)
+
+	var buf bytes.Buffer
+	if err := CompressMessage(&buf, msg); err != nil {
+		t.Fatalf("Unexpected error while compressing: %s", err)
+	}
+
+	got, err := DecompressMessage(&buf)
+	if err != nil {
+		t.Fatalf("Unexpected error while decompressing: %s", err)
+	}
+
+	expected, _ := msg.Bytes()
+	if data, _ := got.Bytes(); !bytes.Equal(data, expected) {
+		t.Errorf("Decompressed message does not match the original")
+	}
+}
+
+func BenchmarkCompressMessage1k(b *testing.B)   { benchmarkCompressMessage(b, 1000) }
+func BenchmarkCompressMessage10k(b *testing.B)  { benchmarkCompressMessage(b, 10000) }
+func BenchmarkCompressMessage100k(b *testing.B) { benchmarkCompressMessage(b, 100000) }
+
+func BenchmarkDecompressMessage1k(b *testing.B)   { benchmarkDecompressMessage(b, 1000) }
+func BenchmarkDecompressMessage10k(b *testing.B)  { benchmarkDecompressMessage(b, 10000) }
+func BenchmarkDecompressMessage100k(b *testing.B) { benchmarkDecompressMessage(b, 100000) }
+
+func benchmarkCompressMessage(b *testing.B, bodySize int) {
+	msg := newTestMessage("LA5NTA", "N0CALL", bodySize)
+	b.SetBytes(int64(bodySize))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := CompressMessage(ioutil.Discard, msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkDecompressMessage(b *testing.B, bodySize int) {
+	var buf bytes.Buffer
+	CompressMessage(&buf, newTestMessage("LA5NTA", "N0CALL", bodySize))
+	data := buf.Bytes()
+	b.SetBytes(int64(bodySize))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := DecompressMessage(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"fmt"
+	"strings"
+)
+
+// UnknownRecipientPolicy determines how received messages not addressed to any of our
+// addresses (the session's call sign or auxiliary addresses) are handled.
+type UnknownRecipientPolicy int
+
+const (
+	AcceptUnknownRecipient UnknownRecipientPolicy = iota // Store the message anyway (default).
+	RejectUnknownRecipient                               // Reject the proposal, or discard the message if the recipients are not known until received.
+	BounceUnknownRecipient                               // Discard the message and send a bounce to the sender.
+)
+
+// The reason recorded in TrafficStats.Refused for messages to unknown recipients.
+const unknownRecipientReason = "unknown recipient"
+
+// SetUnknownRecipientPolicy sets how received messages addressed to unknown recipients are handled.
+//
+// A message is addressed to an unknown recipient if none of its recipients is the session's call
+// sign or one of the auxiliary addresses. The recipients of compressed proposals are not known until
+// the message is received, so such messages are discarded after the transfer. Discarded messages are
+// recorded in TrafficStats.Refused.
+//
+// Bounces are sent to the remote (addressed to the sender of the discarded message) in our next turn
+// of the exchange. They are dropped if deferred by the remote, or if the exchange ends before they are sent.
+//
+// The policy does not apply to messages handled by an inbound stream (see SetInboundStreamFunc).
+// The default is AcceptUnknownRecipient.
+func (s *Session) SetUnknownRecipientPolicy(policy UnknownRecipientPolicy) {
+	s.unknownRecipient = policy
+}
+
+// isLocalRecipient returns true if addr is the session's call sign or one of the auxiliary addresses.
+func (s *Session) isLocalRecipient(addr Address) bool {
+	for _, fw := range s.localFW {
+		if fw.Proto == "" {
+			fw.Addr = s.callsign(fw.Addr)
+		}
+		if strings.EqualFold(fw.Addr, addr.Addr) && strings.EqualFold(fw.Proto, addr.Proto) {
+			return true
+		}
+	}
+	return false
+}
+
+// isUnknownRecipient returns true if the policy applies to msg, and none of its receivers are local.
+func (s *Session) isUnknownRecipient(msg *Message) bool {
+	if s.unknownRecipient == AcceptUnknownRecipient {
+		return false
+	}
+	for _, addr := range msg.Receivers() {
+		if s.isLocalRecipient(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// discardUnknownRecipient discards the received message, and queues a bounce if required by the policy.
+func (s *Session) discardUnknownRecipient(msg *Message) {
+	s.log.Printf("Discarding %s (%s)", msg.MID(), unknownRecipientReason)
+	s.trafficStats.Refused = append(s.trafficStats.Refused, Refusal{MID: msg.MID(), Answer: Reject, Reason: unknownRecipientReason})
+
+	if s.unknownRecipient != BounceUnknownRecipient || msg.From().IsZero() {
+		return
+	}
+
+	bounce := NewMessage(Private, s.Mycall())
+	bounce.SetDate(s.messageTime())
+	bounce.AddTo(msg.From().String())
+	bounce.SetSubject("Undeliverable: " + msg.Subject())
+	bounce.SetBody(fmt.Sprintf(
+		"Your message %s to %s could not be delivered: No such recipient at %s.\r\n",
+		msg.MID(), addressList(msg.Receivers()), s.Mycall(),
+	))
+	s.bounces.pending = append(s.bounces.pending, bounce)
+}
+
+func addressList(addrs []Address) string {
+	strs := make([]string, len(addrs))
+	for i, addr := range addrs {
+		strs[i] = addr.String()
+	}
+	return strings.Join(strs, ", ")
+}
+
+// bounceHandler is an OutboundHandler adding the pending bounces to the outbound messages of another handler.
+type bounceHandler struct {
+	h       OutboundHandler // The wrapped handler (nil if none)
+	pending []*Message      // Bounces yet to be sent
+}
+
+func (b *bounceHandler) GetOutbound(fw ...Address) []*Message {
+	var msgs []*Message
+	if b.h != nil {
+		msgs = b.h.GetOutbound(fw...)
+	}
+	return append(msgs, b.pending...)
+}
+
+func (b *bounceHandler) SetSent(MID string, rejected bool) {
+	if !b.remove(MID) && b.h != nil {
+		b.h.SetSent(MID, rejected)
+	}
+}
+
+func (b *bounceHandler) SetDeferred(MID string) {
+	if !b.remove(MID) && b.h != nil {
+		b.h.SetDeferred(MID)
+	}
+}
+
+func (b *bounceHandler) remove(MID string) bool {
+	for i, msg := range b.pending {
+		if msg.MID() == MID {
+			b.pending = append(b.pending[:i], b.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
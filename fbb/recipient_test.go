@@ -0,0 +1,78 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSessionUnknownRecipientPolicy(t *testing.T) {
+	tests := []struct {
+		policy       UnknownRecipientPolicy
+		uncompressed bool
+		expectStored int
+		expectBounce bool
+	}{
+		{AcceptUnknownRecipient, false, 3, false},
+		{RejectUnknownRecipient, false, 2, false},
+		{RejectUnknownRecipient, true, 2, false},
+		{BounceUnknownRecipient, false, 2, true},
+	}
+
+	for _, test := range tests {
+		local, aux := newTestMessage("N0CALL", "LA5NTA", 100), newTestMessage("N0CALL", "LA1B", 100)
+		unknown := newTestMessage("N0CALL", "LE1OF", 100)
+		clientMBox, masterMBox := newMemMBox(), newMemMBox(local, aux, unknown)
+
+		client := NewSession("LA5NTA", "N0CALL", "JO39EQ", clientMBox)
+		client.AddAuxiliaryAddress(Address{Addr: "la1b"})
+		client.SetUnknownRecipientPolicy(test.policy)
+		master := NewSession("N0CALL", "LA5NTA", "JO39EQ", masterMBox)
+		master.SetForceUncompressed(test.uncompressed)
+		st, _ := exchange(t, client, master)
+
+		if len(clientMBox.in) != test.expectStored {
+			t.Errorf("policy %d: Expected %d stored messages, got %d", test.policy, test.expectStored, len(clientMBox.in))
+		}
+		for _, msg := range clientMBox.in {
+			if test.policy != AcceptUnknownRecipient && msg.MID() == unknown.MID() {
+				t.Errorf("policy %d: Message to unknown recipient was stored", test.policy)
+			}
+		}
+
+		if test.policy != AcceptUnknownRecipient {
+			expect := Refusal{MID: unknown.MID(), Answer: Reject, Reason: "unknown recipient"}
+			if len(st.Refused) != 1 || st.Refused[0] != expect {
+				t.Errorf("policy %d: Expected refusal %+v, got %+v", test.policy, expect, st.Refused)
+			}
+		}
+		if test.uncompressed && !masterMBox.sent[unknown.MID()] {
+			t.Errorf("Expected uncompressed proposal to unknown recipient to be rejected")
+		}
+
+		// The bounce is sent back to the remote, addressed to the sender
+		var bounces []*Message
+		for _, msg := range masterMBox.in {
+			if strings.HasPrefix(msg.Subject(), "Undeliverable: ") {
+				bounces = append(bounces, msg)
+			}
+		}
+		switch {
+		case !test.expectBounce && len(bounces) > 0:
+			t.Errorf("policy %d: Unexpected bounce", test.policy)
+		case test.expectBounce && len(bounces) != 1:
+			t.Errorf("policy %d: Expected 1 bounce, got %d", test.policy, len(bounces))
+		case test.expectBounce:
+			body, _ := bounces[0].Body()
+			if to := bounces[0].To(); len(to) != 1 || to[0].Addr != "N0CALL" {
+				t.Errorf("Expected bounce to N0CALL, got %v", to)
+			}
+			if !strings.Contains(body, unknown.MID()) || !strings.Contains(body, "LE1OF") {
+				t.Errorf("Unexpected bounce body: %q", body)
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"sync"
+	"time"
+)
+
+// TransferStore holds the state needed to resume interrupted outbound transfers, keyed by BID (MID).
+//
+// The remote resumes an interrupted transfer by requesting the message at an offset (the number
+// of bytes already received), so the message must be sent exactly as it was the first time. The
+// store holds what the session adds to outbound messages: The trace header and the date of messages
+// without a Date header. It also counts the deferrals of each message, so that the retry-after hints
+// back off across connects (see DeferralPolicy). It holds nothing tied to the connection, so a store shared by the sessions
+// (see Session.SetTransferStore) allows a transfer interrupted over one transport (i.e. ARDOP) to be
+// resumed over another (i.e. telnet).
+//
+// The state of a message is removed when the remote has confirmed the message.
+type TransferStore struct {
+	mu     sync.Mutex
+	traced map[string]TraceHeader // Trace headers added to outbound messages
+	dated  map[string]string      // Date headers given to outbound messages
+	defers map[string]int         // Number of times outbound messages have been deferred
+}
+
+// NewTransferStore returns a new, empty TransferStore.
+func NewTransferStore() *TransferStore {
+	return &TransferStore{
+		traced: make(map[string]TraceHeader),
+		dated:  make(map[string]string),
+		defers: make(map[string]int),
+	}
+}
+
+// SetTransferStore sets the store used to resume interrupted outbound transfers.
+//
+// By default, each session has its own store. Share a store between sessions to resume
+// a transfer interrupted by a previous session (i.e. over a different transport). A nil
+// store restores the default.
+func (s *Session) SetTransferStore(ts *TransferStore) {
+	if ts == nil {
+		ts = NewTransferStore()
+	}
+	s.transfers = ts
+}
+
+// Forget removes the state of the message with the given BID.
+func (ts *TransferStore) Forget(bid string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	delete(ts.traced, bid)
+	delete(ts.dated, bid)
+	delete(ts.defers, bid)
+}
+
+// traceHeader returns the trace header added to the message, or stores h if none.
+func (ts *TransferStore) traceHeader(bid string, h func() (TraceHeader, bool)) (TraceHeader, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if stored, ok := ts.traced[bid]; ok {
+		return stored, true
+	}
+	stored, ok := h()
+	if ok {
+		ts.traced[bid] = stored
+	}
+	return stored, ok
+}
+
+// date returns the Date header given to the message, or stores the given time if none.
+func (ts *TransferStore) date(bid string, t time.Time) string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if stored, ok := ts.dated[bid]; ok {
+		return stored
+	}
+	ts.dated[bid] = t.UTC().Format(DateLayout)
+	return ts.dated[bid]
+}
+
+// deferred counts a deferral of the message, returning the number of times it has been deferred.
+func (ts *TransferStore) deferred(bid string) int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.defers[bid]++
+	return ts.defers[bid]
+}
@@ -0,0 +1,159 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// reloadMBox is a memMBox returning a freshly loaded copy of its outbound message on every call, like
+// a mailbox backed by disk would.
+type reloadMBox struct {
+	*memMBox
+	load func() *Message
+}
+
+func (m *reloadMBox) GetOutbound(fw ...Address) []*Message {
+	if len(m.memMBox.GetOutbound(fw...)) == 0 {
+		return nil
+	}
+	return []*Message{m.load()}
+}
+
+// readTransfer reads the SOH header and the STX blocks of a message written by the session,
+// returning the data of at most maxBlocks blocks (all if zero).
+func readTransfer(t *testing.T, rd *bufio.Reader, maxBlocks int) []byte {
+	if c, _ := rd.ReadByte(); c != _CHRSOH {
+		t.Fatalf("Expected SOH, got %d", c)
+	}
+	n, _ := rd.ReadByte()
+	if _, err := io.ReadFull(rd, make([]byte, n)); err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	for i := 0; maxBlocks == 0 || i < maxBlocks; i++ {
+		c, err := rd.ReadByte()
+		if err != nil {
+			t.Fatal(err)
+		} else if c == _CHREOT {
+			rd.ReadByte() // Checksum
+			break
+		}
+		n, _ := rd.ReadByte()
+		block := make([]byte, n)
+		if _, err := io.ReadFull(rd, block); err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, block...)
+	}
+	return data
+}
+
+func TestSessionResumeAcrossTransports(t *testing.T) {
+	var body strings.Builder
+	for i := 0; body.Len() < 5000; i++ {
+		fmt.Fprintf(&body, "Line %d: %x\r\n", i, i*i*7919)
+	}
+	load := func() *Message {
+		msg := NewMessage(Private, "LA5NTA")
+		msg.Header.Set(HEADER_MID, "RESUME000001")
+		msg.Header.Del(HEADER_DATE) // Dated by the session
+		msg.AddTo("N0CALL")
+		msg.SetSubject("Resumed")
+		msg.SetBody(body.String())
+		return msg
+	}
+	mbox := &reloadMBox{newMemMBox(load()), load}
+	store := NewTransferStore()
+	start := time.Date(2016, 3, 28, 12, 0, 0, 0, time.UTC)
+
+	newSession := func(now time.Time) *Session {
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", mbox)
+		s.SetLogger(log.New(ioutil.Discard, "", 0))
+		s.SetTransferStore(store)
+		s.SetClockSource(func() time.Time { return now })
+		s.SetTraceHeaderFunc(func(*Message) (TraceHeader, bool) { return TraceHeader{Node: "LA5NTA"}, true })
+		return s
+	}
+
+	// The first transfer (over TCP) drops after two blocks
+	client, srv := tcpPipe(t)
+	cerrs := make(chan error, 1)
+	go func() {
+		_, err := newSession(start).Exchange(client)
+		cerrs <- err
+	}()
+	rd := bufio.NewReader(srv)
+	fmt.Fprint(srv, "[WL2K-5.0-B2FWIHJM$]\rTest CMS >\r")
+	readProposal(t, rd)
+	fmt.Fprint(srv, "FS +\r")
+	partial := readTransfer(t, rd, 2)
+	srv.Close()
+	if err := <-cerrs; err == nil {
+		t.Fatal("Expected the first exchange to fail")
+	}
+	client.Close()
+
+	// The second transfer (over a different transport, an hour later) resumes at the offset received
+	client, srv = net.Pipe()
+	go func() {
+		_, err := newSession(start.Add(time.Hour)).Exchange(client)
+		cerrs <- err
+	}()
+	rd = bufio.NewReader(srv)
+	fmt.Fprint(srv, "[WL2K-5.0-B2FWIHJM$]\rTest CMS >\r")
+	readProposal(t, rd)
+	fmt.Fprintf(srv, "FS !%d\r", len(partial))
+	resumed := readTransfer(t, rd, 0)
+	fmt.Fprint(srv, "FF\r")
+	go ioutil.ReadAll(rd)
+	if err := <-cerrs; err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	srv.Close()
+
+	data := append(partial, resumed[lzhufHeaderLength:]...)
+	var buf bytes.Buffer
+	if err := decompress(&buf, Wl2kProposal, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Unable to decompress the resumed message: %s", err)
+	}
+	msg, err := ParseMessage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := msg.Body(); !strings.HasSuffix(got, body.String()) {
+		t.Errorf("Unexpected body of the resumed message")
+	}
+	if !msg.Date().Equal(start) {
+		t.Errorf("Expected the date of the first transfer (%s), got %s", start, msg.Date())
+	}
+	if rejected, ok := mbox.sent["RESUME000001"]; !ok || rejected {
+		t.Errorf("Expected the message to be marked as sent")
+	}
+	if len(store.traced) != 0 || len(store.dated) != 0 {
+		t.Errorf("Expected the transfer state to be removed when confirmed")
+	}
+}
+
+// readProposal reads the proposals of the session, up to and including the F> line.
+func readProposal(t *testing.T, rd *bufio.Reader) {
+	for {
+		line, err := rd.ReadString('\r')
+		if err != nil {
+			t.Fatal(err)
+		} else if strings.HasPrefix(line, "F>") {
+			return
+		}
+	}
+}
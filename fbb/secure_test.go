@@ -4,7 +4,13 @@
 
 package fbb
 
-import "testing"
+import (
+	"bytes"
+	"crypto/rand"
+	"log"
+	"strings"
+	"testing"
+)
 
 func TestSecureLoginResponse(t *testing.T) {
 	type test struct{ challenge, password, expect string }
@@ -26,3 +32,64 @@ func BenchmarkSecureLoginResponse(b *testing.B) {
 		secureLoginResponse("23753528", "foobar")
 	}
 }
+
+func TestSessionSetPassword(t *testing.T) {
+	client, master := tcpPipe(t)
+
+	var logged bytes.Buffer
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", newMemMBox())
+	s.SetLogger(log.New(&logged, "", 0))
+	s.SetPassword("FooBar")
+
+	errs := make(chan error, 1)
+	go func() {
+		m := NewSession("N0CALL", "LA5NTA", "JO39EQ", newMemMBox())
+		m.IsMaster(true)
+		m.SetSecureLoginVerifier(func(call string) (string, error) { return "FooBar", nil })
+		_, err := m.Exchange(master)
+		errs <- err
+	}()
+
+	if _, err := s.Exchange(client); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Unexpected master error: %s", err)
+	}
+	if !s.SecureLoginPerformed() {
+		t.Errorf("Expected secure login to be performed")
+	}
+	if strings.Contains(logged.String(), "FooBar") {
+		t.Errorf("Password was logged: %q", logged.String())
+	}
+
+	s.Close()
+	if s.password != "" {
+		t.Errorf("Expected the password to be cleared by Close")
+	}
+	if _, err := s.storedPassword(); err != ErrAborted {
+		t.Errorf("Expected ErrAborted after Close, got %v", err)
+	}
+}
+
+func TestNewSecureChallenge(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		challenge, err := newSecureChallenge(rand.Reader)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if len(challenge) != 8 || strings.Trim(challenge, "0123456789") != "" {
+			t.Errorf("Expected 8 digits, got %q", challenge)
+		}
+		seen[challenge] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("Expected random challenges, got %v", seen)
+	}
+
+	// The challenge is never generated from a weaker source
+	if challenge, err := newSecureChallenge(bytes.NewReader(nil)); err == nil {
+		t.Errorf("Expected an error from an exhausted source, got %q", challenge)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrSIDRenegotiated is returned when the remote sends a new SID header after the handshake,
+// and the session's SIDChangePolicy is AbortOnSIDChange.
+var ErrSIDRenegotiated = errors.New("Remote sent a new SID header after the handshake")
+
+// SIDChangePolicy determines how a SID header received after the handshake (i.e. in the
+// transfer phase) is handled.
+type SIDChangePolicy int
+
+const (
+	AbortOnSIDChange       SIDChangePolicy = iota // Abort the exchange with ErrSIDRenegotiated (default).
+	RenegotiateOnSIDChange                        // Use the new SID codes for the rest of the exchange.
+)
+
+// SetSIDChangePolicy sets how a SID header sent by the remote after the handshake is handled.
+//
+// The protocol does not allow the remote to renegotiate, but some implementations do. A new
+// SID header is recognized wherever the remote is expected to send a protocol command.
+//
+// With RenegotiateOnSIDChange, the new SID is subject to the same checks as the SID received
+// during the handshake. RemoteSID, RawRemoteSID and the remote's user agent are updated to
+// reflect the new SID. The default is AbortOnSIDChange.
+func (s *Session) SetSIDChangePolicy(policy SIDChangePolicy) { s.sidChange = policy }
+
+// isSIDLine returns true if the received line is a SID header (i.e. [WL2K-2.8.4.8-B2FWIHJM$]).
+func isSIDLine(line string) bool {
+	if !strings.HasPrefix(line, "[") || !strings.HasSuffix(line, "]") {
+		return false
+	}
+	_, err := parseSID(line)
+	return err == nil
+}
+
+// handleSIDChange handles a SID header received in the transfer phase according to the policy.
+func (s *Session) handleSIDChange(line string) error {
+	if s.sidChange != RenegotiateOnSIDChange {
+		return fmt.Errorf("%w: '%s'", ErrSIDRenegotiated, line)
+	}
+
+	code, err := parseSID(line)
+	if err != nil {
+		return err
+	}
+	app, version := parseSIDApp(line)
+
+	switch {
+	case s.forceUncompressed && code.Has(sFBBasic):
+		// The basic protocol is sufficient
+	case isBasicOnly(code):
+		// The remote forces uncompressed transfers
+	case !code.Has(sFBComp2):
+		return &NoFB2Error{SID: string(code)}
+	}
+	if !s.isAllowedApp(app) {
+		return ErrAppNotAllowed
+	}
+	if s.requireBID && !code.Has(sBID) {
+		return ErrBIDUnsupported
+	}
+
+	s.log.Printf("Remote renegotiated SID: %s", line)
+	s.remoteSID = code
+	s.remoteRawSID = sidRe.FindString(line)
+	s.remoteRawSIDLine = s.rawLine
+	s.remoteUA = UserAgent{Name: app, Version: version}
+	return nil
+}
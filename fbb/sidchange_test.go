@@ -0,0 +1,74 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+func TestIsSIDLine(t *testing.T) {
+	tests := map[string]bool{
+		"[WL2K-5.0-B2FWIHJM$]":          true,
+		"[RMS Express-1.2.35.0-B2FHM$]": true,
+		"[WL2K-5.0-]":                   false,
+		"FB P LA5NTA N0CALL 1 2 0":      false,
+		"; [WL2K-5.0-B2FWIHJM$]":        false,
+	}
+	for line, expect := range tests {
+		if got := isSIDLine(line); got != expect {
+			t.Errorf("%q: Expected %t, got %t", line, expect, got)
+		}
+	}
+}
+
+func TestSessionSIDChange(t *testing.T) {
+	for _, policy := range []SIDChangePolicy{AbortOnSIDChange, RenegotiateOnSIDChange} {
+		client, srv := tcpPipe(t)
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", newMemMBox())
+		s.SetSIDChangePolicy(policy)
+
+		cerrs := make(chan error)
+		go func() {
+			_, err := s.Exchange(client)
+			cerrs <- err
+		}()
+
+		fmt.Fprint(srv, "[WL2K-2.8.4.8-B2FWIHJM$]\rTest CMS >\r")
+
+		// Wait for the client's turnover, then renegotiate before sending our FQ
+		rd := bufio.NewReader(srv)
+		for line := ""; line != "FF\r"; {
+			var err error
+			if line, err = rd.ReadString('\r'); err != nil {
+				t.Fatalf("Unexpected read error: %s", err)
+			}
+		}
+		fmt.Fprint(srv, "[WL2K-5.0-B2FHM$]\rFQ\r")
+		go ioutil.ReadAll(rd)
+
+		err := <-cerrs
+		srv.Close()
+		switch policy {
+		case AbortOnSIDChange:
+			if !errors.Is(err, ErrSIDRenegotiated) {
+				t.Errorf("Expected ErrSIDRenegotiated, got %v", err)
+			}
+		case RenegotiateOnSIDChange:
+			if err != nil {
+				t.Errorf("Unexpected error: %s", err)
+			}
+			if got := s.RemoteSID(); got != "B2FHM$" {
+				t.Errorf("Expected the renegotiated SID, got %q", got)
+			}
+			if got := s.RemoteUserAgent(); got != (UserAgent{Name: "WL2K", Version: "5.0"}) {
+				t.Errorf("Unexpected user agent: %+v", got)
+			}
+		}
+	}
+}
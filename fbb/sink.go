@@ -0,0 +1,62 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import "fmt"
+
+// A MessageSink receives the inbound messages of a Session, as an alternative to the MBoxHandler's ProcessInbound.
+type MessageSink interface {
+	// Store should persist the received message, returning an error if the operation was unsuccessful.
+	Store(msg *Message) error
+}
+
+// SetMessageSink sets the sink of inbound messages, replacing the handler's ProcessInbound.
+//
+// The handler's GetInboundAnswer is still used to answer the remote's proposals. If the session
+// has no handler, every proposal is accepted.
+//
+// If Store returns an error, the exchange is aborted before the remote is notified that the
+// message was received. The remote will then keep the message, and propose it again on the
+// next connect (i.e. the message is implicitly deferred). The exchange can't continue, as the
+// remote considers every message of the block delivered once it does. Messages of the block
+// stored before the error are proposed again too, and should be rejected as duplicates by the
+// handler's GetInboundAnswer.
+func (s *Session) SetMessageSink(sink MessageSink) { s.sink = sink }
+
+// SetQuarantineSink sets a sink holding inbound messages pending external checks (i.e. virus or size checks).
+//
+// When set, every received message is stored in the quarantine sink instead of the message sink (see
+// SetMessageSink) or the handler's ProcessInbound. The caller is responsible for promoting the messages
+// passing the checks to the main store. Errors are handled the same way as for the message sink.
+//
+// The quarantine does not apply to messages handled by an inbound stream (see SetInboundStreamFunc).
+func (s *Session) SetQuarantineSink(sink MessageSink) { s.quarantine = sink }
+
+func (s *Session) inboundAnswer(p Proposal) (answer ProposalAnswer, reason string) {
+	switch h := s.h.(type) {
+	case nil:
+		return Accept, ""
+	case InboundAnswerReasoner:
+		return h.AnswerInbound(p)
+	default:
+		return h.GetInboundAnswer(p), ""
+	}
+}
+
+// storeInbound passes the received message to the quarantine or the sink, or the handler if neither is set.
+func (s *Session) storeInbound(msg *Message) error {
+	sink := s.sink
+	if s.quarantine != nil {
+		sink = s.quarantine
+	}
+	if sink == nil {
+		return s.h.ProcessInbound(msg)
+	}
+
+	if err := sink.Store(msg); err != nil {
+		return fmt.Errorf("Unable to store %s: %s", msg.MID(), err)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// funcSink is a MessageSink calling a function.
+type funcSink func(msg *Message) error
+
+func (f funcSink) Store(msg *Message) error { return f(msg) }
+
+func TestSessionMessageSink(t *testing.T) {
+	errStore := errors.New("disk full")
+
+	for _, fail := range []bool{false, true} {
+		clientMBox := newMemMBox(newTestMessage("LA5NTA", "N0CALL", 100), newTestMessage("LA5NTA", "N0CALL", 200))
+
+		var stored int
+		sink := funcSink(func(msg *Message) error {
+			if fail {
+				return errStore
+			}
+			stored++
+			return nil
+		})
+
+		client, master := tcpPipe(t)
+		s := NewSession("N0CALL", "LA5NTA", "JO39EQ", nil) // No handler, only the sink
+		s.SetMessageSink(sink)
+		_, _, clientErr, masterErr := exchangeConns(NewSession("LA5NTA", "N0CALL", "JO39EQ", clientMBox), s, client, master)
+
+		switch {
+		case !fail && (masterErr != nil || clientErr != nil):
+			t.Errorf("Unexpected errors: %v, %v", masterErr, clientErr)
+		case !fail && stored != 2:
+			t.Errorf("Expected 2 stored messages, got %d", stored)
+		case !fail && len(clientMBox.sent) != 2:
+			t.Errorf("Expected 2 messages to be marked as sent, got %d", len(clientMBox.sent))
+		case fail && (masterErr == nil || !strings.Contains(masterErr.Error(), errStore.Error())):
+			t.Errorf("Expected store error, got %v", masterErr)
+		case fail && len(clientMBox.sent) != 0:
+			t.Errorf("Expected no messages to be marked as sent after store error, got %d", len(clientMBox.sent))
+		}
+	}
+}
+
+func TestSessionMessageSinkRetry(t *testing.T) {
+	clientMBox := newMemMBox(newTestMessage("LA5NTA", "N0CALL", 100), newTestMessage("LA5NTA", "N0CALL", 200))
+	masterMBox := newMemMBox()
+
+	// The second message of the first exchange fails to store
+	var calls int
+	sink := funcSink(func(msg *Message) error {
+		if calls++; calls == 2 {
+			return errors.New("disk full")
+		}
+		return masterMBox.ProcessInbound(msg)
+	})
+
+	for i := 0; i < 2; i++ {
+		client, master := tcpPipe(t)
+		s := NewSession("N0CALL", "LA5NTA", "JO39EQ", masterMBox)
+		s.SetMessageSink(sink)
+		_, _, _, masterErr := exchangeConns(NewSession("LA5NTA", "N0CALL", "JO39EQ", clientMBox), s, client, master)
+
+		switch {
+		case i == 0 && masterErr == nil:
+			t.Fatalf("Expected store error")
+		case i == 0 && len(clientMBox.sent) != 0:
+			t.Fatalf("Expected no messages to be marked as sent after store error, got %d", len(clientMBox.sent))
+		case i == 1 && masterErr != nil:
+			t.Fatalf("Unexpected error: %s", masterErr)
+		}
+	}
+
+	// The stored message is rejected as a duplicate when proposed again
+	if n := len(masterMBox.inbox()); n != 2 {
+		t.Errorf("Expected 2 stored messages, got %d", n)
+	}
+	if len(clientMBox.sent) != 2 {
+		t.Errorf("Expected 2 messages to be marked as sent, got %d", len(clientMBox.sent))
+	}
+}
+
+func TestSessionQuarantineSink(t *testing.T) {
+	clientMBox := newMemMBox(newTestMessage("LA5NTA", "N0CALL", 100), newTestMessage("LA5NTA", "N0CALL", 200))
+	masterMBox := newMemMBox()
+
+	var quarantined, stored []*Message
+	quarantine := funcSink(func(msg *Message) error { quarantined = append(quarantined, msg); return nil })
+	sink := funcSink(func(msg *Message) error { stored = append(stored, msg); return nil })
+
+	client, master := tcpPipe(t)
+	errs := make(chan error, 1)
+	go func() {
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", clientMBox)
+		_, err := s.Exchange(client)
+		errs <- err
+	}()
+
+	s := NewSession("N0CALL", "LA5NTA", "JO39EQ", masterMBox)
+	s.IsMaster(true)
+	s.SetMessageSink(sink)
+	s.SetQuarantineSink(quarantine)
+	_, masterErr := s.Exchange(master)
+	clientErr := <-errs
+
+	switch {
+	case masterErr != nil || clientErr != nil:
+		t.Errorf("Unexpected errors: %v, %v", masterErr, clientErr)
+	case len(quarantined) != 2:
+		t.Errorf("Expected 2 quarantined messages, got %d", len(quarantined))
+	case len(stored) != 0:
+		t.Errorf("Expected no messages in the message sink, got %d", len(stored))
+	case len(masterMBox.inbox()) != 0:
+		t.Errorf("Expected no messages in the main store, got %d", len(masterMBox.inbox()))
+	case len(clientMBox.sent) != 2:
+		t.Errorf("Expected 2 messages to be marked as sent, got %d", len(clientMBox.sent))
+	}
+}
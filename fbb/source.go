@@ -0,0 +1,82 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+// A ProposalSource supplies outbound messages to a Session, as an alternative to the MBoxHandler's OutboundHandler.
+//
+// This is useful for callers storing messages in a database or memory.
+type ProposalSource interface {
+	// Next returns the next outbound message, or false if there are no more messages.
+	//
+	// The messages are not filtered by the remote's forward addresses, so the source
+	// should only supply messages that can be delivered through the remote node.
+	Next() (*Message, bool)
+
+	// Ack is called when the message identified by id (MID) is successfully sent,
+	// or rejected because the remote has already received it.
+	//
+	// Messages deferred by the remote are not acknowledged.
+	Ack(id string)
+}
+
+// SetProposalSource sets the source of outbound messages, replacing the handler's OutboundHandler.
+func (s *Session) SetProposalSource(src ProposalSource) {
+	if src == nil {
+		s.src = nil
+		return
+	}
+	s.src = &sourceHandler{src: src}
+}
+
+// outboundHandler returns the OutboundHandler used by this session (nil if none).
+//
+// While bounces are pending (see SetUnknownRecipientPolicy), the handler is wrapped to include them.
+func (s *Session) outboundHandler() OutboundHandler {
+	var h OutboundHandler
+	switch {
+	case s.src != nil:
+		h = s.src
+	case s.h != nil:
+		h = s.h
+	}
+	if len(s.bounces.pending) > 0 {
+		s.bounces.h = h
+		return &s.bounces
+	}
+	return h
+}
+
+// sourceHandler is an OutboundHandler backed by a ProposalSource.
+type sourceHandler struct {
+	src     ProposalSource
+	pending []*Message // Messages fetched from src, yet to be sent or deferred
+}
+
+func (h *sourceHandler) GetOutbound(fw ...Address) []*Message {
+	for {
+		msg, ok := h.src.Next()
+		if !ok {
+			break
+		}
+		h.pending = append(h.pending, msg)
+	}
+	return append([]*Message(nil), h.pending...)
+}
+
+func (h *sourceHandler) SetSent(MID string, rejected bool) {
+	h.remove(MID)
+	h.src.Ack(MID)
+}
+
+func (h *sourceHandler) SetDeferred(MID string) { h.remove(MID) }
+
+func (h *sourceHandler) remove(MID string) {
+	for i, msg := range h.pending {
+		if msg.MID() == MID {
+			h.pending = append(h.pending[:i], h.pending[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// sliceSource is a ProposalSource supplying messages from a slice.
+type sliceSource struct {
+	mu    sync.Mutex
+	msgs  []*Message
+	acked []string
+}
+
+func (s *sliceSource) Next() (*Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.msgs) == 0 {
+		return nil, false
+	}
+	msg := s.msgs[0]
+	s.msgs = s.msgs[1:]
+	return msg, true
+}
+
+func (s *sliceSource) Ack(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acked = append(s.acked, id)
+}
+
+func TestSessionProposalSource(t *testing.T) {
+	msgs := []*Message{
+		newTestMessage("LA5NTA", "N0CALL", 100),
+		newTestMessage("LA5NTA", "N0CALL", 200),
+		newTestMessage("LA5NTA", "N0CALL", 300),
+	}
+	src := &sliceSource{msgs: append([]*Message(nil), msgs...)}
+
+	// The source should replace the handler's outbound messages
+	clientMBox := newMemMBox(newTestMessage("LA5NTA", "N0CALL", 100))
+	masterMBox := newMemMBox()
+
+	client := NewSession("LA5NTA", "N0CALL", "JO39EQ", clientMBox)
+	client.SetProposalSource(src)
+	master := NewSession("N0CALL", "LA5NTA", "JO39EQ", masterMBox)
+	exchange(t, client, master)
+
+	var expected []string
+	for _, msg := range msgs {
+		expected = append(expected, msg.MID())
+	}
+	sort.Strings(expected)
+	sort.Strings(src.acked)
+	if !reflect.DeepEqual(src.acked, expected) {
+		t.Errorf("Expected %q to be acked, got %q", expected, src.acked)
+	}
+
+	var received []string
+	for _, msg := range masterMBox.inbox() {
+		received = append(received, msg.MID())
+	}
+	sort.Strings(received)
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("Expected master to receive %q, got %q", expected, received)
+	}
+	if len(clientMBox.sent) > 0 {
+		t.Errorf("Expected the handler's outbound messages to be ignored")
+	}
+}
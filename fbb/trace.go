@@ -0,0 +1,145 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrInvalidTraceHeader is returned when a line is not a valid R: trace header.
+var ErrInvalidTraceHeader = errors.New("Invalid R: trace header")
+
+// TraceHeader is a parsed FBB routing trace header (R: line).
+//
+// Each node relaying a message prepends a line documenting when and where the
+// message passed through, i.e.
+//
+//	R:160328/1243Z @:LA5NTA.#OSL.NOR.EU [Oslo] #:1234 $:BID
+//	R:160328/1243Z 1234@LA5NTA.#OSL.NOR.EU BPQ6.0.23
+//	R:880102/0735 @:N6XYZ.#NOCAL.CA.USA.NA #:1234 Z:95123
+type TraceHeader struct {
+	Time     time.Time // The time the message passed the node (UTC).
+	Node     string    // The node's (hierarchical) address, i.e. LA5NTA.#OSL.NOR.EU.
+	Location string    // The node's location, i.e. Oslo. Empty if not given.
+	Raw      string    // The header line as received.
+}
+
+// The layouts of the R: header timestamp (some nodes omit the Z suffix).
+var traceTimeLayouts = []string{
+	"060102/1504Z",
+	"060102/1504",
+	"060102/150405Z",
+}
+
+// ParseTraceHeader parses a single R: trace header line.
+func ParseTraceHeader(line string) (TraceHeader, error) {
+	h := TraceHeader{Raw: line}
+
+	line = strings.TrimSpace(line)
+	if len(line) < 2 || !strings.EqualFold(line[:2], "R:") {
+		return h, ErrInvalidTraceHeader
+	}
+
+	// The location is enclosed in brackets, possibly containing spaces
+	if i := strings.IndexByte(line, '['); i >= 0 {
+		if j := strings.IndexByte(line[i:], ']'); j > 0 {
+			h.Location = strings.TrimSpace(line[i+1 : i+j])
+			line = line[:i] + line[i+j+1:]
+		}
+	}
+
+	fields := strings.Fields(line[2:])
+	if len(fields) == 0 {
+		return h, ErrInvalidTraceHeader
+	}
+
+	var err error
+	for _, layout := range traceTimeLayouts {
+		if h.Time, err = time.Parse(layout, strings.ToUpper(fields[0])); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return h, ErrInvalidTraceHeader
+	}
+
+	// The node is given either as @:NODE or as NUMBER@NODE
+	for _, f := range fields[1:] {
+		if i := strings.IndexByte(f, '@'); i >= 0 {
+			h.Node = strings.TrimPrefix(f[i+1:], ":")
+			break
+		}
+	}
+	if h.Node == "" {
+		return h, ErrInvalidTraceHeader
+	}
+	h.Node = strings.ToUpper(h.Node)
+
+	return h, nil
+}
+
+// String returns the header formatted as an R: line, i.e.
+//
+//	R:160328/1243Z @:LA5NTA.#OSL.NOR.EU [Oslo]
+//
+// The location is omitted if empty.
+func (h TraceHeader) String() string {
+	str := fmt.Sprintf("R:%s @:%s", h.Time.UTC().Format(traceTimeLayouts[0]), strings.ToUpper(h.Node))
+	if h.Location != "" {
+		str += " [" + h.Location + "]"
+	}
+	return str
+}
+
+// PrependTraceHeader prepends the R: trace header to the message body.
+//
+// If the body already starts with the same header line, the body is left unchanged.
+func (m *Message) PrependTraceHeader(h TraceHeader) {
+	line := []byte(h.String() + "\r\n")
+	if bytes.HasPrefix(m.body, line) {
+		return
+	}
+	m.body = append(line, m.body...)
+	m.Header.Set(HEADER_BODY, fmt.Sprintf("%d", len(m.body)))
+}
+
+// TraceHeaders returns the R: trace headers found at the start of the message body,
+// with the most recent node first.
+//
+// Lines that look like trace headers, but can't be parsed, are skipped.
+func (m *Message) TraceHeaders() []TraceHeader {
+	var headers []TraceHeader
+
+	scanner := bufio.NewScanner(bytes.NewReader(m.body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) < 2 || !strings.EqualFold(line[:2], "R:") {
+			break // The trace headers are always at the start of the body
+		}
+		if h, err := ParseTraceHeader(line); err == nil {
+			headers = append(headers, h)
+		}
+	}
+	return headers
+}
+
+// addTraceHeader prepends our trace header to the outbound message, if relayed.
+func (s *Session) addTraceHeader(m *Message) {
+	h, ok := s.transfers.traceHeader(m.MID(), func() (TraceHeader, bool) {
+		h, ok := s.traceHeader(m)
+		if ok && h.Time.IsZero() {
+			h.Time = s.messageTime()
+		}
+		return h, ok
+	})
+	if ok {
+		m.PrependTraceHeader(h)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTraceHeader(t *testing.T) {
+	tests := map[string]TraceHeader{
+		"R:160328/1243Z @:LA5NTA.#OSL.NOR.EU [Oslo] #:1234 $:BID": {
+			Time:     time.Date(2016, 3, 28, 12, 43, 0, 0, time.UTC),
+			Node:     "LA5NTA.#OSL.NOR.EU",
+			Location: "Oslo",
+		},
+		"R:160328/1243Z 41206@GB7XYZ.#23.GBR.EURO BPQ6.0.23": {
+			Time: time.Date(2016, 3, 28, 12, 43, 0, 0, time.UTC),
+			Node: "GB7XYZ.#23.GBR.EURO",
+		},
+		"R:880102/0735 @:N6XYZ.#NOCAL.CA.USA.NA #:1234 Z:95123": {
+			Time: time.Date(1988, 1, 2, 7, 35, 0, 0, time.UTC),
+			Node: "N6XYZ.#NOCAL.CA.USA.NA",
+		},
+		"r:930111/1243z 1234@f6fbb.fmlr.fra.eu [Mirabel, France] FBB5.15": {
+			Time:     time.Date(1993, 1, 11, 12, 43, 0, 0, time.UTC),
+			Node:     "F6FBB.FMLR.FRA.EU",
+			Location: "Mirabel, France",
+		},
+	}
+	for line, expect := range tests {
+		expect.Raw = line
+		got, err := ParseTraceHeader(line)
+		if err != nil {
+			t.Errorf("%q: Unexpected error: %s", line, err)
+		} else if !reflect.DeepEqual(got, expect) {
+			t.Errorf("%q:\nExpected %+v\nGot      %+v", line, expect, got)
+		}
+	}
+
+	for _, line := range []string{
+		"",
+		"R:",
+		"Hello world",
+		"R:yesterday @:LA5NTA",
+		"R:160328/1243Z [Oslo]",
+	} {
+		if _, err := ParseTraceHeader(line); err != ErrInvalidTraceHeader {
+			t.Errorf("%q: Expected ErrInvalidTraceHeader, got %v", line, err)
+		}
+	}
+}
+
+func TestMessageTraceHeaders(t *testing.T) {
+	msg := NewMessage(Private, "LA5NTA")
+	msg.SetBody(strings.Join([]string{
+		"R:160328/1300Z @:LA1B.#OSL.NOR.EU [Oslo] #:99",
+		"R:garbage",
+		"R:160328/1243 1234@LA5NTA.#OSL.NOR.EU",
+		"",
+		"R:160328/1200Z @:N0CALL (part of the text, not a header)",
+	}, "\r\n"))
+
+	headers := msg.TraceHeaders()
+	if len(headers) != 2 {
+		t.Fatalf("Expected 2 trace headers, got %+v", headers)
+	}
+	if headers[0].Node != "LA1B.#OSL.NOR.EU" || headers[1].Node != "LA5NTA.#OSL.NOR.EU" {
+		t.Errorf("Unexpected trace headers: %+v", headers)
+	}
+
+	msg.SetBody("Hello world")
+	if headers := msg.TraceHeaders(); len(headers) != 0 {
+		t.Errorf("Expected no trace headers, got %+v", headers)
+	}
+}
+
+func TestTraceHeaderString(t *testing.T) {
+	tests := map[TraceHeader]string{
+		{Time: time.Date(2016, 3, 28, 12, 43, 10, 0, time.UTC), Node: "la5nta.#osl.nor.eu", Location: "Oslo"}: "R:160328/1243Z @:LA5NTA.#OSL.NOR.EU [Oslo]",
+		{Time: time.Date(2016, 3, 28, 12, 43, 0, 0, time.FixedZone("CEST", 7200)), Node: "LA5NTA"}:            "R:160328/1043Z @:LA5NTA",
+	}
+	for h, expect := range tests {
+		got := h.String()
+		if got != expect {
+			t.Errorf("Expected %q, got %q", expect, got)
+		}
+
+		// Must be parsable by ourselves
+		parsed, err := ParseTraceHeader(got)
+		if err != nil {
+			t.Errorf("%q: Unable to parse: %s", got, err)
+		} else if parsed.String() != got {
+			t.Errorf("%q: Round trip mismatch: %q", got, parsed.String())
+		}
+	}
+}
+
+func TestMessagePrependTraceHeader(t *testing.T) {
+	msg := NewMessage(Private, "LA5NTA")
+	msg.SetBody("R:160328/1200Z @:N0CALL\r\nHello")
+
+	h := TraceHeader{Time: time.Date(2016, 3, 28, 12, 43, 0, 0, time.UTC), Node: "LA5NTA"}
+	msg.PrependTraceHeader(h)
+	msg.PrependTraceHeader(h) // No-op
+
+	const expect = "R:160328/1243Z @:LA5NTA\r\nR:160328/1200Z @:N0CALL\r\nHello\r\n"
+	if body, _ := msg.Body(); body != expect {
+		t.Errorf("Unexpected body: %q", body)
+	}
+	if msg.BodySize() != len(expect) {
+		t.Errorf("Expected body size %d, got %d", len(expect), msg.BodySize())
+	}
+	if headers := msg.TraceHeaders(); len(headers) != 2 || headers[0].Node != "LA5NTA" {
+		t.Errorf("Unexpected trace headers: %+v", headers)
+	}
+}
+
+func TestSessionTraceHeaderFunc(t *testing.T) {
+
+	relayed := newTestMessage("N0CALL", "LA1B", 100)
+	local := newTestMessage("LA5NTA", "LA1B", 100)
+	masterMBox := newMemMBox()
+
+	clock := newFakeClock()
+	client := NewSession("LA5NTA", "LA1B", "JO39EQ", newMemMBox(relayed, local))
+	client.clock = clock
+	client.SetTraceHeaderFunc(func(msg *Message) (TraceHeader, bool) {
+		return TraceHeader{Node: "LA5NTA.#OSL.NOR.EU", Location: "Oslo"}, msg.From().Addr != "LA5NTA"
+	})
+	master := NewSession("LA1B", "LA5NTA", "JO39EQ", masterMBox)
+	exchange(t, client, master)
+
+	if len(masterMBox.in) != 2 {
+		t.Fatalf("Expected 2 received messages, got %d", len(masterMBox.in))
+	}
+	expect := TraceHeader{Time: clock.Now(), Node: "LA5NTA.#OSL.NOR.EU", Location: "Oslo"}
+	for _, msg := range masterMBox.in {
+		headers := msg.TraceHeaders()
+		switch msg.MID() {
+		case relayed.MID():
+			if len(headers) != 1 || headers[0].String() != expect.String() {
+				t.Errorf("Expected trace header %q, got %+v", expect, headers)
+			}
+		case local.MID():
+			if len(headers) != 0 {
+				t.Errorf("Expected no trace headers on local message, got %+v", headers)
+			}
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+// ConfigError is returned by Validate when the Session's configuration is contradictory.
+type ConfigError struct {
+	Reason string
+}
+
+func (e *ConfigError) Error() string { return "Invalid session configuration: " + e.Reason }
+
+// Validate checks the session's configuration for contradictions.
+//
+// Validate is called by Exchange before the handshake, but can be called
+// by the caller to catch errors early.
+func (s *Session) Validate() error {
+	switch {
+	case s.mycall == "":
+		return &ConfigError{"mycall is empty"}
+	case s.secureLoginVerifier != nil && !s.master:
+		return &ConfigError{"secure login verifier set on a non-master session"}
+	case s.inboundStream != nil && s.direction == Send:
+		return &ConfigError{"inbound stream set on a send only session"}
+	case s.connectSettleDelay < 0:
+		return &ConfigError{"negative connect settle delay"}
+	case s.maxInFlight < 0:
+		return &ConfigError{"negative max in flight"}
+	case s.fwPage < 0 || s.fwPageSize < 0:
+		return &ConfigError{"negative FW page"}
+	case s.checksumRetries < 0:
+		return &ConfigError{"negative checksum retries"}
+	case s.motdMaxLines < 0 || s.motdMaxBytes < 0:
+		return &ConfigError{"negative MOTD limit"}
+	case s.keepaliveInterval < 0:
+		return &ConfigError{"negative keepalive interval"}
+	case s.handshakeTimeout < 0:
+		return &ConfigError{"negative handshake timeout"}
+	case s.maxHandshakeAttempts < 0:
+		return &ConfigError{"negative max handshake attempts"}
+	case s.blockSize < 0 || s.blockSize > MaxBlockLength:
+		return &ConfigError{"block size out of range"}
+	case s.deferralPolicy != nil && (s.deferralPolicy.Delay < 0 || s.deferralPolicy.MaxDelay < 0):
+		return &ConfigError{"negative delay in deferral policy"}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2016 Martin Hebnes Pedersen (LA5NTA). All rights reserved.
+// Use of this source code is governed by the MIT-license that can be
+// found in the LICENSE file.
+
+package fbb
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func isConfigError(err error) bool { _, ok := err.(*ConfigError); return ok }
+
+func TestSessionValidate(t *testing.T) {
+	tests := map[string]func(s *Session){
+		"empty mycall":       func(s *Session) { s.mycall = "" },
+		"verifier on client": func(s *Session) { s.SetSecureLoginVerifier(func(string) (string, error) { return "", nil }) },
+		"stream on send only": func(s *Session) {
+			s.SetDirection(Send)
+			s.SetInboundStreamFunc(func(Proposal) (io.WriteCloser, error) { return nil, nil })
+		},
+		"negative settle delay":  func(s *Session) { s.SetConnectSettleDelay(-time.Second) },
+		"negative max attempts":  func(s *Session) { s.SetMaxHandshakeAttempts(-1) },
+		"negative hs timeout":    func(s *Session) { s.SetHandshakeTimeout(-time.Second) },
+		"negative keepalive":     func(s *Session) { s.SetKeepalive(-time.Second) },
+		"negative MOTD limit":    func(s *Session) { s.SetMOTDLimits(-1, 0) },
+		"negative max in flight": func(s *Session) { s.SetMaxInFlight(-1) },
+		"negative retries":       func(s *Session) { s.SetChecksumRetries(-1) },
+		"negative FW page":       func(s *Session) { s.SetFWPage(-1, 10) },
+		"negative deferral time": func(s *Session) { s.SetDeferralPolicy(DeferralPolicy{Delay: -time.Minute}) },
+		"negative block size":    func(s *Session) { s.SetBlockSize(-1) },
+		"oversized block size":   func(s *Session) { s.SetBlockSize(MaxBlockLength + 1) },
+	}
+	for name, configure := range tests {
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+		configure(s)
+		if err := s.Validate(); !isConfigError(err) {
+			t.Errorf("%s: Expected ConfigError, got %v", name, err)
+		}
+
+		// Exchange should fail before the handshake
+		client, srv := net.Pipe()
+		srv.Close()
+		if _, err := s.Exchange(client); !isConfigError(err) {
+			t.Errorf("%s: Expected Exchange to return the validation error, got %v", name, err)
+		}
+	}
+
+	// Valid configurations
+	master := NewSession("N0CALL", "LA5NTA", "JO39EQ", nil)
+	master.IsMaster(true)
+	master.SetMOTD("Hello")
+	master.SetSecureLoginVerifier(func(string) (string, error) { return "", nil })
+	for _, s := range []*Session{NewSession("LA5NTA", "N0CALL", "JO39EQ", nil), master} {
+		if err := s.Validate(); err != nil {
+			t.Errorf("Unexpected validation error: %s", err)
+		}
+	}
+}
@@ -9,13 +9,18 @@ package fbb
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net"
 	"os"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/la5nta/wl2k-go/transport"
@@ -71,31 +76,125 @@ type InboundHandler interface {
 //
 // A session should only be used once.
 type Session struct {
-	mycall     string
-	targetcall string
-	locator    string
-	motd       []string
+	id           string
+	mycall       string
+	targetcall   string
+	locator      string
+	normalize    bool // Upper-case call signs
+	motd         []string
+	motdMaxLines int  // Max number of MOTD lines (0 means no limit)
+	motdMaxBytes int  // Max total size of the MOTD (0 means no limit)
+	noMOTD       bool // Never send the MOTD (see SetSendMOTD)
 
 	h             MBoxHandler
+	src           *sourceHandler // Replaces h as OutboundHandler if set
+	sink          MessageSink    // Replaces h's ProcessInbound if set
+	quarantine    MessageSink    // Replaces both sink and h's ProcessInbound if set
 	statusUpdater StatusUpdater
+	metrics       MetricsCollector
 
 	// Callback when secure login password is needed
 	secureLoginHandleFunc func() (password string, err error)
-
-	master     bool
-	robustMode robustMode
-
-	remoteSID sid
-	remoteFW  []Address // Addresses the remote requests messages on behalf of
-	localFW   []Address // Addresses we request messages on behalf of
+	password              string // Set by SetPassword (guarded by connMu)
+
+	// Callback used to look up the remote's password when we challenge it (master only)
+	secureLoginVerifier  func(call string) (password string, err error)
+	secureChallenge      string
+	secureLoginPerformed bool
+
+	master          bool
+	robustMode      robustMode
+	allowedApps     []string // Remote applications allowed to connect (nil allows all)
+	requireBID      bool     // Fail the handshake if the remote does not support BID
+	missingFWAsSelf bool     // Assume remote requests messages for itself only if ;FW is omitted
+
+	forceUncompressed bool // Send messages using the FBB basic (ASCII) protocol
+	compactHandshake  bool // Advertise (and use if mutual) the compact handshake
+	fwSort            bool // Sort the auxiliary addresses of the ;FW line
+	fwPage            int  // The page of auxiliary addresses to request messages on behalf of
+	fwPageSize        int  // Max number of auxiliary addresses per page (0 means no paging)
+	blockSize         int  // Length of the compressed data blocks we send (0 means MaxMsgLength)
+	maxInFlight       int  // Max number of outbound proposals per block (0 means MaxBlockSize)
+	checksumRetries   int  // Max number of proposal blocks deferred due to checksum errors
+	checksumErrors    int  // Number of proposal blocks deferred due to checksum errors
+
+	connectSettleDelay time.Duration // Delay before the handshake starts
+	turnoverTimeout    time.Duration // Max time to wait for the remote after our turnover (0 means no limit)
+	turnoverTimeoutSet bool          // True if the turnover timeout is set explicitly
+	handshakeTimeout   time.Duration // Max duration of the handshake (0 means no limit)
+	keepaliveInterval  time.Duration // Interval of the keepalive frames (0 means disabled)
+	clock              clock
+	clockSource        func() time.Time // Used for dating messages if set (see SetClockSource)
+
+	direction      ExchangeDirection
+	deferralPolicy *DeferralPolicy
+	gzipRefused    map[string]bool         // MIDs of gzip proposals deferred by the remote
+	written        map[string]MessageStats // Outbound messages written, but not yet confirmed by the remote
+
+	inboundStream  func(p Proposal) (io.WriteCloser, error)
+	postHandshake  func(caps Capabilities) error
+	hsApproval     func(info HandshakeInfo) error
+	bidObserver    func(bid string, dir Direction)
+	unknownLine    func(line string) error
+	outboundHeader func(msg *Message)
+	traceHeader    func(msg *Message) (TraceHeader, bool)
+	transfers      *TransferStore
+	capCache       CapabilityCache
+	events         chan Event
+	eventsClosed   bool
+
+	unknownRecipient UnknownRecipientPolicy
+	bounces          bounceHandler // Bounces to send (see SetUnknownRecipientPolicy)
+
+	isExpired        func(p Proposal) bool
+	isAuthorizedCall func(addr Address) bool
+	expired          map[string]bool // MIDs of expired outbound messages
+
+	handshakeAttempts    int // Number of handshakes attempted by this session
+	maxHandshakeAttempts int
+
+	remoteAddr           net.Addr  // The remote address of the connection (if available)
+	remoteUA             UserAgent // The remote's application name and version (from the SID)
+	remoteSID            sid
+	remoteRawSID         string    // The remote's SID header as received
+	remoteRawSIDLine     string    // The line containing the remote's SID header, as received
+	remoteFooter         *Footer   // The remote's handshake footer (if sent)
+	remoteFW             []Address // Addresses the remote requests messages on behalf of
+	localFW              []Address // Addresses we request messages on behalf of
+	remoteMaxMessageSize int       // Max message size advertised by the remote (0 if unknown)
+
+	remoteTimeout time.Duration // Command timeout advertised by the remote (0 if unknown)
+	remoteTime    time.Time     // The remote's time advertised in its banner (zero if unknown)
+	clockSkew     time.Duration // The local time minus remoteTime (at the time of the handshake)
+
+	sidChange SIDChangePolicy // How SID headers received after the handshake are handled
 
 	trafficStats TrafficStats
 
 	quitReceived bool
 	quitSent     bool
 	remoteNoMsgs bool // True if last remote turn had no more messages
+	remoteHold   bool // True if the remote held our last proposals (see handleOutbound)
+
+	aborted int32 // Set (atomically) to 1 by Abort
+
+	pauseMu sync.Mutex
+	resume  chan struct{} // Non-nil while paused, closed by Resume
+
+	cancelMu  sync.Mutex
+	cancelled map[string]bool // MIDs of inbound messages cancelled by CancelInbound
 
-	rd *bufio.Reader
+	connMu sync.Mutex
+	conn   net.Conn // The connection used by the ongoing Exchange (if any)
+	closed bool     // Set by Close
+
+	hsConn net.Conn // The connection of a successful Handshake, awaiting Transfer
+
+	returnMsgErrors bool
+	failed          map[string]bool // MIDs of messages with a recorded MessageError
+
+	rd      *bufio.Reader
+	rawLine string // The last line read by nextLine, as received (without the line terminator)
 
 	log  *log.Logger
 	pLog *log.Logger
@@ -117,6 +216,7 @@ type StatusUpdater interface {
 
 // Status holds information about ongoing transfers.
 type Status struct {
+	SessionID        string // The ID of the reporting session (see Session.ID).
 	Receiving        *Proposal
 	Sending          *Proposal
 	BytesTransferred int
@@ -125,10 +225,103 @@ type Status struct {
 	When             time.Time
 }
 
+// Direction returns the direction of the transfer reported by this Status.
+func (s Status) Direction() Direction {
+	if s.Sending != nil {
+		return Outbound
+	}
+	return Inbound
+}
+
+// Direction is the direction of a message transfer.
+type Direction int
+
+const (
+	Inbound  Direction = iota // Message received from the remote node.
+	Outbound                  // Message sent to the remote node.
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Inbound:
+		return "inbound"
+	case Outbound:
+		return "outbound"
+	default:
+		return fmt.Sprintf("Direction(%d)", int(d))
+	}
+}
+
+// MarshalText encodes the direction as its string representation (i.e. in JSON).
+func (d Direction) MarshalText() ([]byte, error) { return []byte(d.String()), nil }
+
+// ExchangeDirection controls which way messages are exchanged in a session.
+type ExchangeDirection int
+
+const (
+	Both    ExchangeDirection = iota // Send and receive messages (default).
+	Receive                          // Receive messages only.
+	Send                             // Send messages only.
+)
+
 // TrafficStats holds exchange message traffic statistics.
+//
+// It can be encoded as JSON (i.e. for logging or dashboards), using the field names as keys.
 type TrafficStats struct {
 	Received []string // Received message MIDs.
 	Sent     []string // Sent message MIDs.
+
+	// Summary of the transfer as reported by the remote (i.e. "2 messages accepted").
+	//
+	// Empty if the remote did not send a summary.
+	RemoteSummary string
+
+	// Outbound messages deferred during the exchange.
+	Deferred []Deferral
+
+	// Outbound message MIDs skipped because they had expired (see Session.SetMessageExpiryFunc).
+	Expired []string
+
+	// Approximate round-trip time of the link, measured during the handshake as the time
+	// between sending our handshake and receiving the first byte of the remote's response.
+	//
+	// Only measured when master, as the client's handshake is not answered by the
+	// remote until after our outbound proposals. Zero if not measured.
+	HandshakeRTT time.Duration
+
+	// Known issues with the remote's application version (see KnownIssues).
+	KnownIssues []KnownIssue
+
+	// Per-message errors (see Session.SetReturnMessageErrors).
+	Errors []*MessageError
+
+	// Inbound proposals rejected or deferred by us (see InboundAnswerReasoner).
+	Refused []Refusal
+
+	// True if the remote's handshake footer addressed another call sign than ours (see Session.RemoteFooter).
+	Misaddressed bool
+
+	// Sizes of the transferred messages, in the order they were sent or received.
+	Messages []MessageStats
+}
+
+// MessageStats holds the size of a transferred message.
+type MessageStats struct {
+	MID       string
+	Direction Direction
+
+	Size           int // The logical (uncompressed) size of the message.
+	CompressedSize int // The on-wire size of the message. Equals Size for basic (uncompressed) messages.
+}
+
+// CompressionRatio returns the ratio between the uncompressed and the on-wire size of the message.
+//
+// Zero is returned if the on-wire size is unknown.
+func (m MessageStats) CompressionRatio() float64 {
+	if m.CompressedSize <= 0 {
+		return 0
+	}
+	return float64(m.Size) / float64(m.CompressedSize)
 }
 
 var StdLogger = log.New(os.Stderr, "", log.LstdFlags)
@@ -138,15 +331,16 @@ var StdUA = UserAgent{Name: "wl2kgo", Version: "0.1a"}
 //
 // The Handler can be nil (but no messages will be exchanged).
 //
-// Mycall and targetcall will be upper-cased.
+// Mycall and targetcall will be upper-cased, unless disabled using SetNormalizeCallsigns.
 func NewSession(mycall, targetcall, locator string, h MBoxHandler) *Session {
-	mycall, targetcall = strings.ToUpper(mycall), strings.ToUpper(targetcall)
-
 	return &Session{
+		id:         newSessionID(),
 		mycall:     mycall,
-		localFW:    []Address{AddressFromString(mycall)},
+		localFW:    []Address{{Addr: mycall}},
 		targetcall: targetcall,
+		normalize:  true,
 		log:        StdLogger,
+		clock:      realClock{},
 		h:          h,
 		pLog:       StdLogger,
 		ua:         StdUA,
@@ -155,6 +349,11 @@ func NewSession(mycall, targetcall, locator string, h MBoxHandler) *Session {
 			Received: make([]string, 0),
 			Sent:     make([]string, 0),
 		},
+		gzipRefused: make(map[string]bool),
+		written:     make(map[string]MessageStats),
+		transfers:   NewTransferStore(),
+		expired:     make(map[string]bool),
+		failed:      make(map[string]bool),
 	}
 }
 
@@ -182,12 +381,300 @@ func (s *Session) SetRobustMode(mode robustMode) {
 // The MOTD is only sent if the local node is session master.
 func (s *Session) SetMOTD(line ...string) { s.motd = line }
 
+// SetSendMOTD sets whether the MOTD should be sent when master (default true).
+//
+// Unlike an empty MOTD (see SetMOTD), which may still contain empty lines, disabling the MOTD
+// guarantees that nothing is sent ahead of our handshake, regardless of the MOTD set.
+func (s *Session) SetSendMOTD(send bool) { s.noMOTD = !send }
+
+// MOTDEllipsis is the line sent in place of the MOTD lines left out due to the MOTD limits.
+const MOTDEllipsis = "..."
+
+// SetMOTDLimits limits the number of lines and the total size in bytes (including line terminators) of the MOTD.
+//
+// If the MOTD exceeds a limit, it is truncated to the whole lines that fit, followed by a
+// MOTDEllipsis line. The ellipsis counts towards the limits. Zero means no limit (default).
+func (s *Session) SetMOTDLimits(maxLines, maxBytes int) {
+	s.motdMaxLines, s.motdMaxBytes = maxLines, maxBytes
+}
+
+// motdLines returns the MOTD lines to send, truncated according to the MOTD limits.
+func (s *Session) motdLines() []string {
+	if s.noMOTD {
+		return nil
+	}
+
+	fits := func(lines, bytes int) bool {
+		return (s.motdMaxLines <= 0 || lines <= s.motdMaxLines) && (s.motdMaxBytes <= 0 || bytes <= s.motdMaxBytes)
+	}
+
+	var size int
+	for _, line := range s.motd {
+		size += len(line) + 1 // Terminated by \r
+	}
+	if fits(len(s.motd), size) {
+		return s.motd
+	}
+
+	// Keep as many lines as possible, leaving room for the ellipsis
+	var n int
+	for size = len(MOTDEllipsis) + 1; n < len(s.motd); n++ {
+		if !fits(n+2, size+len(s.motd[n])+1) {
+			break
+		}
+		size += len(s.motd[n]) + 1
+	}
+	if !fits(n+1, size) {
+		return nil // No room for the ellipsis
+	}
+	return append(s.motd[:n:n], MOTDEllipsis)
+}
+
+// SetAllowedApps restricts which remote applications (by the application name
+// in the SID header) are allowed to complete the handshake.
+//
+// The names are matched case-insensitively. If the remote's application is not
+// in the list, the handshake fails with ErrAppNotAllowed. A nil slice (the default)
+// allows all applications.
+//
+// This is typically used by a gateway (session master).
+func (s *Session) SetAllowedApps(apps []string) { s.allowedApps = apps }
+
+// SetRequireBID makes the handshake fail with ErrBIDUnsupported if the remote's
+// SID does not indicate support for BID ($).
+//
+// BID is not required by default.
+func (s *Session) SetRequireBID(require bool) { s.requireBID = require }
+
+// SetConnectSettleDelay sets a delay to wait before the handshake is started.
+//
+// Some TNCs/modems need a brief delay after the connection is established before
+// the link is reliable. Default is no delay.
+func (s *Session) SetConnectSettleDelay(d time.Duration) { s.connectSettleDelay = d }
+
+// SetDeferralPolicy sets the policy used to record retry-after hints for deferred messages.
+//
+// See TrafficStats.Deferred.
+func (s *Session) SetDeferralPolicy(p DeferralPolicy) { s.deferralPolicy = &p }
+
+// SetMessageExpiryFunc sets a function used to determine if an outbound message has expired.
+//
+// The function is called for every outbound proposal. Proposals of expired messages are
+// not sent, and the MIDs are recorded in TrafficStats.Expired. The messages are not
+// marked as sent or deferred, so the caller is responsible for taking further action.
+func (s *Session) SetMessageExpiryFunc(f func(p Proposal) bool) { s.isExpired = f }
+
+// SetInboundStreamFunc enables streaming of inbound messages.
+//
+// When set, f is called for each accepted inbound proposal, and the message is written
+// to the returned writer as it's received (decompressed) instead of being buffered in
+// memory. The writer is closed when the transfer is done. If the transfer fails, the
+// written data is incomplete and should be discarded.
+//
+// Streamed messages are recorded in TrafficStats.Received, but they are not passed to
+// the MBoxHandler's ProcessInbound.
+func (s *Session) SetInboundStreamFunc(f func(p Proposal) (io.WriteCloser, error)) {
+	s.inboundStream = f
+}
+
+// SetPostHandshakeFunc sets a function to be called when the handshake is done, before any messages are transferred.
+//
+// The function is given the capabilities negotiated with the remote. If it returns an error,
+// the exchange is aborted and Exchange returns the error.
+func (s *Session) SetPostHandshakeFunc(f func(caps Capabilities) error) { s.postHandshake = f }
+
+// SetHandshakeApprovalFunc sets a function to approve the remote's handshake, before logging in or transferring any messages.
+//
+// The function is called when the remote's handshake has been read and checked, with everything the remote
+// sent (i.e. the MOTD, SID and call sign). If it returns an error, the exchange is aborted and Exchange returns
+// the error. If the remote is the session master (i.e. a CMS), our handshake (and secure login response) is never sent.
+func (s *Session) SetHandshakeApprovalFunc(f func(info HandshakeInfo) error) { s.hsApproval = f }
+
+// SetBIDObserver sets a function to be called with the BID (MID) of every message transferred, i.e. to maintain an
+// external ledger of BIDs seen.
+//
+// The function is called when an inbound message has been received and stored, and when an outbound message has
+// been confirmed by the remote. Messages refused by either side are not reported.
+func (s *Session) SetBIDObserver(f func(bid string, dir Direction)) { s.bidObserver = f }
+
+// observeBID reports the BID of a transferred message to the BID observer (if any).
+func (s *Session) observeBID(bid string, dir Direction) {
+	if s.bidObserver != nil {
+		s.bidObserver(bid, dir)
+	}
+}
+
+// SetOutboundHeaderFunc sets a function to be called for every outbound message before it is proposed to the remote.
+//
+// The function may modify the message's header (i.e. add a tracking header or fix the Date)
+// before the message is validated and compressed for transfer. The message passed to the
+// function is the one given by the MBoxHandler (or ProposalSource), so the changes are visible to the caller.
+//
+// The function is called every time the outbound messages are prepared, which may happen more
+// than once per message during an exchange. Use Header.Set rather than Header.Add.
+func (s *Session) SetOutboundHeaderFunc(f func(msg *Message)) { s.outboundHeader = f }
+
+// SetTraceHeaderFunc sets a function used to add our own R: trace header to outbound messages
+// relayed by this node (i.e. in a P2P or gateway role), as done by other FBB software.
+//
+// The function is called for every outbound message. It should return false for messages
+// that are not relayed (i.e. originating from this node). Otherwise, the returned header is
+// prepended to the message body. If the header's Time is zero, the current time (see SetClockSource) is used.
+//
+// The header is only added once per message, even if the outbound messages are prepared
+// more than once during the exchange.
+func (s *Session) SetTraceHeaderFunc(f func(msg *Message) (TraceHeader, bool)) { s.traceHeader = f }
+
+// SetUnknownLineFunc sets a function to be called for every line of the remote's handshake that is not recognized.
+//
+// Recognized lines (the SID, ;FW, ;PQ, ;PR, the prompt and message size hints) are not passed
+// to the function. Lines that are not recognized are ignored by default, which includes
+// banner and MOTD lines. If the function returns an error, the handshake fails with the error.
+func (s *Session) SetUnknownLineFunc(f func(line string) error) { s.unknownLine = f }
+
+// SetMaxHandshakeAttempts limits the number of handshakes attempted by this session.
+//
+// This is useful for callers retrying Exchange on a flaky link, to avoid hammering
+// the remote. When the limit is reached, Exchange closes the connection and returns
+// ErrTooManyAttempts. Zero (the default) means no limit.
+func (s *Session) SetMaxHandshakeAttempts(n int) { s.maxHandshakeAttempts = n }
+
+// HandshakeAttempts returns the number of handshakes attempted by this session.
+func (s *Session) HandshakeAttempts() int { return s.handshakeAttempts }
+
+// SetBlockSize sets the length of the data blocks used when sending messages using the compressed protocol.
+//
+// Larger blocks reduce the per-block overhead on good links. The size must be between 1 and
+// MaxBlockLength (see Validate). Zero (the default) means MaxMsgLength, which allows use of
+// AX.25 links with a paclen of 128.
+//
+// The block size is chosen by the sender, so this does not affect inbound messages.
+func (s *Session) SetBlockSize(n int) { s.blockSize = n }
+
+// SetMaxInFlight limits the number of outbound messages proposed (and transferred) per block.
+//
+// Accepted messages are transferred back-to-back after the remote's answer, so this bounds the
+// number of messages in flight before the remote confirms them. A limit of 1 proposes and transfers
+// one message at a time. Zero (the default) allows up to MaxBlockSize.
+func (s *Session) SetMaxInFlight(n int) { s.maxInFlight = n }
+
+// SetChecksumRetries sets the number of times an inbound proposal block with a checksum error
+// is deferred, to have the remote propose the messages again.
+//
+// The proposals of a block failing the checksum check can't be trusted. Instead of aborting the
+// exchange, every proposal in the block is deferred, and the remote may send a new block. The
+// exchange is aborted when the number of checksum errors exceeds n. Zero (the default) aborts
+// on the first checksum error.
+func (s *Session) SetChecksumRetries(n int) { s.checksumRetries = n }
+
+// SetCompactHandshake enables the compact handshake for bandwidth-critical links.
+//
+// This is an experimental feature specific to wl2k-go, negotiated by advertising the
+// K code in the SID. The compact form is used only when both peers advertise it, and
+// falls back to the standard handshake otherwise.
+//
+// In the compact form, the client (non-master) leaves out the informational
+// "; TARGETCALL DE MYCALL (LOCATOR)" line. With six character call signs, this saves
+// 27 bytes (about 45%) of the client handshake. The master sends its handshake before learning the
+// remote's capabilities, so the master's handshake is unaffected.
+func (s *Session) SetCompactHandshake(compact bool) { s.compactHandshake = compact }
+
+// SetDirection sets the direction of the message exchange. Default is Both.
+//
+// In Receive mode, no outbound messages are proposed to the remote. In Send mode, every
+// inbound proposal is deferred and messages are requested for the primary callsign only
+// (auxiliary addresses are left out of the ;FW line).
+func (s *Session) SetDirection(d ExchangeDirection) { s.direction = d }
+
+// SetTurnoverTimeout sets the maximum time to wait for the remote to respond after a session turnover.
+//
+// When we're done sending (FF, or after transferring our messages), the remote is
+// given the turn. If the remote does not respond within d, Exchange returns
+// ErrTurnoverTimeout. Zero (the default) means no limit.
+//
+// The timeout is applied using the connection's read deadline, and is only effective
+// on connections supporting it.
+//
+// If not set, the command timeout advertised in the remote's banner is used (see RemoteSuggestedTimeout).
+func (s *Session) SetTurnoverTimeout(d time.Duration) {
+	s.turnoverTimeout, s.turnoverTimeoutSet = d, true
+}
+
+// SetHandshakeTimeout sets the maximum duration of the handshake as a whole.
+//
+// If the handshake (including the connect settle delay) does not complete within d, Exchange
+// (or Handshake) returns ErrHandshakeTimeout. Zero (the default) means no limit.
+//
+// The timeout is applied using the connection's deadline, which is cleared when the handshake is done.
+func (s *Session) SetHandshakeTimeout(d time.Duration) { s.handshakeTimeout = d }
+
 // IsMaster sets whether this end should initiate the handshake.
 func (s *Session) IsMaster(isMaster bool) { s.master = isMaster }
 
+// RemoteAddr returns the remote network address of the connection given to Exchange.
+//
+// It returns nil if Exchange has not been called, or if the connection does not report a remote address.
+func (s *Session) RemoteAddr() net.Addr { return s.remoteAddr }
+
 // RemoteSID returns the remote's SID (if available).
+//
+// The SID codes are upper-cased. See RawRemoteSID for the SID as received.
 func (s *Session) RemoteSID() string { return string(s.remoteSID) }
 
+// RawRemoteSID returns the remote's SID header exactly as received, i.e. [WL2K-2.8.4.8-B2FWIHJM$] (if available).
+//
+// This is intended for diagnostics. Use RemoteSID for matching SID codes.
+func (s *Session) RawRemoteSID() string { return s.remoteRawSID }
+
+// RawRemoteSIDLine returns the complete line of the remote's handshake containing the SID header,
+// exactly as received (without the line terminator), including any text surrounding the brackets.
+//
+// This is intended for debugging gateway quirks. See also RawRemoteSID.
+func (s *Session) RawRemoteSIDLine() string { return s.remoteRawSIDLine }
+
+// RemoteFooter returns the informational footer of the remote's handshake, i.e. "; LA5NTA DE N0CALL (JO39EQ)".
+//
+// The footer gives the call sign the remote addressed (normally ours) and the remote's call sign.
+// Ok is false if the remote did not send a footer (i.e. a Winlink CMS).
+func (s *Session) RemoteFooter() (footer Footer, ok bool) {
+	if s.remoteFooter == nil {
+		return Footer{}, false
+	}
+	return *s.remoteFooter, true
+}
+
+// RemoteUserAgent returns the remote's application name and version, as given in the remote's SID (if available).
+//
+// This is available in both master and client mode.
+func (s *Session) RemoteUserAgent() UserAgent { return s.remoteUA }
+
+// RemoteMaxMessageSize returns the max message size (in bytes) advertised in the remote's banner.
+//
+// Outbound messages larger than this limit are deferred. Zero is returned if the remote
+// did not advertise a limit (which is the common case).
+func (s *Session) RemoteMaxMessageSize() int { return s.remoteMaxMessageSize }
+
+// RemoteSuggestedTimeout returns the command timeout advertised in the remote's banner (i.e. "Timeout: 120 seconds").
+//
+// Unless set explicitly, the turnover timeout (see SetTurnoverTimeout) is set to this value
+// during the handshake. Zero is returned if the remote did not advertise a timeout.
+func (s *Session) RemoteSuggestedTimeout() time.Duration { return s.remoteTimeout }
+
+// ClockSkewThreshold is the clock skew (see ClockSkew) causing a warning to be logged.
+const ClockSkewThreshold = 5 * time.Minute
+
+// RemoteTime returns the time advertised in the remote's banner (i.e. "2016-03-28 12:43:05 UTC").
+//
+// Zero is returned if the remote did not advertise its time (which is the common case).
+func (s *Session) RemoteTime() time.Time { return s.remoteTime }
+
+// ClockSkew returns the difference between the local time (see SetClockSource) and the time
+// advertised in the remote's banner, at the time of the handshake. A positive skew means the local
+// clock is ahead of the remote's. Zero is returned if the remote did not advertise its time.
+//
+// A warning is logged during the handshake if the skew exceeds ClockSkewThreshold.
+func (s *Session) ClockSkew() time.Duration { return s.clockSkew }
+
 // Exchange is the main method for exchanging messages with a remote over the B2F protocol.
 //
 // Sends outbound messages and downloads inbound messages prepared for this session.
@@ -205,33 +692,58 @@ func (s *Session) RemoteSID() string { return string(s.remoteSID) }
 // the exchange is done, is will return io.EOF.
 //
 // Subsequent Exchange calls on the same session is a noop.
+//
+// Exchange is equivalent to Handshake followed by Transfer.
 func (s *Session) Exchange(conn net.Conn) (stats TrafficStats, err error) {
 	if s.Done() {
 		return stats, nil
 	}
 
-	// The given conn should always be closed after returning from this method.
-	// If an error occurred, echo it to the remote.
-	defer func() {
-		if err == nil {
-			return
-		}
+	if _, err = s.Handshake(conn); err != nil {
+		return stats, err
+	}
+	return s.Transfer()
+}
 
-		// In case another go-routine closes the connection...
-		localEOF := strings.Contains(err.Error(), "use of closed network connection")
-		if localEOF {
-			err = io.EOF
-		}
+// Handshake performs the handshake with the remote on the given connection, without transferring any messages.
+//
+// This allows the caller to inspect the remote's capabilities before deciding whether to
+// proceed with the transfer (see Transfer) or to disconnect (see Close). Exchange is
+// equivalent to Handshake followed by Transfer.
+//
+// If the handshake fails, the connection is closed.
+func (s *Session) Handshake(conn net.Conn) (caps Capabilities, err error) {
+	if err := s.Validate(); err != nil {
+		conn.Close()
+		return caps, err
+	}
 
-		if err != io.EOF {
-			conn.SetDeadline(time.Now().Add(time.Minute))
-			fmt.Fprintf(conn, "*** %s\r\n", err)
-			conn.Close()
-		} else {
-			err = io.ErrUnexpectedEOF
+	if !s.setConn(conn) {
+		conn.Close()
+		return caps, ErrAborted // Session closed
+	}
+
+	if s.maxHandshakeAttempts > 0 && s.handshakeAttempts >= s.maxHandshakeAttempts {
+		s.endExchange(conn)
+		conn.Close()
+		return caps, ErrTooManyAttempts
+	}
+
+	s.addMetric(MetricSessions, 1)
+
+	// The given conn should always be closed if the handshake fails.
+	defer func() {
+		if err != nil {
+			err = s.exchangeFailed(conn, err)
+			s.endExchange(conn)
 		}
 	}()
 
+	if addr := conn.RemoteAddr(); addr != nil {
+		s.remoteAddr = addr
+		s.log.Printf("Exchanging messages with %s (%s)", s.Targetcall(), addr)
+	}
+
 	// Prepare mailbox handler
 	if s.h != nil {
 		err = s.h.Prepare()
@@ -243,22 +755,77 @@ func (s *Session) Exchange(conn net.Conn) (stats TrafficStats, err error) {
 	// Set connection's robust-mode according to setting
 	if r, ok := conn.(transport.Robust); ok {
 		r.SetRobust(s.robustMode != RobustDisabled)
-		defer r.SetRobust(false)
 	}
 
 	s.rd = bufio.NewReader(conn)
 
+	s.loadCachedCapabilities()
+	hsStart := s.clock.Now()
+	if s.handshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.handshakeTimeout))
+	}
 	err = s.handshake(conn)
+	if s.handshakeTimeout > 0 {
+		conn.SetDeadline(time.Time{})
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			err = ErrHandshakeTimeout
+		}
+	}
 	if err != nil {
 		return
 	}
+	s.observeMetric(MetricHandshakeDuration, s.clock.Now().Sub(hsStart).Seconds())
+	s.storeCapabilities()
+
+	for _, k := range s.knownIssues() {
+		s.log.Printf("Warning: %s-%s has a known issue: %s", s.remoteUA.Name, s.remoteUA.Version, k.Description)
+		s.trafficStats.KnownIssues = append(s.trafficStats.KnownIssues, k)
+	}
+	s.emit(Event{Type: HandshakeComplete, Capabilities: s.capabilities()})
 
 	if gzipExperimentEnabled() && s.remoteSID.Has(sGzip) {
 		s.log.Println("GZIP_EXPERIMENT:", "Gzip compression enabled in this session.")
 	}
 
+	if s.postHandshake != nil {
+		if err = s.postHandshake(s.capabilities()); err != nil {
+			return
+		}
+	}
+
+	s.hsConn = conn
+	return s.capabilities(), nil
+}
+
+// Transfer exchanges messages with the remote on the connection of a successful Handshake.
+//
+// The connection is closed when Transfer returns.
+func (s *Session) Transfer() (stats TrafficStats, err error) {
+	conn := s.hsConn
+	if conn == nil {
+		return stats, ErrNoHandshake
+	}
+	s.hsConn = nil
+
+	defer func() {
+		if err != nil {
+			err = s.exchangeFailed(conn, err)
+		} else if s.returnMsgErrors && len(s.trafficStats.Errors) > 0 {
+			err = MessageErrors(s.trafficStats.Errors)
+		}
+		s.endExchange(conn)
+	}()
+
 	for myTurn := !s.master; !s.Done(); myTurn = !myTurn {
+		if s.isAborted() {
+			return s.trafficStats, ErrAborted
+		}
+
 		if myTurn {
+			if s.keepalive(conn, s.waitPaused); s.isAborted() {
+				return s.trafficStats, ErrAborted
+			}
 			s.quitSent, err = s.handleOutbound(conn)
 		} else {
 			s.quitReceived, err = s.handleInbound(conn)
@@ -272,9 +839,130 @@ func (s *Session) Exchange(conn net.Conn) (stats TrafficStats, err error) {
 	return s.trafficStats, conn.Close()
 }
 
+// exchangeFailed echoes err to the remote and closes conn, returning the error to report to the caller.
+func (s *Session) exchangeFailed(conn net.Conn, err error) error {
+	defer func() {
+		s.addMetric(MetricSessionErrors, 1)
+		if IsLoginFailure(err) {
+			s.addMetric(MetricLoginFailures, 1)
+		}
+		s.emit(Event{Type: ExchangeError, Err: err})
+	}()
+
+	if s.isClosed() {
+		err = ErrAborted // The connection was closed by Close
+		return err
+	}
+
+	// In case another go-routine closes the connection...
+	localEOF := strings.Contains(err.Error(), "use of closed network connection")
+	if localEOF {
+		err = io.EOF
+	}
+
+	if err != io.EOF {
+		conn.SetDeadline(time.Now().Add(time.Minute))
+		fmt.Fprintf(conn, "*** %s\r\n", err)
+		conn.Close()
+	} else {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// endExchange releases the resources held for an exchange on conn.
+func (s *Session) endExchange(conn net.Conn) {
+	if r, ok := conn.(transport.Robust); ok {
+		r.SetRobust(false)
+	}
+	s.closeEvents()
+	s.setConn(nil)
+}
+
 // Done() returns true if either parties have existed from this session.
 func (s *Session) Done() bool { return s.quitReceived || s.quitSent }
 
+// Abort aborts the ongoing exchange. It is safe to call from another go-routine.
+//
+// If an outbound message is being transmitted, the transfer is terminated with a
+// corrupt checksum so that the remote discards the partially received message.
+// Otherwise the exchange is aborted at the next session turnover.
+//
+// Exchange returns ErrAborted after an abort.
+func (s *Session) Abort() {
+	atomic.StoreInt32(&s.aborted, 1)
+	s.Resume() // End any pause
+}
+
+func (s *Session) isAborted() bool { return atomic.LoadInt32(&s.aborted) == 1 }
+
+// CancelInbound cancels the acceptance of the inbound message with the given MID. It is safe to
+// call from another go-routine (i.e. from a StatusUpdater, after seeing the proposal being received).
+//
+// The protocol has no way to stop the remote from sending a single message, so the message is
+// received as usual, but discarded instead of stored. The exchange continues with the rest of the
+// messages. As with a rejected proposal, the remote considers the message delivered. Cancelled
+// messages are recorded in TrafficStats.Refused.
+//
+// The cancellation does not apply to messages handled by an inbound stream (see SetInboundStreamFunc).
+func (s *Session) CancelInbound(mid string) {
+	s.cancelMu.Lock()
+	defer s.cancelMu.Unlock()
+	if s.cancelled == nil {
+		s.cancelled = make(map[string]bool)
+	}
+	s.cancelled[mid] = true
+}
+
+func (s *Session) isCancelledInbound(mid string) bool {
+	s.cancelMu.Lock()
+	defer s.cancelMu.Unlock()
+	return s.cancelled[mid]
+}
+
+// Close closes the session, releasing any resources held by it. It is safe to call
+// from another go-routine, and it's safe to call Close multiple times.
+//
+// If Exchange is running, the exchange is aborted (see Abort), and the connection is closed
+// to interrupt any blocking reads or writes. Exchange returns ErrAborted. Messages that were
+// not fully transferred are not reported as sent or received.
+//
+// There is no need to call Close after Exchange returns, as the connection is closed when
+// the exchange is done. Once closed, subsequent calls to Exchange returns ErrAborted.
+func (s *Session) Close() error {
+	s.Abort()
+
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.password = ""
+
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+func (s *Session) isClosed() bool {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	return s.closed
+}
+
+// setConn sets the connection currently used by Exchange. It returns false if the session is closed.
+func (s *Session) setConn(conn net.Conn) bool {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conn = conn
+	return true
+}
+
 // Waits for connection to be closed, returning an error if seen on the line.
 func waitRemoteHangup(conn net.Conn) error {
 	conn.SetDeadline(time.Now().Add(time.Minute))
@@ -305,28 +993,165 @@ func remoteErr(str string) error {
 	return fmt.Errorf(strings.TrimSpace(str[idx+1:]))
 }
 
+// ID returns a string uniquely identifying this session.
+//
+// The ID is generated by NewSession, and is passed to the StatusUpdater in Status.SessionID.
+// It's useful for correlating output when several sessions run concurrently, i.e. by
+// using it as the prefix of the session's logger:
+//
+//	s.SetLogger(log.New(os.Stderr, s.ID()+" ", log.LstdFlags))
+func (s *Session) ID() string { return s.id }
+
+var sessionCount uint64
+
+// newSessionID returns a new unique session ID.
+func newSessionID() string {
+	return fmt.Sprintf("%d-%04x", atomic.AddUint64(&sessionCount, 1), rand.Intn(0x10000))
+}
+
 // Mycall returns this stations call sign.
-func (s *Session) Mycall() string { return s.mycall }
+func (s *Session) Mycall() string { return s.callsign(s.mycall) }
 
 // Targetcall returns the remote stations call sign (if known).
-func (s *Session) Targetcall() string { return s.targetcall }
+func (s *Session) Targetcall() string { return s.callsign(s.targetcall) }
+
+// SetNormalizeCallsigns sets whether call signs should be upper-cased. Default is true.
+//
+// Call signs are case-insensitive, but conventionally upper-case. When enabled, mycall,
+// targetcall and the (winlink) auxiliary addresses are upper-cased in the handshake.
+func (s *Session) SetNormalizeCallsigns(normalize bool) { s.normalize = normalize }
+
+// callsign returns call as it should be presented to the remote.
+func (s *Session) callsign(call string) string {
+	if !s.normalize {
+		return call
+	}
+	return strings.ToUpper(call)
+}
 
 // SetSecureLoginHandleFunc registers a callback function used to prompt for password when a secure login challenge is received.
+//
+// The callback is only required for remotes sending a secure login challenge (;PQ). Without a
+// registered callback, the handshake with a remote not requiring secure login (i.e. a gateway
+// offering the basic, non-secure login) proceeds as normal, while a challenge fails the handshake.
+//
+// The callback is called on every challenge. Neither the password nor the response is
+// cached by the session, so a session reconnecting after a failed exchange is always
+// re-authenticated using a fresh password from the callback. The exception is a password
+// given by SetPassword, which replaces the callback and is held by the session until Close.
 func (s *Session) SetSecureLoginHandleFunc(f func() (password string, err error)) {
 	s.secureLoginHandleFunc = f
 }
 
+// SetPassword sets the password used to answer secure login challenges.
+//
+// It is an alternative to SetSecureLoginHandleFunc for non-interactive use, and replaces any
+// registered callback. The password is never logged, and the session's reference to it is
+// cleared by Close.
+func (s *Session) SetPassword(password string) {
+	s.connMu.Lock()
+	s.password = password
+	s.connMu.Unlock()
+	s.secureLoginHandleFunc = s.storedPassword
+}
+
+func (s *Session) storedPassword() (string, error) {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	if s.closed {
+		return "", ErrAborted
+	}
+	return s.password, nil
+}
+
+// SetSecureLoginVerifier enables secure login of the remote node.
+//
+// When set, a session master sends a secure login challenge during handshake. The
+// callback is called with the remote's call sign (see Targetcall) and should return
+// the password used to verify the remote's response. The handshake fails with
+// ErrSecureLoginFailed if the response does not match.
+//
+// The verifier is ignored if the session is not master.
+func (s *Session) SetSecureLoginVerifier(f func(call string) (password string, err error)) {
+	s.secureLoginVerifier = f
+}
+
+// SecureLoginPerformed reports whether the handshake included a secure login.
+//
+// For a client, this is true if a secure login challenge was received and answered.
+// For a master, it is true if the remote's response to our challenge was verified
+// (see SetSecureLoginVerifier).
+func (s *Session) SecureLoginPerformed() bool { return s.secureLoginPerformed }
+
 // This method returns the call signs the remote is requesting traffic on behalf of. The call signs are not available until
 // the handshake is done.
 //
 // It will typically be the call sign of the remote P2P station and empty when the remote is a Winlink CMS.
+// If the remote did not send a ;FW line, nil is returned (see SetMissingFWAsSelf).
 func (s *Session) RemoteForwarders() []Address { return s.remoteFW }
 
+// SetMissingFWAsSelf sets how to handle a remote that omits the ;FW line in its handshake.
+//
+// By default, a remote without forwarders is assumed to be a Winlink CMS and all
+// outbound messages are offered (see OutboundHandler). If enabled, the remote is
+// instead assumed to request messages on behalf of itself (Targetcall) only.
+func (s *Session) SetMissingFWAsSelf(enabled bool) { s.missingFWAsSelf = enabled }
+
+// SetForceUncompressed forces outbound messages to be sent uncompressed using the FBB basic (ASCII) protocol.
+//
+// This is intended for debugging message corruption, as the messages are transferred as plaintext.
+// The remote must support the basic protocol (F in SID). Messages containing the ASCII end-of-message
+// marker (Ctrl-Z) can not be sent uncompressed, and are skipped.
+//
+// The compressed protocol (B2) is not advertised in our SID, so that the remote sends its messages
+// uncompressed too.
+func (s *Session) SetForceUncompressed(force bool) { s.forceUncompressed = force }
+
 // AddAuxiliaryAddress adds one or more addresses to request messages on behalf of.
 //
 // Currently the Winlink System only support requesting messages for call signs, not full email addresses.
 func (s *Session) AddAuxiliaryAddress(aux ...Address) { s.localFW = append(s.localFW, aux...) }
 
+// SetFWSort sets whether the auxiliary addresses of the ;FW line should be sorted.
+//
+// The ;FW line always starts with this session's call sign, followed by the auxiliary
+// addresses. By default, the auxiliary addresses are sent in the order they were added
+// (see AddAuxiliaryAddress). When sorting is enabled, they are sorted in lexical order
+// (after call sign normalization), making the line independent of the order of the
+// AddAuxiliaryAddress calls.
+func (s *Session) SetFWSort(sort bool) { s.fwSort = sort }
+
+// SetFWPage sets the page of auxiliary addresses to request messages on behalf of, for sessions with too many
+// auxiliary addresses to request in a single exchange (i.e. a gateway serving a large tactical deployment).
+//
+// The B2F protocol has no way of negotiating paging with the remote, and the Winlink System does not document a
+// limit on the ;FW line. Paging is done by the caller, in one exchange per page: The auxiliary addresses (after
+// authorization and sorting, see SetFWSort) are split into pages of at most size addresses, and only the given
+// page (counting from zero) is requested. Use FWPages to get the number of pages. The session's own call sign is
+// requested on every page, and a page beyond the last requests the session's call sign only. With secure login,
+// every auxiliary address is sent with the password hash (9 bytes). Enable sorting to keep the pages stable as
+// addresses are added.
+//
+// A size of zero disables paging (the default).
+func (s *Session) SetFWPage(page, size int) { s.fwPage, s.fwPageSize = page, size }
+
+// FWPages returns the number of pages of auxiliary addresses (see SetFWPage). It's one if paging is disabled.
+func (s *Session) FWPages() int {
+	aux := len(s.fwAddresses(false)) - 1
+	if s.fwPageSize <= 0 || aux <= s.fwPageSize {
+		return 1
+	}
+	return (aux + s.fwPageSize - 1) / s.fwPageSize
+}
+
+// SetAuthorizedCallsFunc sets a function used to validate the auxiliary addresses before
+// requesting messages on their behalf (see AddAuxiliaryAddress).
+//
+// Requesting messages for a call sign we are not authorized to forward for is rejected by the
+// gateway, and wastes a connect. Addresses for which the function returns false are left out
+// of the ;FW line with a warning. The session's own call sign is always requested.
+func (s *Session) SetAuthorizedCallsFunc(f func(addr Address) bool) { s.isAuthorizedCall = f }
+
 // Set callback for status updates on receiving / sending messages
 func (s *Session) SetStatusUpdater(updater StatusUpdater) { s.statusUpdater = updater }
 
@@ -347,40 +1172,82 @@ func (s *Session) SetUserAgent(ua UserAgent) { s.ua = ua }
 func (s *Session) UserAgent() UserAgent { return s.ua }
 
 func (s *Session) outbound() []*Proposal {
-	if s.h == nil {
+	h := s.outboundHandler()
+	if h == nil || s.direction == Receive {
 		return []*Proposal{}
 	}
 
-	msgs := s.h.GetOutbound(s.remoteFW...)
+	msgs := h.GetOutbound(s.remoteFW...)
 	props := make([]*Proposal, 0, len(msgs))
 
 	for _, m := range msgs {
+		if s.outboundHeader != nil {
+			s.outboundHeader(m)
+		}
+		if s.traceHeader != nil {
+			s.addTraceHeader(m)
+		}
+		if m.Header.Get(HEADER_DATE) == "" {
+			m.Header.Set(HEADER_DATE, s.transfers.date(m.MID(), s.messageTime()))
+		}
+
 		// It seems reasonable to ignore these with a warning
 		if err := m.Validate(); err != nil {
 			s.log.Printf("Ignoring invalid outbound message '%s': %s", m.MID(), err)
+			s.messageFailed(m.MID(), err)
 			continue
 		}
 
-		prop, err := m.Proposal(s.highestPropCode())
+		code := s.highestPropCode()
+		if code == GzipProposal && s.gzipRefused[m.MID()] {
+			code = Wl2kProposal
+		}
+
+		prop, err := m.Proposal(code)
 		if err != nil {
 			s.log.Printf("Unable to prepare proposal for '%s'. Corrupt message? Ignoring...", m.MID())
+			s.messageFailed(m.MID(), err)
+			continue
+		}
+
+		if prop.code == BasicProposal && bytes.IndexByte(prop.compressedData, _CHRSUB) >= 0 {
+			s.log.Printf("Ignoring '%s': Unable to send uncompressed (contains Ctrl-Z)", m.MID())
+			s.messageFailed(m.MID(), errors.New("Unable to send uncompressed (contains Ctrl-Z)"))
+			continue
+		}
+
+		if s.isExpired != nil && s.isExpired(*prop) {
+			if !s.expired[m.MID()] {
+				s.log.Printf("Skipping expired message %s", m.MID())
+				s.expired[m.MID()] = true
+				s.trafficStats.Expired = append(s.trafficStats.Expired, m.MID())
+			}
+			continue
+		}
+
+		if max := s.remoteMaxMessageSize; max > 0 && prop.size > max {
+			s.log.Printf("Defering %s (size %d exceeds the remote's limit of %d bytes)", m.MID(), prop.size, max)
+			s.setDeferred(m.MID(), ExceedsRemoteSize)
 			continue
 		}
 
 		props = append(props, prop)
 	}
 
-	// Sort the proposals by size, smallest first as suggested by the Winlink FAQ Q460.
-	sort.Sort(bySize(props))
+	// Sort the proposals by precedence (highest first), then size (smallest first as suggested by the Winlink FAQ Q460).
+	sort.Sort(byPrecedence(props))
 
 	return props
 }
 
-type bySize []*Proposal
+type byPrecedence []*Proposal
 
-func (s bySize) Len() int      { return len(s) }
-func (s bySize) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
-func (s bySize) Less(i, j int) bool {
+func (s byPrecedence) Len() int      { return len(s) }
+func (s byPrecedence) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byPrecedence) Less(i, j int) bool {
+	if pi, pj := s[i].Precedence(), s[j].Precedence(); pi != pj {
+		return pi > pj
+	}
 	if s[i].compressedSize != s[j].compressedSize {
 		return s[i].compressedSize < s[j].compressedSize
 	}
@@ -388,6 +1255,9 @@ func (s bySize) Less(i, j int) bool {
 }
 
 func (s *Session) highestPropCode() PropCode {
+	if s.basicMode() {
+		return BasicProposal
+	}
 	if s.remoteSID.Has(sGzip) && gzipExperimentEnabled() {
 		return GzipProposal
 	}
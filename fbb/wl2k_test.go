@@ -6,12 +6,176 @@ package fbb
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
+// memMBox is an in-memory MBoxHandler used for testing.
+type memMBox struct {
+	mu       sync.Mutex
+	out      []*Message
+	in       []*Message
+	sent     map[string]bool
+	deferred map[string]bool
+	fw       []Address  // The fw addresses given in the last call to GetOutbound
+	answered []Proposal // The proposals given to GetInboundAnswer
+
+	answerFunc func(Proposal) ProposalAnswer // Overrides the default answer if non-nil
+}
+
+func newMemMBox(out ...*Message) *memMBox {
+	return &memMBox{out: out, sent: make(map[string]bool), deferred: make(map[string]bool)}
+}
+
+func (m *memMBox) Prepare() error { return nil }
+
+func (m *memMBox) GetOutbound(fw ...Address) []*Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fw = fw
+
+	var out []*Message
+	for _, msg := range m.out {
+		if _, ok := m.sent[msg.MID()]; ok || m.deferred[msg.MID()] {
+			continue
+		}
+		out = append(out, msg)
+	}
+	return out
+}
+
+func (m *memMBox) SetSent(MID string, rejected bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent[MID] = rejected
+}
+
+func (m *memMBox) SetDeferred(MID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deferred[MID] = true
+}
+
+func (m *memMBox) ProcessInbound(msgs ...*Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.in = append(m.in, msgs...)
+	return nil
+}
+
+func (m *memMBox) GetInboundAnswer(p Proposal) ProposalAnswer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.answered = append(m.answered, p)
+	if m.answerFunc != nil {
+		return m.answerFunc(p)
+	}
+	for _, msg := range m.in {
+		if msg.MID() == p.MID() {
+			return Reject
+		}
+	}
+	return Accept
+}
+
+func (m *memMBox) inbox() []*Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*Message(nil), m.in...)
+}
+
+// tcpPipe returns both ends of a loopback TCP connection.
+//
+// Unlike net.Pipe, writes are buffered by the kernel so that both ends can
+// report errors to each other without deadlocking.
+func tcpPipe(t *testing.T) (a, b net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+
+	if a, err = net.Dial("tcp", ln.Addr().String()); err != nil {
+		t.Fatalf("Unable to dial: %s", err)
+	}
+	if b = <-accepted; b == nil {
+		t.Fatalf("Unable to accept connection")
+	}
+	return a, b
+}
+
+// exchange runs an exchange between the client and the master session over a tcpPipe,
+// failing the test if either side returns an error.
+func exchange(t *testing.T, client, master *Session) (cStats, mStats TrafficStats) {
+	t.Helper()
+	a, b := tcpPipe(t)
+	cStats, mStats, cErr, mErr := exchangeConns(client, master, a, b)
+	if cErr != nil || mErr != nil {
+		t.Fatalf("Exchange failed: %v, %v", cErr, mErr)
+	}
+	return cStats, mStats
+}
+
+// exchangeConns runs an exchange between the client and the master session over the given
+// connections, returning the result of both sides. The master session is made master.
+func exchangeConns(client, master *Session, cConn, mConn net.Conn) (cStats, mStats TrafficStats, cErr, mErr error) {
+	master.IsMaster(true)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mStats, mErr = master.Exchange(mConn)
+	}()
+	cStats, cErr = client.Exchange(cConn)
+	<-done
+	return
+}
+
+func newTestMessage(from, to string, bodySize int) *Message {
+	msg := NewMessage(Private, from)
+	msg.AddTo(to)
+	msg.SetSubject("Test message")
+
+	// Random data compresses poorly, which gives us multiple data blocks
+	body := make([]byte, bodySize)
+	for i := range body {
+		if i%72 == 71 {
+			body[i] = '\n'
+		} else {
+			body[i] = byte('a' + rand.Intn(26))
+		}
+	}
+	msg.SetBody(string(body))
+	return msg
+}
+
+// writeHookConn calls fn before every write to the underlying connection.
+type writeHookConn struct {
+	net.Conn
+	fn func(p []byte)
+}
+
+func (c writeHookConn) Write(p []byte) (int, error) { c.fn(p); return c.Conn.Write(p) }
+
 //[WL2K-2.8.4.8-B2FWIHJM$]
 //Brentwood CMS >
 //	;FW: LA5NTA
@@ -187,3 +351,1364 @@ func TestSessionCMSv4(t *testing.T) {
 		t.Errorf("Session exchange returned error: %s", err)
 	}
 }
+
+func TestSessionAbortMidMessage(t *testing.T) {
+	client, master := tcpPipe(t)
+
+	msg := newTestMessage("LA5NTA", "N0CALL", 5000)
+	clientMBox, masterMBox := newMemMBox(msg), newMemMBox()
+
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", clientMBox)
+
+	// Abort as soon as the first data block is written
+	conn := writeHookConn{client, func(p []byte) {
+		if len(p) > 0 && p[0] == _CHRSTX {
+			s.Abort()
+		}
+	}}
+	_, _, clientErr, masterErr := exchangeConns(s, NewSession("N0CALL", "LA5NTA", "JO39EQ", masterMBox), conn, master)
+
+	if clientErr != ErrAborted {
+		t.Errorf("Expected client to return ErrAborted, got: %v", clientErr)
+	}
+	if masterErr == nil || masterErr.Error() != "Bad checksum" {
+		t.Errorf("Expected master to report bad checksum, got: %v", masterErr)
+	}
+
+	if n := len(masterMBox.inbox()); n != 0 {
+		t.Errorf("Expected the partial message to be discarded, but master stored %d message(s)", n)
+	}
+	if _, ok := clientMBox.sent[msg.MID()]; ok {
+		t.Errorf("Aborted message was marked as sent")
+	}
+}
+
+func TestSessionMissingFW(t *testing.T) {
+	tests := []struct {
+		missingFWAsSelf bool
+		expect          []Address
+	}{
+		{false, nil},
+		{true, []Address{AddressFromString("N0CALL")}},
+	}
+
+	for i, test := range tests {
+		client, srv := net.Pipe()
+		mbox := newMemMBox()
+
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", mbox)
+		s.SetMissingFWAsSelf(test.missingFWAsSelf)
+
+		cerrs := make(chan error)
+		go func() {
+			_, err := s.Exchange(client)
+			cerrs <- err
+		}()
+
+		// Handshake with SID but without ;FW
+		fmt.Fprint(srv, "[RMS Express-1.2.35.0-B2FHM$]\r")
+		fmt.Fprint(srv, "; LA5NTA DE N0CALL (JO39EQ)>\r")
+
+		rd := bufio.NewReader(srv)
+		for {
+			line, err := rd.ReadString('\r')
+			if err != nil {
+				t.Fatalf("%d: Unexpected error: %s", i, err)
+			} else if line == "FF\r" {
+				break
+			}
+		}
+		fmt.Fprint(srv, "FQ\r")
+		srv.Close()
+
+		if err := <-cerrs; err != nil {
+			t.Errorf("%d: Session exchange returned error: %s", i, err)
+		}
+		if got := s.RemoteForwarders(); !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("%d: Expected remote forwarders %v, got %v", i, test.expect, got)
+		}
+		if !reflect.DeepEqual(mbox.fw, test.expect) {
+			t.Errorf("%d: Expected GetOutbound to be called with %v, got %v", i, test.expect, mbox.fw)
+		}
+	}
+}
+
+func TestSessionRemoteMaxMessageSize(t *testing.T) {
+	small, large := newTestMessage("LA5NTA", "N0CALL", 100), newTestMessage("LA5NTA", "N0CALL", 5000)
+	mbox := newMemMBox(small, large)
+
+	client, srv := net.Pipe()
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", mbox)
+
+	cerrs := make(chan error)
+	go func() {
+		_, err := s.Exchange(client)
+		cerrs <- err
+	}()
+
+	fmt.Fprint(srv, "[WL2K-2.8.4.8-B2FWIHJM$]\r")
+	fmt.Fprint(srv, "Max message size: 1000 bytes\r")
+	fmt.Fprint(srv, "Test CMS >\r")
+
+	var proposals []string
+	rd := bufio.NewReader(srv)
+	for {
+		line, err := rd.ReadString('\r')
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		} else if strings.HasPrefix(line, "FC") {
+			proposals = append(proposals, line)
+		} else if strings.HasPrefix(line, "F>") {
+			break
+		}
+	}
+	fmt.Fprint(srv, "FS -\r") // Already received
+	rd.ReadString('\r')       // FF (turnover)
+	fmt.Fprint(srv, "FQ\r")
+	srv.Close()
+
+	if err := <-cerrs; err != nil {
+		t.Errorf("Session exchange returned error: %s", err)
+	}
+	if got := s.RemoteMaxMessageSize(); got != 1000 {
+		t.Errorf("Expected remote max message size 1000, got %d", got)
+	}
+	if len(proposals) != 1 || !strings.Contains(proposals[0], small.MID()) {
+		t.Errorf("Expected only %s to be proposed, got %q", small.MID(), proposals)
+	}
+	if !mbox.deferred[large.MID()] {
+		t.Errorf("Expected %s to be deferred", large.MID())
+	}
+}
+
+func TestDirectionString(t *testing.T) {
+	tests := map[Direction]string{
+		Inbound:      "inbound",
+		Outbound:     "outbound",
+		Direction(7): "Direction(7)",
+	}
+	for d, expected := range tests {
+		if got := d.String(); got != expected {
+			t.Errorf("Expected %q, got %q", expected, got)
+		}
+	}
+}
+
+// statusRecorder is a StatusUpdater recording all updates.
+type statusRecorder struct {
+	mu      sync.Mutex
+	updates []Status
+}
+
+func (r *statusRecorder) UpdateStatus(s Status) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.updates = append(r.updates, s)
+}
+
+func (r *statusRecorder) all() []Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Status(nil), r.updates...)
+}
+
+func TestStatusDirection(t *testing.T) {
+	clientMBox := newMemMBox(newTestMessage("LA5NTA", "N0CALL", 1000))
+	masterMBox := newMemMBox(newTestMessage("N0CALL", "LA5NTA", 1000))
+	clientStatus, masterStatus := new(statusRecorder), new(statusRecorder)
+
+	client := NewSession("LA5NTA", "N0CALL", "JO39EQ", clientMBox)
+	client.SetStatusUpdater(clientStatus)
+	master := NewSession("N0CALL", "LA5NTA", "JO39EQ", masterMBox)
+	master.SetStatusUpdater(masterStatus)
+	exchange(t, client, master)
+
+	for _, r := range []*statusRecorder{clientStatus, masterStatus} {
+		seen := make(map[Direction]bool)
+		for _, update := range r.all() {
+			switch {
+			case update.Sending != nil && update.Direction() != Outbound:
+				t.Errorf("Expected outbound direction while sending, got %s", update.Direction())
+			case update.Receiving != nil && update.Direction() != Inbound:
+				t.Errorf("Expected inbound direction while receiving, got %s", update.Direction())
+			}
+			seen[update.Direction()] = true
+		}
+		if !seen[Inbound] || !seen[Outbound] {
+			t.Errorf("Expected status updates in both directions, got %v", seen)
+		}
+	}
+}
+
+func TestSessionCMSRemoteSummary(t *testing.T) {
+	tests := map[string]string{
+		"; 2 messages accepted\r": "2 messages accepted",
+		"":                        "",
+		";WARNING: Foo bar baz\r": "",
+		";PM: LA5NTA TJKYEIMMHSRB 123 foo@bar.baz\r": "",
+	}
+
+	for lines, expected := range tests {
+		client, srv := net.Pipe()
+
+		stats := make(chan TrafficStats, 1)
+		cerrs := make(chan error, 1)
+		go func() {
+			s := NewSession("LA5NTA", "LA1B-10", "JO39EQ", nil)
+			st, err := s.Exchange(client)
+			stats <- st
+			cerrs <- err
+		}()
+
+		fmt.Fprint(srv, "[WL2K-2.8.4.8-B2FWIHJM$]\r")
+		fmt.Fprint(srv, "Test CMS >\r")
+
+		// Read until FF
+		rd := bufio.NewReader(srv)
+		for line := ""; line != "FF\r"; {
+			line, _ = rd.ReadString('\r')
+		}
+
+		fmt.Fprint(srv, lines)
+		fmt.Fprint(srv, "FQ\r")
+		srv.Close()
+
+		if err := <-cerrs; err != nil {
+			t.Errorf("Session exchange returned error: %s", err)
+		}
+		if got := (<-stats).RemoteSummary; got != expected {
+			t.Errorf("Expected remote summary %q, got %q", expected, got)
+		}
+	}
+}
+
+func TestSessionForceUncompressed(t *testing.T) {
+	var sizes [2]int // Bytes written by the sending node (compressed, uncompressed)
+
+	for i, force := range []bool{false, true} {
+		client, master := tcpPipe(t)
+
+		msg := NewMessage(Private, "LA5NTA")
+		msg.AddTo("N0CALL")
+		msg.SetSubject("Compressible")
+		msg.SetBody(strings.Repeat("The quick brown fox jumps over the lazy dog.\n", 100))
+		clientMBox, masterMBox := newMemMBox(msg), newMemMBox()
+
+		var proposals []string
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", clientMBox)
+		s.SetForceUncompressed(force)
+		conn := writeHookConn{client, func(p []byte) {
+			sizes[i] += len(p)
+			if len(p) > 1 && p[0] == 'F' && (p[1] == 'B' || p[1] == 'C') {
+				proposals = append(proposals, string(p))
+			}
+		}}
+		_, _, cErr, mErr := exchangeConns(s, NewSession("N0CALL", "LA5NTA", "JO39EQ", masterMBox), conn, master)
+		if cErr != nil || mErr != nil {
+			t.Fatalf("force=%t: Exchange failed: %v, %v", force, cErr, mErr)
+		}
+
+		inbox := masterMBox.inbox()
+		if len(inbox) != 1 {
+			t.Fatalf("force=%t: Expected 1 received message, got %d", force, len(inbox))
+		}
+		expected, _ := msg.Bytes()
+		if got, _ := inbox[0].Bytes(); !bytes.Equal(got, expected) {
+			t.Errorf("force=%t: Received message does not match the sent message", force)
+		}
+
+		if len(proposals) != 1 {
+			t.Errorf("force=%t: Expected one proposal, got %q", force, proposals)
+		} else if expect := map[bool]string{false: "FC ", true: "FB P LA5NTA N0CALL N0CALL "}[force]; !strings.HasPrefix(proposals[0], expect) {
+			t.Errorf("force=%t: Expected proposal prefix %q, got %q", force, expect, proposals[0])
+		}
+	}
+
+	if sizes[1] <= sizes[0] {
+		t.Errorf("Expected uncompressed transfer to be larger than compressed (%d <= %d)", sizes[1], sizes[0])
+	}
+}
+
+func TestSessionForceUncompressedSID(t *testing.T) {
+	for _, force := range []bool{false, true} {
+		var buf bytes.Buffer
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+		s.SetForceUncompressed(force)
+		if err := s.sendHandshake(&buf, ""); err != nil {
+			t.Fatal(err)
+		}
+		if hasB2 := strings.Contains(buf.String(), "-B2FHM$]"); hasB2 == force {
+			t.Errorf("force=%t: Unexpected SID in handshake %q", force, buf.String())
+		}
+	}
+}
+
+func TestSessionRemoteForcesUncompressed(t *testing.T) {
+	out, in := newTestMessage("LA5NTA", "N0CALL", 1000), newTestMessage("N0CALL", "LA5NTA", 1000)
+	clientMBox, masterMBox := newMemMBox(out), newMemMBox(in)
+
+	// Only the master forces uncompressed transfers, the client follows its SID
+	client, master := tcpPipe(t)
+	var proposals []string
+	conn := writeHookConn{client, func(p []byte) {
+		if len(p) > 1 && p[0] == 'F' && (p[1] == 'B' || p[1] == 'C') {
+			proposals = append(proposals, string(p))
+		}
+	}}
+	ms := NewSession("N0CALL", "LA5NTA", "JO39EQ", masterMBox)
+	ms.SetForceUncompressed(true)
+	if _, _, cErr, mErr := exchangeConns(NewSession("LA5NTA", "N0CALL", "JO39EQ", clientMBox), ms, conn, master); cErr != nil || mErr != nil {
+		t.Fatalf("Exchange failed: %v, %v", cErr, mErr)
+	}
+
+	if len(proposals) != 1 || !strings.HasPrefix(proposals[0], "FB ") {
+		t.Errorf("Expected the client to propose uncompressed, got %q", proposals)
+	}
+	for _, test := range []struct {
+		mbox *memMBox
+		msg  *Message
+	}{{masterMBox, out}, {clientMBox, in}} {
+		inbox := test.mbox.inbox()
+		expected, _ := test.msg.Bytes()
+		if len(inbox) != 1 {
+			t.Errorf("Expected %s to be received, got %d messages", test.msg.MID(), len(inbox))
+		} else if got, _ := inbox[0].Bytes(); !bytes.Equal(got, expected) {
+			t.Errorf("Received %s does not match the sent message", test.msg.MID())
+		}
+	}
+}
+
+func TestSessionDefersCompressedFB(t *testing.T) {
+	client, srv := net.Pipe()
+	mbox := newMemMBox()
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", mbox)
+
+	type result struct {
+		stats TrafficStats
+		err   error
+	}
+	results := make(chan result, 1)
+	go func() {
+		stats, err := s.Exchange(client)
+		results <- result{stats, err}
+	}()
+
+	rd := bufio.NewReader(srv)
+	fmt.Fprint(srv, "[FBB-7.00-B2FHM$]\rN0CALL BBS >\r")
+	for line := ""; line != "FF\r"; {
+		line, _ = rd.ReadString('\r')
+	}
+
+	// A compressed binary message in FB syntax
+	line := "FB P F6FBB LA5NTA LA5NTA 24657_F6FB 1345"
+	sum := 0
+	for _, c := range line + "\r" {
+		sum += int(c)
+	}
+	fmt.Fprintf(srv, "%s\rF> %02X\r", line, (-sum)&0xff)
+	answer, _ := rd.ReadString('\r')
+	fmt.Fprint(srv, "FF\r")
+	go ioutil.ReadAll(rd)
+
+	res := <-results
+	srv.Close()
+	if res.err != nil {
+		t.Fatalf("Unexpected error: %s", res.err)
+	}
+	if answer != "FS =\r" {
+		t.Errorf("Expected the proposal to be deferred, got %q", answer)
+	}
+	if len(res.stats.Refused) != 1 || res.stats.Refused[0].Reason != "unsupported format" {
+		t.Errorf("Unexpected refusals: %+v", res.stats.Refused)
+	}
+	if len(mbox.answered) != 0 {
+		t.Errorf("Expected the proposal not to be passed to the handler")
+	}
+}
+
+func TestSessionSecureLoginPerformed(t *testing.T) {
+	tests := map[string]bool{
+		"[WL2K-5.0-B2FWIHJM$]\r;PQ: 23753528\rTest CMS >\r": true,
+		"[WL2K-5.0-B2FWIHJM$]\rTest CMS >\r":                false,
+	}
+
+	for handshake, expected := range tests {
+		client, srv := net.Pipe()
+
+		s := NewSession("LA5NTA", "LA1B-10", "JO39EQ", nil)
+		s.SetSecureLoginHandleFunc(func() (string, error) { return "foobar", nil })
+
+		cerrs := make(chan error, 1)
+		go func() {
+			_, err := s.Exchange(client)
+			cerrs <- err
+		}()
+
+		fmt.Fprint(srv, handshake)
+
+		var gotResponse bool
+		rd := bufio.NewReader(srv)
+		for line := ""; line != "FF\r"; {
+			line, _ = rd.ReadString('\r')
+			gotResponse = gotResponse || strings.HasPrefix(line, ";PR: ")
+		}
+		fmt.Fprint(srv, "FQ\r")
+		srv.Close()
+
+		if err := <-cerrs; err != nil {
+			t.Errorf("Session exchange returned error: %s", err)
+		}
+		if gotResponse != expected {
+			t.Errorf("Expected secure login response sent to be %t", expected)
+		}
+		if got := s.SecureLoginPerformed(); got != expected {
+			t.Errorf("Expected SecureLoginPerformed() to be %t, got %t", expected, got)
+		}
+	}
+}
+
+func TestSessionSecureLoginNotCached(t *testing.T) {
+	s := NewSession("LA5NTA", "LA1B-10", "JO39EQ", nil)
+	var calls int
+	s.SetSecureLoginHandleFunc(func() (string, error) { calls++; return "foobar", nil })
+
+	for i, complete := range []bool{false, true} {
+		client, srv := net.Pipe()
+
+		cerrs := make(chan error, 1)
+		go func() {
+			_, err := s.Exchange(client)
+			cerrs <- err
+		}()
+
+		fmt.Fprint(srv, "[WL2K-5.0-B2FWIHJM$]\r;PQ: 23753528\rTest CMS >\r")
+		rd := bufio.NewReader(srv)
+		for line := ""; line != "FF\r"; {
+			line, _ = rd.ReadString('\r')
+		}
+		if complete {
+			fmt.Fprint(srv, "FQ\r")
+		}
+		srv.Close() // The first connect is dropped before the exchange completes
+
+		if err := <-cerrs; complete != (err == nil) {
+			t.Errorf("Connect %d: Unexpected exchange result: %v", i+1, err)
+		}
+		if calls != i+1 {
+			t.Errorf("Connect %d: Expected the secure login handler to be called %d time(s), got %d", i+1, i+1, calls)
+		}
+	}
+}
+
+func TestSessionHandshakeThenTransfer(t *testing.T) {
+	client, master := tcpPipe(t)
+
+	msg := newTestMessage("LA5NTA", "N0CALL", 1000)
+	cs := NewSession("LA5NTA", "N0CALL", "JO39EQ", newMemMBox(msg))
+	mbox := newMemMBox()
+	ms := NewSession("N0CALL", "LA5NTA", "JO39EQ", mbox)
+	ms.IsMaster(true)
+
+	merrs := make(chan error, 1)
+	go func() { _, err := ms.Exchange(master); merrs <- err }()
+
+	if _, err := cs.Transfer(); err != ErrNoHandshake {
+		t.Errorf("Expected ErrNoHandshake, got %v", err)
+	}
+
+	caps, err := cs.Handshake(client)
+	if err != nil {
+		t.Fatalf("Handshake failed: %s", err)
+	}
+	if caps.RemoteUA.Name != StdUA.Name {
+		t.Errorf("Unexpected remote user agent: %+v", caps.RemoteUA)
+	}
+
+	stats, err := cs.Transfer()
+	if err != nil {
+		t.Fatalf("Transfer failed: %s", err)
+	}
+	if err := <-merrs; err != nil {
+		t.Fatalf("Master exchange failed: %s", err)
+	}
+	if len(stats.Sent) != 1 || len(mbox.inbox()) != 1 {
+		t.Errorf("Expected one message transferred, sent %v", stats.Sent)
+	}
+}
+
+func TestSessionHandshakeThenDisconnect(t *testing.T) {
+	client, master := tcpPipe(t)
+
+	cs := NewSession("LA5NTA", "N0CALL", "JO39EQ", newMemMBox(newTestMessage("LA5NTA", "N0CALL", 1000)))
+	mbox := newMemMBox()
+	ms := NewSession("N0CALL", "LA5NTA", "JO39EQ", mbox)
+	ms.IsMaster(true)
+
+	merrs := make(chan error, 1)
+	go func() { _, err := ms.Exchange(master); merrs <- err }()
+
+	if _, err := cs.Handshake(client); err != nil {
+		t.Fatalf("Handshake failed: %s", err)
+	}
+	cs.Close()
+
+	if err := <-merrs; err == nil {
+		t.Errorf("Expected the master's exchange to fail after disconnect")
+	}
+	if _, err := cs.Transfer(); err != ErrAborted {
+		t.Errorf("Expected ErrAborted from Transfer after Close, got %v", err)
+	}
+	if len(mbox.inbox()) != 0 {
+		t.Errorf("Unexpected message transferred after disconnect")
+	}
+}
+
+func TestSessionOutboundHeaderFunc(t *testing.T) {
+	msg := newTestMessage("LA5NTA", "N0CALL", 1000)
+	cs := NewSession("LA5NTA", "N0CALL", "JO39EQ", newMemMBox(msg))
+	cs.SetOutboundHeaderFunc(func(m *Message) { m.Header.Set("X-Tracking", "abc123") })
+	mbox := newMemMBox()
+	ms := NewSession("N0CALL", "LA5NTA", "JO39EQ", mbox)
+
+	exchange(t, cs, ms)
+
+	inbox := mbox.inbox()
+	if len(inbox) != 1 {
+		t.Fatalf("Expected one received message, got %d", len(inbox))
+	}
+	if got := inbox[0].Header.Get("X-Tracking"); got != "abc123" {
+		t.Errorf("Expected the injected header on the receiving side, got %q", got)
+	}
+}
+
+func TestSessionCMSPendingMessageMetadata(t *testing.T) {
+	client, srv := net.Pipe()
+	mbox := newMemMBox()
+	mbox.answerFunc = func(Proposal) ProposalAnswer { return Defer }
+
+	cerrs := make(chan error)
+	go func() {
+		s := NewSession("LA5NTA", "LA1B-10", "JO39EQ", mbox)
+		_, err := s.Exchange(client)
+		cerrs <- err
+	}()
+
+	fmt.Fprint(srv, "[WL2K-4.0-B2FWIHJM$]\r")
+	fmt.Fprint(srv, "Test CMS >\r")
+
+	rd := bufio.NewReader(srv)
+	for line := ""; line != "FF\r"; {
+		line, _ = rd.ReadString('\r')
+	}
+
+	fmt.Fprintf(srv, ";PM: LA5NTA TJKYEIMMHSRB 123 martin.h.pedersen@gmail.com\r")
+	fmt.Fprintf(srv, "FC EM TJKYEIMMHSRB 527 123 0\r")
+	fmt.Fprintf(srv, "FC EM TJKYEIMMHSRC 527 123 0\r") // Without ;PM
+	fmt.Fprintf(srv, "F> 75\r")
+
+	if line, _ := rd.ReadString('\r'); line != "FS ==\r" {
+		t.Errorf("Expected 'FS ==', got '%s'", line)
+	}
+	fmt.Fprintf(srv, "FF\r")
+	rd.ReadString('\r') // FQ
+
+	if err := <-cerrs; err != nil {
+		t.Fatalf("Session exchange returned error: %s", err)
+	}
+
+	if len(mbox.answered) != 2 {
+		t.Fatalf("Expected 2 proposals, got %d", len(mbox.answered))
+	}
+	p := mbox.answered[0]
+	if from := p.From(); from != AddressFromString("martin.h.pedersen@gmail.com") {
+		t.Errorf("Unexpected sender: %s", from)
+	}
+	if to := p.To(); to != AddressFromString("LA5NTA") {
+		t.Errorf("Unexpected recipient: %s", to)
+	}
+	if p := mbox.answered[1]; !p.From().IsZero() || !p.To().IsZero() {
+		t.Errorf("Expected unknown sender/recipient, got %s/%s", p.From(), p.To())
+	}
+}
+
+func TestSessionDeferrals(t *testing.T) {
+	a, b := newTestMessage("LA5NTA", "N0CALL", 100), newTestMessage("LA5NTA", "N0CALL", 100)
+	large := newTestMessage("LA5NTA", "N0CALL", 5000)
+	mbox := newMemMBox(a, b, large)
+
+	client, srv := net.Pipe()
+	clock := newFakeClock()
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", mbox)
+	s.clock = clock
+	s.SetDeferralPolicy(DeferralPolicy{Delay: time.Hour})
+
+	type result struct {
+		stats TrafficStats
+		err   error
+	}
+	results := make(chan result)
+	go func() {
+		stats, err := s.Exchange(client)
+		results <- result{stats, err}
+	}()
+
+	fmt.Fprint(srv, "[WL2K-2.8.4.8-B2FWIHJM$]\r")
+	fmt.Fprint(srv, "Max message size: 1000 bytes\r")
+	fmt.Fprint(srv, "Test CMS >\r")
+
+	var proposals []string
+	rd := bufio.NewReader(srv)
+	for {
+		line, err := rd.ReadString('\r')
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		} else if strings.HasPrefix(line, "FC") {
+			proposals = append(proposals, line)
+		} else if strings.HasPrefix(line, "F>") {
+			break
+		}
+	}
+	if len(proposals) != 2 {
+		t.Fatalf("Unexpected proposals: %q", proposals)
+	}
+	first, second := a, b // Proposals are sorted by size
+	if !strings.Contains(proposals[0], first.MID()) {
+		first, second = b, a
+	}
+	fmt.Fprint(srv, "FS =H\r")
+	rd.ReadString('\r') // FF (turnover)
+	fmt.Fprint(srv, "FQ\r")
+	srv.Close()
+
+	res := <-results
+	if res.err != nil {
+		t.Fatalf("Session exchange returned error: %s", res.err)
+	}
+
+	retryAfter := clock.Now().Add(time.Hour)
+	expected := []Deferral{
+		{MID: large.MID(), Reason: ExceedsRemoteSize, Attempts: 1, RetryAfter: retryAfter},
+		{MID: first.MID(), Reason: DeferredByRemote, Attempts: 1, RetryAfter: retryAfter},
+		{MID: second.MID(), Reason: HeldByRemote, Attempts: 1, RetryAfter: retryAfter},
+	}
+	if !reflect.DeepEqual(res.stats.Deferred, expected) {
+		t.Errorf("Unexpected deferrals.\nGot:      %+v\nExpected: %+v", res.stats.Deferred, expected)
+	}
+	for _, d := range expected {
+		if !mbox.deferred[d.MID] {
+			t.Errorf("Expected %s to be marked as deferred", d.MID)
+		}
+	}
+}
+
+func TestSessionDeferralBackoff(t *testing.T) {
+	msg := newTestMessage("LA5NTA", "N0CALL", 100)
+	mbox := newMemMBox(msg)
+	store := NewTransferStore()
+	clock := newFakeClock()
+
+	deferOnce := func() Deferral {
+		client, srv := net.Pipe()
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", mbox)
+		s.clock = clock
+		s.SetTransferStore(store)
+		s.SetDeferralPolicy(DeferralPolicy{Delay: time.Hour})
+
+		errs := make(chan error, 1)
+		stats := make(chan TrafficStats, 1)
+		go func() {
+			st, err := s.Exchange(client)
+			stats <- st
+			errs <- err
+		}()
+
+		rd := bufio.NewReader(srv)
+		fmt.Fprint(srv, "[WL2K-2.8.4.8-B2FWIHJM$]\rTest CMS >\r")
+		readProposal(t, rd)
+		fmt.Fprint(srv, "FS =\r")
+		rd.ReadString('\r') // FF (turnover)
+		fmt.Fprint(srv, "FQ\r")
+		srv.Close()
+
+		st := <-stats
+		if err := <-errs; err != nil {
+			t.Fatalf("Session exchange returned error: %s", err)
+		} else if len(st.Deferred) != 1 {
+			t.Fatalf("Unexpected deferrals: %+v", st.Deferred)
+		}
+		return st.Deferred[0]
+	}
+
+	first := deferOnce()
+	mbox.deferred = make(map[string]bool) // Retried by the caller on the next connect
+	second := deferOnce()
+
+	if first.Attempts != 1 || second.Attempts != 2 {
+		t.Errorf("Expected attempts 1 and 2, got %d and %d", first.Attempts, second.Attempts)
+	}
+	if d := first.RetryAfter.Sub(clock.Now()); d != time.Hour {
+		t.Errorf("Expected the first retry after an hour, got %s", d)
+	}
+	if d := second.RetryAfter.Sub(clock.Now()); d != 2*time.Hour {
+		t.Errorf("Expected the second retry after two hours, got %s", d)
+	}
+}
+
+func TestSessionRemoteHold(t *testing.T) {
+	var msgs []*Message
+	for i := 0; i < MaxBlockSize+1; i++ {
+		msgs = append(msgs, newTestMessage("LA5NTA", "N0CALL", 100))
+	}
+	mbox := newMemMBox(msgs...)
+
+	client, srv := net.Pipe()
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", mbox)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := s.Exchange(client)
+		errs <- err
+	}()
+
+	rd := bufio.NewReader(srv)
+	readProposals := func() (proposals []string) {
+		for {
+			line, err := rd.ReadString('\r')
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			} else if strings.HasPrefix(line, "FC") {
+				proposals = append(proposals, line)
+			} else if strings.HasPrefix(line, "F>") {
+				return proposals
+			}
+		}
+	}
+
+	fmt.Fprint(srv, "[WL2K-2.8.4.8-B2FWIHJM$]\rTest CMS >\r")
+	held := readProposals()
+	if len(held) != MaxBlockSize {
+		t.Fatalf("Unexpected proposals: %q", held)
+	}
+	fmt.Fprint(srv, "FS "+strings.Repeat("H", MaxBlockSize)+"\r")
+
+	// The session must pause by turning over, instead of proposing the remaining message
+	if line, _ := rd.ReadString('\r'); line != "FF\r" {
+		t.Fatalf("Expected turnover after hold, got %q", line)
+	}
+
+	// ... and resume proposing in its next turn
+	fmt.Fprint(srv, "FF\r")
+	p := readProposals()
+	if len(p) != 1 {
+		t.Fatalf("Expected the remaining message to be proposed, got %q", p)
+	}
+	for _, h := range held {
+		if h == p[0] {
+			t.Fatalf("Held message proposed again: %q", p[0])
+		}
+	}
+	fmt.Fprint(srv, "FS -\r")
+	if line, _ := rd.ReadString('\r'); line != "FQ\r" {
+		t.Errorf("Expected FQ, got %q", line)
+	}
+	srv.Close()
+
+	if err := <-errs; err != nil {
+		t.Fatalf("Session exchange returned error: %s", err)
+	}
+}
+
+func TestDeferralPolicyRetryAfter(t *testing.T) {
+	p := DeferralPolicy{Delay: time.Minute, MaxDelay: 10 * time.Minute}
+	tests := map[int]time.Duration{
+		1: time.Minute,
+		2: 2 * time.Minute,
+		4: 8 * time.Minute,
+		5: 10 * time.Minute,
+		9: 10 * time.Minute,
+	}
+	for attempts, expected := range tests {
+		if got := p.RetryAfter(attempts); got != expected {
+			t.Errorf("RetryAfter(%d): expected %s, got %s", attempts, expected, got)
+		}
+	}
+}
+
+func TestSessionGzipFallback(t *testing.T) {
+	os.Setenv("GZIP_EXPERIMENT", "1")
+	defer os.Unsetenv("GZIP_EXPERIMENT")
+
+	a, b := newTestMessage("LA5NTA", "N0CALL", 1000), newTestMessage("LA5NTA", "N0CALL", 1000)
+	clientMBox, masterMBox := newMemMBox(a, b), newMemMBox()
+
+	var codes []string // The proposal codes seen by master
+	masterMBox.answerFunc = func(p Proposal) ProposalAnswer {
+		codes = append(codes, fmt.Sprintf("%s:%c", p.MID(), p.code))
+		if p.MID() == b.MID() && p.code == GzipProposal {
+			return Defer // Reject gzip for this message only
+		}
+		return Accept
+	}
+
+	client, master := tcpPipe(t)
+
+	type result struct {
+		stats TrafficStats
+		err   error
+	}
+	clientRes := make(chan result)
+	go func() {
+		stats, err := NewSession("LA5NTA", "N0CALL", "JO39EQ", clientMBox).Exchange(client)
+		clientRes <- result{stats, err}
+	}()
+
+	s := NewSession("N0CALL", "LA5NTA", "JO39EQ", masterMBox)
+	s.IsMaster(true)
+	if _, err := s.Exchange(master); err != nil {
+		t.Errorf("Master returned with error: %s", err)
+	}
+	res := <-clientRes
+	if res.err != nil {
+		t.Fatalf("Client returned with error: %s", res.err)
+	}
+
+	expected := []string{a.MID() + ":D", b.MID() + ":D", b.MID() + ":C"}
+	sort.Strings(codes[:2]) // The first block is sorted by size
+	sort.Strings(expected[:2])
+	if !reflect.DeepEqual(codes, expected) {
+		t.Errorf("Unexpected proposals. Got %q, expected %q", codes, expected)
+	}
+	if len(res.stats.Sent) != 2 || len(res.stats.Deferred) != 0 {
+		t.Errorf("Expected both messages sent and none deferred, got %+v", res.stats)
+	}
+	if inbox := masterMBox.inbox(); len(inbox) != 2 {
+		t.Errorf("Expected 2 received messages, got %d", len(inbox))
+	}
+}
+
+func TestSessionReceiveOnly(t *testing.T) {
+	mbox := newMemMBox(newTestMessage("LA5NTA", "N0CALL", 100))
+
+	client, srv := net.Pipe()
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", mbox)
+	s.SetDirection(Receive)
+
+	cerrs := make(chan error)
+	go func() {
+		_, err := s.Exchange(client)
+		cerrs <- err
+	}()
+
+	fmt.Fprint(srv, "[WL2K-2.8.4.8-B2FWIHJM$]\r")
+	fmt.Fprint(srv, "Test CMS >\r")
+
+	rd := bufio.NewReader(srv)
+	for {
+		line, err := rd.ReadString('\r')
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		} else if strings.HasPrefix(line, "FC") || strings.HasPrefix(line, "F>") {
+			t.Errorf("Unexpected proposal in receive only mode: %q", line)
+		} else if line == "FF\r" {
+			break
+		}
+	}
+	fmt.Fprint(srv, "FQ\r")
+	srv.Close()
+
+	if err := <-cerrs; err != nil {
+		t.Errorf("Session exchange returned error: %s", err)
+	}
+	if len(mbox.sent) > 0 || len(mbox.deferred) > 0 {
+		t.Errorf("Expected outbound message to be left untouched")
+	}
+}
+
+func TestSessionSendOnly(t *testing.T) {
+	mbox := newMemMBox()
+
+	client, srv := net.Pipe()
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", mbox)
+	s.AddAuxiliaryAddress(AddressFromString("LE1OF"))
+	s.SetDirection(Send)
+
+	cerrs := make(chan error)
+	go func() {
+		_, err := s.Exchange(client)
+		cerrs <- err
+	}()
+
+	fmt.Fprint(srv, "[WL2K-2.8.4.8-B2FWIHJM$]\r")
+	fmt.Fprint(srv, "Test CMS >\r")
+
+	rd := bufio.NewReader(srv)
+	for line := ""; line != "FF\r"; {
+		line, _ = rd.ReadString('\r')
+		if strings.HasPrefix(line, ";FW") && line != ";FW: LA5NTA\r" {
+			t.Errorf("Unexpected FW line in send only mode: %q", line)
+		}
+	}
+
+	fmt.Fprintf(srv, "FC EM TJKYEIMMHSRB 527 123 0\r")
+	fmt.Fprintf(srv, "F> 3B\r")
+
+	if line, _ := rd.ReadString('\r'); line != "FS =\r" {
+		t.Errorf("Expected 'FS =', got '%s'", line)
+	}
+	fmt.Fprintf(srv, "FF\r")
+	rd.ReadString('\r') // FQ
+
+	if err := <-cerrs; err != nil {
+		t.Fatalf("Session exchange returned error: %s", err)
+	}
+	if len(mbox.answered) > 0 {
+		t.Errorf("Expected the handler to not be consulted in send only mode")
+	}
+}
+
+func TestSessionMessageExpiry(t *testing.T) {
+	valid, expired := newTestMessage("LA5NTA", "N0CALL", 100), newTestMessage("LA5NTA", "N0CALL", 100)
+	mbox := newMemMBox(valid, expired)
+
+	client, srv := net.Pipe()
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", mbox)
+	s.SetMessageExpiryFunc(func(p Proposal) bool { return p.MID() == expired.MID() })
+
+	type result struct {
+		stats TrafficStats
+		err   error
+	}
+	results := make(chan result)
+	go func() {
+		stats, err := s.Exchange(client)
+		results <- result{stats, err}
+	}()
+
+	fmt.Fprint(srv, "[WL2K-2.8.4.8-B2FWIHJM$]\r")
+	fmt.Fprint(srv, "Test CMS >\r")
+
+	var proposals []string
+	rd := bufio.NewReader(srv)
+	for {
+		line, err := rd.ReadString('\r')
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		} else if strings.HasPrefix(line, "FC") {
+			proposals = append(proposals, line)
+		} else if strings.HasPrefix(line, "F>") {
+			break
+		}
+	}
+	fmt.Fprint(srv, "FS -\r") // Already received
+	rd.ReadString('\r')       // FF (turnover)
+	fmt.Fprint(srv, "FQ\r")
+	srv.Close()
+
+	res := <-results
+	if res.err != nil {
+		t.Fatalf("Session exchange returned error: %s", res.err)
+	}
+	if len(proposals) != 1 || !strings.Contains(proposals[0], valid.MID()) {
+		t.Errorf("Expected only %s to be proposed, got %q", valid.MID(), proposals)
+	}
+	if !reflect.DeepEqual(res.stats.Expired, []string{expired.MID()}) {
+		t.Errorf("Expected %s to be recorded as expired, got %q", expired.MID(), res.stats.Expired)
+	}
+	if _, ok := mbox.sent[expired.MID()]; ok || mbox.deferred[expired.MID()] {
+		t.Errorf("Expected expired message to be left untouched")
+	}
+}
+
+// closeRecorder is an io.WriteCloser recording the data written to it.
+type closeRecorder struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (c *closeRecorder) Close() error { c.closed = true; return nil }
+
+func TestSessionInboundStream(t *testing.T) {
+	for _, force := range []bool{false, true} {
+		msg := newTestMessage("LA5NTA", "N0CALL", 100000)
+
+		// received returns the message bytes as received by the master, with or without streaming enabled.
+		received := func(stream bool) []byte {
+			clientMBox, masterMBox := newMemMBox(msg), newMemMBox()
+
+			var rec *closeRecorder
+			client := NewSession("LA5NTA", "N0CALL", "JO39EQ", clientMBox)
+			client.SetForceUncompressed(force)
+			master := NewSession("N0CALL", "LA5NTA", "JO39EQ", masterMBox)
+			if stream {
+				master.SetInboundStreamFunc(func(p Proposal) (io.WriteCloser, error) {
+					if p.MID() != msg.MID() {
+						t.Errorf("Unexpected proposal %s", p.MID())
+					}
+					rec = &closeRecorder{}
+					return rec, nil
+				})
+			}
+			_, stats := exchange(t, client, master)
+			if !reflect.DeepEqual(stats.Received, []string{msg.MID()}) {
+				t.Errorf("force=%t, stream=%t: Unexpected received MIDs: %q", force, stream, stats.Received)
+			}
+
+			inbox := masterMBox.inbox()
+			switch {
+			case !stream && len(inbox) == 1:
+				b, _ := inbox[0].Bytes()
+				return b
+			case stream && len(inbox) > 0:
+				t.Errorf("force=%t: Streamed message passed to ProcessInbound", force)
+			case stream && rec != nil:
+				if !rec.closed {
+					t.Errorf("force=%t: Stream writer not closed", force)
+				}
+				return rec.Bytes()
+			}
+			t.Fatalf("force=%t, stream=%t: Message not received", force, stream)
+			return nil
+		}
+
+		buffered, streamed := received(false), received(true)
+		if !bytes.Equal(buffered, streamed) {
+			t.Errorf("force=%t: Streamed message (%d bytes) differs from buffered (%d bytes)", force, len(streamed), len(buffered))
+		}
+	}
+}
+
+func TestSessionID(t *testing.T) {
+	cs := NewSession("LA5NTA", "N0CALL", "JO39EQ", newMemMBox(newTestMessage("LA5NTA", "N0CALL", 1000)))
+	ms := NewSession("N0CALL", "LA5NTA", "JO39EQ", newMemMBox())
+
+	if cs.ID() == "" || cs.ID() == ms.ID() {
+		t.Fatalf("Expected distinct session IDs, got %q and %q", cs.ID(), ms.ID())
+	}
+
+	clientStatus, masterStatus := new(statusRecorder), new(statusRecorder)
+	cs.SetStatusUpdater(clientStatus)
+	ms.SetStatusUpdater(masterStatus)
+	exchange(t, cs, ms)
+
+	for s, rec := range map[*Session]*statusRecorder{cs: clientStatus, ms: masterStatus} {
+		updates := rec.all()
+		if len(updates) == 0 {
+			t.Errorf("%s: No status updates", s.Mycall())
+		}
+		for _, u := range updates {
+			if u.SessionID != s.ID() {
+				t.Errorf("%s: Expected session ID %q, got %q", s.Mycall(), s.ID(), u.SessionID)
+				break
+			}
+		}
+	}
+}
+
+func TestSessionRemoteAddr(t *testing.T) {
+	client, master := tcpPipe(t)
+
+	cs := NewSession("LA5NTA", "N0CALL", "JO39EQ", nil)
+	ms := NewSession("N0CALL", "LA5NTA", "JO39EQ", nil)
+	if cs.RemoteAddr() != nil {
+		t.Errorf("Expected nil remote address before Exchange, got %s", cs.RemoteAddr())
+	}
+
+	if _, _, cErr, mErr := exchangeConns(cs, ms, client, master); cErr != nil || mErr != nil {
+		t.Fatalf("Exchange failed: %v, %v", cErr, mErr)
+	}
+
+	if addr := cs.RemoteAddr(); addr == nil || addr.String() != master.LocalAddr().String() {
+		t.Errorf("Expected client's remote address %s, got %v", master.LocalAddr(), addr)
+	}
+	if addr := ms.RemoteAddr(); addr == nil || addr.String() != client.LocalAddr().String() {
+		t.Errorf("Expected master's remote address %s, got %v", client.LocalAddr(), addr)
+	}
+}
+
+// checkGoroutineLeaks fails the test if the number of goroutines does not return to n (waiting up to 2 seconds).
+func checkGoroutineLeaks(t *testing.T, n int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("Goroutine leak: %d goroutines, expected %d\n%s", runtime.NumGoroutine(), n, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	client, srv := tcpPipe(t)
+	defer srv.Close()
+
+	s := NewSession("LA5NTA", "N0CALL", "JO39EQ", newMemMBox())
+	errs := make(chan error)
+	go func() {
+		_, err := s.Exchange(client)
+		errs <- err
+	}()
+
+	// Wait for the session to block reading the remote's handshake
+	time.Sleep(50 * time.Millisecond)
+
+	if err := s.Close(); err != nil {
+		t.Errorf("Close returned error: %s", err)
+	}
+	select {
+	case err := <-errs:
+		if err != ErrAborted {
+			t.Errorf("Expected ErrAborted, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Exchange did not return after Close")
+	}
+
+	// Close is idempotent
+	if err := s.Close(); err != nil {
+		t.Errorf("Second Close returned error: %s", err)
+	}
+
+	// Exchange on a closed session
+	a, b := tcpPipe(t)
+	defer b.Close()
+	if _, err := s.Exchange(a); err != ErrAborted {
+		t.Errorf("Expected ErrAborted from closed session, got %v", err)
+	}
+
+	srv.Close()
+	b.Close()
+	checkGoroutineLeaks(t, before)
+}
+
+func TestSessionTurnoverTimeout(t *testing.T) {
+	const timeout = 300 * time.Millisecond
+	for _, delay := range []time.Duration{50 * time.Millisecond, 2 * timeout} {
+		client, srv := tcpPipe(t)
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", newMemMBox())
+		s.SetTurnoverTimeout(timeout)
+
+		cerrs := make(chan error)
+		go func() {
+			_, err := s.Exchange(client)
+			cerrs <- err
+		}()
+
+		fmt.Fprint(srv, "[WL2K-2.8.4.8-B2FWIHJM$]\r")
+		fmt.Fprint(srv, "Test CMS >\r")
+
+		rd := bufio.NewReader(srv)
+		for line := ""; line != "FF\r"; {
+			line, _ = rd.ReadString('\r')
+		}
+		time.Sleep(delay)
+		fmt.Fprint(srv, "FQ\r")
+
+		err := <-cerrs
+		srv.Close()
+		switch {
+		case delay < timeout && err != nil:
+			t.Errorf("delay=%s: Unexpected error: %s", delay, err)
+		case delay > timeout && err != ErrTurnoverTimeout:
+			t.Errorf("delay=%s: Expected ErrTurnoverTimeout, got %v", delay, err)
+		}
+	}
+}
+
+func TestSessionMessageStats(t *testing.T) {
+	msg := NewMessage(Private, "LA5NTA")
+	msg.AddTo("N0CALL")
+	msg.SetSubject("Compressible")
+	msg.SetBody(strings.Repeat("All work and no play makes Jack a dull boy\n", 200))
+	prop, err := msg.Proposal(Wl2kProposal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := MessageStats{MID: msg.MID(), Size: prop.size, CompressedSize: prop.compressedSize}
+	if expect.CompressionRatio() < 10 {
+		t.Fatalf("Test message compressed poorly: %d -> %d", expect.Size, expect.CompressedSize)
+	}
+
+	cStats, mStats := exchange(t, NewSession("LA5NTA", "N0CALL", "JO39EQ", newMemMBox(msg)), NewSession("N0CALL", "LA5NTA", "JO39EQ", newMemMBox()))
+	for _, st := range []TrafficStats{cStats, mStats} {
+		if len(st.Messages) != 1 {
+			t.Fatalf("Expected 1 message stat, got %v", st.Messages)
+		}
+		got := st.Messages[0]
+		expect.Direction = Outbound
+		if len(st.Received) > 0 {
+			expect.Direction = Inbound
+		}
+		if got != expect {
+			t.Errorf("Expected %+v, got %+v", expect, got)
+		}
+	}
+}
+
+func TestMessageStatsCompressionRatio(t *testing.T) {
+	tests := map[MessageStats]float64{
+		{Size: 1000, CompressedSize: 250}:  4,
+		{Size: 1000, CompressedSize: 1000}: 1,
+		{Size: 1000}:                       0,
+	}
+	for stats, expect := range tests {
+		if got := stats.CompressionRatio(); got != expect {
+			t.Errorf("%+v: Expected %v, got %v", stats, expect, got)
+		}
+	}
+}
+
+func TestSessionMaxInFlight(t *testing.T) {
+	for _, limit := range []int{1, 2, 0} {
+		var msgs []*Message
+		for i := 0; i < 4; i++ {
+			msgs = append(msgs, newTestMessage("LA5NTA", "N0CALL", 100))
+		}
+		masterMBox := newMemMBox()
+
+		s := NewSession("LA5NTA", "N0CALL", "JO39EQ", newMemMBox(msgs...))
+		s.SetMaxInFlight(limit)
+		events := s.Events() // Buffered, and closed when the exchange returns
+		exchange(t, s, NewSession("N0CALL", "LA5NTA", "JO39EQ", masterMBox))
+
+		// Count the proposals of each block
+		var blocks []int
+		inBlock := false
+		for e := range events {
+			switch {
+			case e.Type == ProposalOffered && e.Direction == Outbound:
+				if !inBlock {
+					blocks, inBlock = append(blocks, 0), true
+				}
+				blocks[len(blocks)-1]++
+			case e.Type == MessageStarted:
+				inBlock = false
+			}
+		}
+
+		expect := []int{1, 1, 1, 1}
+		switch limit {
+		case 2:
+			expect = []int{2, 2}
+		case 0:
+			expect = []int{4}
+		}
+		if !reflect.DeepEqual(blocks, expect) {
+			t.Errorf("limit %d: Unexpected proposal blocks %v", limit, blocks)
+		}
+		if len(masterMBox.inbox()) != len(msgs) {
+			t.Errorf("limit %d: Expected %d messages delivered, got %d", limit, len(msgs), len(masterMBox.inbox()))
+		}
+	}
+}
+
+func TestTrafficStatsJSON(t *testing.T) {
+	stats := TrafficStats{
+		Received: []string{"AAA"},
+		Deferred: []Deferral{{MID: "BBB", Reason: HeldByRemote}},
+		Errors:   []*MessageError{{MID: "CCC", Err: ErrCompressionMismatch}},
+		Refused:  []Refusal{{MID: "DDD", Answer: Defer, Reason: "busy"}},
+		Messages: []MessageStats{{MID: "AAA", Direction: Inbound, Size: 100, CompressedSize: 50}},
+	}
+	data, err := json.Marshal(stats)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	var got struct {
+		Received []string
+		Deferred []map[string]interface{}
+		Errors   []map[string]interface{}
+		Refused  []map[string]interface{}
+		Messages []map[string]interface{}
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	switch {
+	case !reflect.DeepEqual(got.Received, []string{"AAA"}):
+		t.Errorf("Unexpected Received: %s", data)
+	case got.Deferred[0]["Reason"] != "held by remote":
+		t.Errorf("Expected the deferral reason as a string, got %s", data)
+	case got.Errors[0]["MID"] != "CCC" || got.Errors[0]["Err"] != ErrCompressionMismatch.Error():
+		t.Errorf("Expected the message error as a string, got %s", data)
+	case got.Refused[0]["Answer"] != "=" || got.Refused[0]["Reason"] != "busy":
+		t.Errorf("Expected the refusal answer as a string, got %s", data)
+	case got.Messages[0]["Direction"] != "inbound" || got.Messages[0]["CompressedSize"] != float64(50):
+		t.Errorf("Unexpected message stats: %s", data)
+	}
+}
+
+// statusFunc is a StatusUpdater calling a function.
+type statusFunc func(s Status)
+
+func (f statusFunc) UpdateStatus(s Status) { f(s) }
+
+func TestSessionCancelInbound(t *testing.T) {
+	msgs := []*Message{
+		newTestMessage("LA5NTA", "N0CALL", 500),
+		newTestMessage("LA5NTA", "N0CALL", 20000), // Cancelled
+		newTestMessage("LA5NTA", "N0CALL", 1000),
+	}
+	cancel := msgs[1].MID()
+	clientMBox, masterMBox := newMemMBox(msgs...), newMemMBox()
+
+	client, master := tcpPipe(t)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := NewSession("LA5NTA", "N0CALL", "JO39EQ", clientMBox).Exchange(client)
+		errs <- err
+	}()
+
+	s := NewSession("N0CALL", "LA5NTA", "JO39EQ", masterMBox)
+	s.IsMaster(true)
+	s.SetStatusUpdater(statusFunc(func(st Status) {
+		if st.Receiving != nil && st.Receiving.MID() == cancel {
+			s.CancelInbound(cancel)
+		}
+	}))
+	stats, err := s.Exchange(master)
+	if err != nil {
+		t.Fatalf("Unexpected master error: %s", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Unexpected client error: %s", err)
+	}
+
+	var received []string
+	for _, msg := range masterMBox.inbox() {
+		received = append(received, msg.MID())
+	}
+	sort.Strings(received)
+	expect := []string{msgs[0].MID(), msgs[2].MID()}
+	sort.Strings(expect)
+	if !reflect.DeepEqual(received, expect) {
+		t.Errorf("Expected %v to be stored, got %v", expect, received)
+	}
+	if expect := []Refusal{{MID: cancel, Answer: Reject, Reason: "cancelled"}}; !reflect.DeepEqual(stats.Refused, expect) {
+		t.Errorf("Expected %v, got %v", expect, stats.Refused)
+	}
+}
+
+func TestSessionBIDObserver(t *testing.T) {
+	out := newTestMessage("LA5NTA", "N0CALL", 100)
+	in := newTestMessage("N0CALL", "LA5NTA", 100)
+
+	var mu sync.Mutex
+	observed := make(map[string][]Direction)
+	observer := func(bid string, dir Direction) {
+		mu.Lock()
+		defer mu.Unlock()
+		observed[bid] = append(observed[bid], dir)
+	}
+
+	client := NewSession("LA5NTA", "N0CALL", "JO39EQ", newMemMBox(out))
+	client.SetBIDObserver(observer)
+	master := NewSession("N0CALL", "LA5NTA", "JO39EQ", newMemMBox(in))
+	exchange(t, client, master)
+
+	expect := map[string][]Direction{out.MID(): {Outbound}, in.MID(): {Inbound}}
+	if !reflect.DeepEqual(observed, expect) {
+		t.Errorf("Expected %v, got %v", expect, observed)
+	}
+}
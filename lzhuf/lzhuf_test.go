@@ -7,11 +7,13 @@ package lzhuf
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 var testdataPath = "testdata/"
@@ -104,6 +106,35 @@ func TestReaderShortRead(t *testing.T) {
 	}
 }
 
+func TestReaderSizeOvershoot(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, false)
+	w.Write(bytes.Repeat([]byte("abc"), 100))
+	w.Close()
+
+	// Shrink the filesize header, so that the first match is decoded past it
+	data := buf.Bytes()
+	binary.LittleEndian.PutUint32(data, 5)
+
+	lz, _ := NewReader(bytes.NewReader(data), false)
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(ioutil.Discard, lz)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != ErrChecksum {
+			t.Errorf("Read: Expected ErrChecksum, got '%v'", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read did not return")
+	}
+	if err := lz.Close(); err != ErrChecksum {
+		t.Errorf("Close: Expected ErrChecksum, got '%v'", err)
+	}
+}
+
 func TestReaderInvalidHeader(t *testing.T) {
 	var err error
 
@@ -108,6 +108,9 @@ func (d *Reader) Read(p []byte) (n int, err error) {
 		d.err = d.r.Err()
 	case d.state.pos == d.header.size && d.state.buf.Len() == 0:
 		return 0, io.EOF
+	case d.state.pos > d.header.size:
+		// Corrupt data decoded past the filesize header. Nothing more can be read.
+		d.err = ErrChecksum
 	}
 
 	if d.err != nil {